@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/codegangsta/negroni"
 	"github.com/julienschmidt/httprouter"
@@ -12,11 +13,12 @@ import (
 	"time"
 )
 
-var DnsTypes = map[string]uint16{"A": dns.TypeA}
+// Largest request body we accept
+const maxApiBody = 1 << 20
 
 func PanicHandler(w http.ResponseWriter, r *http.Request, p interface{}) {
 	handlePanic(p)
-	Json(w, "Internal Error", 500)
+	ApiErr(w, apiError(500, "internal", "Internal Error"))
 }
 
 func LogMiddleWare(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
@@ -27,64 +29,306 @@ func LogMiddleWare(rw http.ResponseWriter, r *http.Request, next http.HandlerFun
 	log.Printf("Completed: %s %s -- %d (%v)", r.Method, r.URL.Path, res.Status(), dur)
 }
 
-func Json(w http.ResponseWriter, text string, code int) {
+func Json(w http.ResponseWriter, v interface{}, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, text)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Unable to write response: %s", err.Error())
+	}
 }
 
-func ApiPutHost(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
-	dnsType := strings.ToUpper(ps.ByName("type"))
-	host := ps.ByName("host")
-	addr := ps.ByName("ip")
-	dt, ok := DnsTypes[dnsType]
+// Write err as {"error": {...}}. Anything that isn't an ApiError is a failure of the record store
+func ApiErr(w http.ResponseWriter, err error) {
+	ae, ok := err.(*ApiError)
 	if !ok {
-		Json(w, "Address type not found", 404)
+		ae = apiError(500, "store_error", "%s", err.Error())
+	}
+	Json(w, map[string]*ApiError{"error": ae}, ae.Status)
+}
+
+// Decode a JSON request body into v. Unknown fields are an error, so typos don't go unnoticed
+func readBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxApiBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiError(400, "invalid_body", "Invalid request body: %s", err.Error())
+	}
+	return nil
+}
+
+// Record type and name from the path
+func recordKey(ps httprouter.Params) (dnsType uint16, name string, err error) {
+	if dnsType, err = parseType(ps.ByName("type")); err != nil {
 		return
 	}
-	recs.Put(dt, host, addr)
-	Json(w, "ok", 200)
+	name, err = parseName(ps.ByName("host"))
+	return
 }
 
-func ApiDelHost(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
-	dnsType := strings.ToUpper(ps.ByName("type"))
-	host := ps.ByName("host")
-	dt, ok := DnsTypes[dnsType]
-	if !ok {
-		Json(w, "Address type not found", 404)
+// The source a client acts for. It can't be one of gloon's own, or clients could pass their
+// changes off as coming from docker or a hostfile
+func apiSource(source string) (string, error) {
+	if source == "" {
+		return defaultApiSource, nil
+	}
+	if internalSources[source] {
+		return "", apiError(http.StatusBadRequest, "invalid_source", "Source %q is reserved for records gloon publishes itself", source)
+	}
+	return source, nil
+}
+
+func ApiGetRecord(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	dt, name, err := recordKey(ps)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	rec, err := loadRecord(recs, dt, name)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	Json(w, rec, 200)
+}
+
+// Create a record. It is a conflict if it already exists
+func ApiCreateRecord(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	var rec ApiRecord
+	if err := readBody(w, r, &rec); err != nil {
+		ApiErr(w, err)
+		return
+	}
+	dt, err := parseType(rec.Type)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	rec.Name, err = parseName(rec.Name)
+	if err != nil {
+		ApiErr(w, err)
 		return
 	}
-	recs.Del(dt, host)
-	Json(w, "ok", 200)
+	putRecord(w, r, recs, dt, rec, true)
 }
 
+// Replace all values of a record, creating it if needed
+func ApiReplaceRecord(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	dt, name, err := recordKey(ps)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	var rec ApiRecord
+	if err := readBody(w, r, &rec); err != nil {
+		ApiErr(w, err)
+		return
+	}
+	if (rec.Type != "" && strings.ToUpper(rec.Type) != dns.TypeToString[dt]) || (rec.Name != "" && strings.TrimSuffix(rec.Name, ".") != name) {
+		ApiErr(w, apiError(400, "invalid_body", "Type and name in the body do not match the path"))
+		return
+	}
+	rec.Name = name
+	putRecord(w, r, recs, dt, rec, false)
+}
+
+// Store rec, answering 201 if this created it. With create, an existing record is a conflict. The
+// check is made while planning, so nothing can create the record in between
+func putRecord(w http.ResponseWriter, r *http.Request, recs *RecordSet, dt uint16, rec ApiRecord, create bool) {
+	vals, err := parseValues(dt, rec.Values)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	if len(vals) == 0 {
+		ApiErr(w, apiError(400, "invalid_value", "A record needs at least one value"))
+		return
+	}
+	source, err := apiSource(rec.Source)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	code := 200
+	_, err = runPlan(r, recs, false, func(bp *batchPlan) error {
+		rp, err := bp.record(dt, rec.Name)
+		if err != nil {
+			return err
+		}
+		if len(rp.vals) > 0 && create {
+			return apiError(409, "conflict", "%s record for %s already exists", dns.TypeToString[dt], rec.Name)
+		} else if len(rp.vals) == 0 {
+			code = 201
+		}
+		return bp.put(dt, rec.Name, vals, rec.Ttl, source)
+	})
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	stored, err := loadRecord(recs, dt, rec.Name)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	Json(w, stored, code)
+}
+
+// Add or remove individual values. Removing the last value deletes the record
+func ApiPatchRecord(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	dt, name, err := recordKey(ps)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	var patch ApiPatch
+	if err := readBody(w, r, &patch); err != nil {
+		ApiErr(w, err)
+		return
+	}
+	patchRecord(w, r, recs, dt, name, patch, true)
+}
+
+// Apply patch to a record. With mustExist, a missing record is not_found, checked while planning
+func patchRecord(w http.ResponseWriter, r *http.Request, recs *RecordSet, dt uint16, name string, patch ApiPatch, mustExist bool) {
+	add, err := parseValues(dt, patch.Add)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	remove, err := parseValues(dt, patch.Remove)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	source, err := apiSource(patch.Source)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	_, err = runPlan(r, recs, false, func(bp *batchPlan) error {
+		rp, err := bp.record(dt, name)
+		if err != nil {
+			return err
+		}
+		if len(rp.vals) == 0 && mustExist {
+			return apiError(http.StatusNotFound, "not_found", "No %s record for %s", dns.TypeToString[dt], name)
+		}
+		return bp.patch(dt, name, add, remove, patch.Ttl, source)
+	})
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	stored, err := loadRecord(recs, dt, name)
+	if ae, ok := err.(*ApiError); ok && ae.Status == 404 {
+		w.WriteHeader(204)
+		return
+	} else if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	Json(w, stored, 200)
+}
+
+// Delete a record and all its values. The source to act for can be given as ?source=
+func ApiDeleteRecord(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	dt, name, err := recordKey(ps)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	source, err := apiSource(r.URL.Query().Get("source"))
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	_, err = runPlan(r, recs, false, func(bp *batchPlan) error {
+		return bp.remove(dt, name, nil, source)
+	})
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// Add a single value. Same as PATCH with {"add": [ip]}
+func ApiPutHost(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	dt, name, err := recordKey(ps)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	patchRecord(w, r, recs, dt, name, ApiPatch{Add: []string{ps.ByName("ip")}}, false)
+}
+
+// Remove a single value. Same as PATCH with {"remove": [addr]}
 func ApiDelHostAddr(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
-	dnsType := strings.ToUpper(ps.ByName("type"))
-	host := ps.ByName("host")
-	addr := ps.ByName("addr")
-	dt, ok := DnsTypes[dnsType]
-	if !ok {
-		Json(w, "Address type not found", 404)
+	dt, name, err := recordKey(ps)
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	if _, err := loadRecord(recs, dt, name); err != nil {
+		ApiErr(w, err)
+		return
+	}
+	patchRecord(w, r, recs, dt, name, ApiPatch{Remove: []string{ps.ByName("addr")}}, false)
+}
+
+// Re-read configuration and apply it
+func ApiReload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, reload func() error) {
+	if err := reload(); err != nil {
+		ApiErr(w, apiError(500, "reload_failed", "%s", err.Error()))
 		return
 	}
-	recs.DelAddr(dt, host, addr)
-	Json(w, "ok", 200)
+	Json(w, map[string]string{"status": "reloaded"}, 200)
 }
 
-func RunApiServer(settings *Settings, recs *RecordSet) {
+// Build the api http server. The caller runs and shuts it down
+func NewApiServer(settings *Settings, recs *RecordSet, reload func() error) (srv *http.Server, err error) {
+	var auth *ApiAuth
+	if settings.ApiTokensFile != "" {
+		if auth, err = LoadApiTokens(settings.ApiTokensFile); err != nil {
+			return nil, fmt.Errorf("Unable to load api tokens: %s", err.Error())
+		}
+	}
+	tlsConfig, err := apiTlsConfig(settings)
+	if err != nil {
+		return
+	}
+	if auth != nil && tlsConfig == nil {
+		log.Printf("WARNING: api tokens are sent in the clear. Use --api-tls-cert and --api-tls-key to serve the api over https")
+	}
 	router := httprouter.New()
 	router.PanicHandler = PanicHandler
-	router.PUT("/records/:type/:host/:ip", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		ApiPutHost(w, r, ps, recs)
-	})
-	router.DELETE("/records/:type/:host", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		ApiDelHost(w, r, ps, recs)
+	route := func(method, path string, handler func(http.ResponseWriter, *http.Request, httprouter.Params, *RecordSet)) {
+		router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			handler(w, r, ps, recs)
+		})
+	}
+	route("POST", "/records", ApiCreateRecord)
+	route("POST", "/records/batch", ApiBatchRecords)
+	route("GET", "/records/:type/:host", ApiGetRecord)
+	route("PUT", "/records/:type/:host", ApiReplaceRecord)
+	route("PATCH", "/records/:type/:host", ApiPatchRecord)
+	route("DELETE", "/records/:type/:host", ApiDeleteRecord)
+	// Single value routes from before the JSON api
+	route("PUT", "/records/:type/:host/:ip", ApiPutHost)
+	route("DELETE", "/records/:type/:host/:addr", ApiDelHostAddr)
+	// Event streams end when the server shuts down, which would otherwise wait for them
+	done := make(chan struct{})
+	router.GET("/events", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ApiEvents(w, r, ps, recs, done)
 	})
-	router.DELETE("/records/:type/:host/:addr", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		ApiDelHostAddr(w, r, ps, recs)
+	router.POST("/reload", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ApiReload(w, r, ps, reload)
 	})
 	n := negroni.New()
 	n.Use(negroni.HandlerFunc(LogMiddleWare))
+	n.Use(negroni.HandlerFunc(auth.Middleware))
 	n.UseHandler(router)
-	log.Fatal(http.ListenAndServe(settings.ApiAddr, n))
+	srv = &http.Server{Addr: settings.ApiAddr, Handler: n, TLSConfig: tlsConfig}
+	srv.RegisterOnShutdown(func() { close(done) })
+	return
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Scopes a token can be granted
+const (
+	ScopeRead  = "read"  // GET requests only
+	ScopeWrite = "write" // Read, and change records. "write:PATTERN" limits changes to names matching PATTERN
+	ScopeAdmin = "admin" // Everything, including reload
+)
+
+// An api token and what it may do
+type ApiToken struct {
+	Name   string // Used in logs. Never the secret itself
+	secret string
+	admin  bool
+	read   bool
+	write  []string // Name patterns the token can change. "*" matches any name
+}
+
+// Tokens accepted by the api. A nil ApiAuth lets every request through
+type ApiAuth struct {
+	tokens []*ApiToken
+}
+
+// Load tokens from a file with one token per line, as NAME TOKEN SCOPE [SCOPE...]. Blank lines
+// and lines starting with # are ignored. Ex.
+//
+//	ci     3b1f...  write:*.ci.example.com
+//	viewer 9ac4...  read
+func LoadApiTokens(fn string) (auth *ApiAuth, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	auth = &ApiAuth{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected NAME TOKEN SCOPE [SCOPE...]", fn, n)
+		}
+		tok := &ApiToken{Name: fields[0], secret: fields[1]}
+		for _, scope := range fields[2:] {
+			if err = tok.grant(scope); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", fn, n, err.Error())
+			}
+		}
+		auth.tokens = append(auth.tokens, tok)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(auth.tokens) == 0 {
+		return nil, fmt.Errorf("No tokens in %s", fn)
+	}
+	return
+}
+
+func (tok *ApiToken) grant(scope string) error {
+	parts := strings.SplitN(scope, ":", 2)
+	switch {
+	case scope == ScopeAdmin:
+		tok.admin = true
+	case scope == ScopeRead:
+		tok.read = true
+	case parts[0] == ScopeWrite:
+		pattern := "*"
+		if len(parts) == 2 {
+			pattern = strings.TrimSuffix(parts[1], ".")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid name pattern in %s", scope)
+		}
+		tok.write = append(tok.write, pattern)
+	default:
+		return fmt.Errorf("Unknown scope %s", scope)
+	}
+	return nil
+}
+
+func (tok *ApiToken) canRead() bool {
+	return tok.admin || tok.read || len(tok.write) > 0
+}
+
+// Whether the token may change records named name. Patterns match the whole name, so
+// write:*.example.com can't be used to add a *.com wildcard
+func (tok *ApiToken) canWrite(name string) bool {
+	if tok.admin {
+		return true
+	}
+	for _, pattern := range tok.write {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The token presented as "Authorization: Bearer TOKEN", if it is one of ours
+func (a *ApiAuth) token(r *http.Request) *ApiToken {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil
+	}
+	secret := []byte(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+	var found *ApiToken
+	for _, tok := range a.tokens {
+		// Compare against every token, so timing doesn't tell which one was close
+		if subtle.ConstantTimeCompare(secret, []byte(tok.secret)) == 1 {
+			found = tok
+		}
+	}
+	return found
+}
+
+type apiTokenKey struct{}
+
+// Checks the token on every request. Reads need any scope, record changes a write scope (names are
+// checked as changes are planned), and anything else admin
+func (a *ApiAuth) Middleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if a == nil {
+		next(rw, r)
+		return
+	}
+	tok := a.token(r)
+	if tok == nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="gloon"`)
+		ApiErr(rw, apiError(http.StatusUnauthorized, "unauthorized", "A valid bearer token is required"))
+		return
+	}
+	var allowed bool
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD":
+		allowed = tok.canRead()
+	case r.URL.Path == "/records" || strings.HasPrefix(r.URL.Path, "/records/"):
+		allowed = tok.admin || len(tok.write) > 0
+	default:
+		allowed = tok.admin
+	}
+	if !allowed {
+		ApiErr(rw, apiError(http.StatusForbidden, "forbidden", "Token %s is not allowed to %s %s", tok.Name, r.Method, r.URL.Path))
+		return
+	}
+	next(rw, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, tok)))
+}
+
+// Whether the request may change records named name. Requests without a token only get this far
+// when authentication is off
+func canWrite(r *http.Request, name string) bool {
+	tok, ok := r.Context().Value(apiTokenKey{}).(*ApiToken)
+	return !ok || tok.canWrite(name)
+}
+
+// TLS settings for the api server. Client certificates are required when a client CA is set
+func apiTlsConfig(settings *Settings) (cfg *tls.Config, err error) {
+	if settings.ApiTlsCert == "" && settings.ApiTlsKey == "" {
+		if settings.ApiClientCa != "" {
+			return nil, fmt.Errorf("Client certificate verification needs --api-tls-cert and --api-tls-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(settings.ApiTlsCert, settings.ApiTlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load api certificate: %s", err.Error())
+	}
+	cfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if settings.ApiClientCa != "" {
+		pem, err := ioutil.ReadFile(settings.ApiClientCa)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CA: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", settings.ApiClientCa)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTokens = `# name token scopes
+viewer  t-viewer  read
+ci      t-ci      write:*.ci.test
+root    t-root    admin
+`
+
+func newAuthApi(t *testing.T) (http.Handler, *record_set.RecordSet) {
+	dir, err := ioutil.TempDir("", "gloon-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(fn, []byte(testTokens), 0600)
+	recs := record_set.Create(mem_rs.Create())
+	srv, err := NewApiServer(&Settings{ApiTokensFile: fn}, recs, func() error { return nil })
+	if err != nil {
+		t.Fatal("NewApiServer()", err)
+	}
+	return srv.Handler, recs
+}
+
+func authRequest(t *testing.T, h http.Handler, token, method, path, body string, status int) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != status {
+		t.Errorf("%s %s with token %q returned %d -- expected %d (%s)", method, path, token, rec.Code, status, rec.Body.String())
+	}
+}
+
+func TestApiAuth(t *testing.T) {
+	h, recs := newAuthApi(t)
+	recs.Put(dns.TypeA, "web.ci.test", "10.0.0.1")
+	authRequest(t, h, "", "GET", "/records/A/web.ci.test", "", 401)
+	authRequest(t, h, "bogus", "GET", "/records/A/web.ci.test", "", 401)
+	authRequest(t, h, "t-viewer", "GET", "/records/A/web.ci.test", "", 200)
+	authRequest(t, h, "t-viewer", "PUT", "/records/A/web.ci.test/10.0.0.2", "", 403)
+
+	authRequest(t, h, "t-ci", "GET", "/records/A/web.ci.test", "", 200)
+	authRequest(t, h, "t-ci", "PUT", "/records/A/web.ci.test/10.0.0.2", "", 200)
+	authRequest(t, h, "t-ci", "POST", "/records", `{"type": "A", "name": "db.ci.test", "values": ["10.0.0.3"]}`, 201)
+	authRequest(t, h, "t-ci", "POST", "/records", `{"type": "A", "name": "db.prod.test", "values": ["10.0.0.3"]}`, 403)
+	// A wildcard that would capture names outside the pattern
+	authRequest(t, h, "t-ci", "POST", "/records", `{"type": "A", "name": "*.test", "values": ["10.0.0.3"]}`, 403)
+	// One name outside the pattern fails the whole batch
+	authRequest(t, h, "t-ci", "POST", "/records/batch", `{"operations": [
+		{"op": "delete", "type": "A", "name": "db.ci.test"},
+		{"op": "put", "type": "A", "name": "db.prod.test", "values": ["10.0.0.3"]}
+	]}`, 403)
+	expectAddr(t, recs, "db.ci.test.", "10.0.0.3")
+	authRequest(t, h, "t-ci", "POST", "/reload", "", 403)
+
+	// Reverse records of names outside the pattern survive changes to addresses they share
+	recs.Put(dns.TypeA, "db.other.test", "10.0.0.3")
+	authRequest(t, h, "t-ci", "DELETE", "/records/A/db.ci.test", "", 204)
+	authRequest(t, h, "t-ci", "PUT", "/records/A/web.ci.test", `{"values": ["10.0.0.3"]}`, 200)
+	authRequest(t, h, "t-ci", "DELETE", "/records/A/web.ci.test/10.0.0.3", "", 204)
+	if vals := recs.GetAll(dns.TypePTR, "3.0.0.10.in-addr.arpa."); len(vals) != 1 || vals[0] != "db.other.test" {
+		t.Errorf("Got PTR %v -- expected db.other.test", vals)
+	}
+
+	authRequest(t, h, "t-root", "POST", "/records", `{"type": "A", "name": "db.prod.test", "values": ["10.0.0.3"]}`, 201)
+	authRequest(t, h, "t-root", "POST", "/reload", "", 200)
+}
+
+func TestLoadApiTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "tokens")
+	for _, bad := range []string{"ci t-ci", "ci t-ci superuser", "ci t-ci write:[", "# nothing"} {
+		ioutil.WriteFile(fn, []byte(bad+"\n"), 0600)
+		if _, err := LoadApiTokens(fn); err == nil {
+			t.Errorf("LoadApiTokens() accepted %q", bad)
+		}
+	}
+}
+
+// Write a self signed certificate and key for 127.0.0.1, usable by servers and clients
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func TestApiMutualTls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srvCert, srvKey := writeTestCert(t, dir, "server")
+	cliCert, cliKey := writeTestCert(t, dir, "client")
+	settings := &Settings{ApiTlsCert: srvCert, ApiTlsKey: srvKey, ApiClientCa: cliCert}
+	api, err := NewApiServer(settings, record_set.Create(mem_rs.Create()), func() error { return nil })
+	if err != nil {
+		t.Fatal("NewApiServer()", err)
+	}
+	ts := httptest.NewUnstartedServer(api.Handler)
+	ts.TLS = api.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	pemData, _ := ioutil.ReadFile(srvCert)
+	roots.AppendCertsFromPEM(pemData)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	if _, err := client().Get(ts.URL + "/records/A/web.test"); err == nil {
+		t.Error("Request without a client certificate succeeded")
+	}
+	cert, err := tls.LoadX509KeyPair(cliCert, cliKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client(cert).Get(ts.URL + "/records/A/web.test")
+	if err != nil {
+		t.Fatal("Request with a client certificate failed", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("Got status %d -- expected 404", resp.StatusCode)
+	}
+
+	if _, err := NewApiServer(&Settings{ApiClientCa: cliCert}, nil, nil); err == nil {
+		t.Error("NewApiServer() accepted a client CA without a server certificate")
+	}
+}
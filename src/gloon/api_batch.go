@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	. "gloon/record_set"
+	"net/http"
+	"strings"
+)
+
+// Operations to apply together. With DryRun, the changes are reported but not made
+type ApiBatch struct {
+	DryRun     bool         `json:"dry_run"`
+	Operations []ApiBatchOp `json:"operations"`
+}
+
+// "put" replaces the values of a record, like PUT /records/:type/:name. "delete" removes the
+// listed values, or the whole record if there are none
+type ApiBatchOp struct {
+	Op     string   `json:"op"`
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	Values []string `json:"values,omitempty"`
+	Ttl    *uint32  `json:"ttl,omitempty"`
+	Source string   `json:"source,omitempty"`
+}
+
+// A value added to or removed from a record, or a new TTL for it
+type ApiChange struct {
+	Op    string  `json:"op"` // "add", "remove" or "ttl"
+	Type  string  `json:"type"`
+	Name  string  `json:"name"`
+	Value string  `json:"value,omitempty"`
+	Ttl   *uint32 `json:"ttl,omitempty"` // For "ttl". Left out when the record goes back to the server TTL
+}
+
+func newApiChange(op string, dnsType uint16, name, v string) ApiChange {
+	return ApiChange{Op: op, Type: dns.TypeToString[dnsType], Name: name, Value: v}
+}
+
+func newApiTtlChange(dnsType uint16, name string, ttl *uint32) ApiChange {
+	return ApiChange{Op: "ttl", Type: dns.TypeToString[dnsType], Name: name, Ttl: ttl}
+}
+
+type ApiBatchResult struct {
+	DryRun  bool        `json:"dry_run"`
+	Changes []ApiChange `json:"changes"`
+}
+
+// Stored and planned state of a record
+type recordPlan struct {
+	dnsType       uint16
+	name          string
+	current, vals []string // Stored values, and the values we want
+	storedTtl     *uint32  // Stored TTL
+	ttl           *uint32  // The TTL we want
+	stored, owner string   // Stored source, and the source we want
+	by            string   // Source of the last operation on the record, for change events
+}
+
+// Changes to several records, worked out against the store and then applied in one go. Each
+// operation sees the result of the ones before it
+type batchPlan struct {
+	recs    *RecordSet
+	r       *http.Request // Request the changes are made for. Its token must allow changing each record
+	records map[string]*recordPlan
+	order   []*recordPlan
+}
+
+func newBatchPlan(r *http.Request, recs *RecordSet) *batchPlan {
+	return &batchPlan{recs: recs, r: r, records: make(map[string]*recordPlan)}
+}
+
+func (bp *batchPlan) record(dnsType uint16, name string) (rp *recordPlan, err error) {
+	k := fmt.Sprintf("%d/%s", dnsType, name)
+	if rp = bp.records[k]; rp != nil {
+		return
+	}
+	if !canWrite(bp.r, name) {
+		return nil, apiError(http.StatusForbidden, "forbidden", "Not allowed to change %s", name)
+	}
+	rp = &recordPlan{dnsType: dnsType, name: name}
+	if rp.current, err = bp.recs.Values(dnsType, name); err != nil {
+		return
+	}
+	meta, err := bp.recs.Meta(dnsType, name)
+	if err != nil {
+		return
+	}
+	rp.stored, rp.storedTtl = meta.Source, meta.Ttl
+	rp.vals, rp.owner, rp.ttl = rp.current, rp.stored, rp.storedTtl
+	bp.records[k] = rp
+	bp.order = append(bp.order, rp)
+	return
+}
+
+// A change made on behalf of source can't touch a record another source owns. Records without a
+// source (docker, hostfiles, zone files) can be changed by anyone
+func (rp *recordPlan) checkSource(source string) error {
+	if rp.owner != "" && rp.owner != source {
+		return apiError(http.StatusConflict, "conflict", "%s record for %s is owned by %s", dns.TypeToString[rp.dnsType], rp.name, rp.owner)
+	}
+	return nil
+}
+
+// Make vals (with ttl, if set) the values of a record. source becomes the owner if this creates it
+func (bp *batchPlan) put(dnsType uint16, name string, vals []string, ttl *uint32, source string) error {
+	rp, err := bp.record(dnsType, name)
+	if err != nil {
+		return err
+	}
+	if err := rp.checkSource(source); err != nil {
+		return err
+	}
+	rp.by = source
+	if len(rp.vals) == 0 {
+		rp.owner = source
+	}
+	rp.vals, rp.ttl = nil, ttl
+	for _, v := range vals {
+		if !containsString(rp.vals, v) {
+			rp.vals = append(rp.vals, v)
+		}
+	}
+	rp.emptied()
+	return nil
+}
+
+// A record with no values left loses its owner and TTL
+func (rp *recordPlan) emptied() {
+	if len(rp.vals) == 0 {
+		rp.owner, rp.ttl = "", nil
+	}
+}
+
+// Add and remove values. The record keeps its TTL unless ttl is set
+func (bp *batchPlan) patch(dnsType uint16, name string, add, remove []string, ttl *uint32, source string) error {
+	rp, err := bp.record(dnsType, name)
+	if err != nil {
+		return err
+	}
+	if ttl == nil {
+		ttl = rp.ttl
+	}
+	var vals []string
+	for _, v := range append(rp.vals, add...) {
+		if !containsString(remove, v) {
+			vals = append(vals, v)
+		}
+	}
+	return bp.put(dnsType, name, vals, ttl, source)
+}
+
+// Remove values from a record, or the whole record if vals is empty
+func (bp *batchPlan) remove(dnsType uint16, name string, vals []string, source string) error {
+	rp, err := bp.record(dnsType, name)
+	if err != nil {
+		return err
+	}
+	if len(rp.vals) == 0 {
+		return apiError(http.StatusNotFound, "not_found", "No %s record for %s", dns.TypeToString[dnsType], name)
+	}
+	if err := rp.checkSource(source); err != nil {
+		return err
+	}
+	rp.by = source
+	var kept []string
+	for _, v := range rp.vals {
+		if len(vals) > 0 && !containsString(vals, v) {
+			kept = append(kept, v)
+		}
+	}
+	rp.vals = kept
+	rp.emptied()
+	return nil
+}
+
+// Store changes for the plan, and the same changes as reported to clients
+func (bp *batchPlan) changes() (changes []Change, report []ApiChange) {
+	reportChange := func(op string, rp *recordPlan, v string) {
+		report = append(report, newApiChange(op, rp.dnsType, rp.name, v))
+	}
+	// Old values go first, for every record, so changes are reported removals first
+	for _, rp := range bp.order {
+		for _, v := range rp.current {
+			if !containsString(rp.vals, v) {
+				changes = append(changes, Change{Type: ChangeDelVal, DnsType: rp.dnsType, Host: rp.name, Val: v, Source: rp.by})
+				reportChange("remove", rp, v)
+			}
+		}
+	}
+	for _, rp := range bp.order {
+		for _, v := range rp.vals {
+			if !containsString(rp.current, v) {
+				changes = append(changes, Change{Type: ChangePut, DnsType: rp.dnsType, Host: rp.name, Val: v, Source: rp.by})
+				reportChange("add", rp, v)
+			}
+		}
+		if rp.owner != rp.stored {
+			changes = append(changes, Change{Type: ChangeSource, DnsType: rp.dnsType, Host: rp.name, Val: rp.owner})
+		}
+		if !SameTtl(rp.ttl, rp.storedTtl) {
+			changes = append(changes, Change{Type: ChangeTtl, DnsType: rp.dnsType, Host: rp.name, Ttl: rp.ttl})
+			report = append(report, newApiTtlChange(rp.dnsType, rp.name, rp.ttl))
+		}
+	}
+	return
+}
+
+// Plan changes with fn, and apply them unless dryRun is set. The changes are returned either way.
+// Nothing else this instance does can change the records between planning and applying
+func runPlan(r *http.Request, recs *RecordSet, dryRun bool, fn func(bp *batchPlan) error) (report []ApiChange, err error) {
+	err = recs.Update(func() (changes []Change, err error) {
+		bp := newBatchPlan(r, recs)
+		if err = fn(bp); err != nil {
+			return
+		}
+		changes, report = bp.changes()
+		if dryRun {
+			changes = nil
+		}
+		return
+	})
+	return
+}
+
+// Validate and plan every operation before changing anything
+func planBatch(bp *batchPlan, ops []ApiBatchOp) error {
+	for i, op := range ops {
+		if err := planBatchOp(bp, op); err != nil {
+			if ae, ok := err.(*ApiError); ok {
+				return apiError(ae.Status, ae.Code, "Operation %d: %s", i, ae.Message)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func planBatchOp(bp *batchPlan, op ApiBatchOp) error {
+	dt, err := parseType(op.Type)
+	if err != nil {
+		return err
+	}
+	name, err := parseName(op.Name)
+	if err != nil {
+		return err
+	}
+	vals, err := parseValues(dt, op.Values)
+	if err != nil {
+		return err
+	}
+	source, err := apiSource(op.Source)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(op.Op) {
+	case "put":
+		if len(vals) == 0 {
+			return apiError(400, "invalid_value", "A record needs at least one value")
+		}
+		return bp.put(dt, name, vals, op.Ttl, source)
+	case "delete":
+		if op.Ttl != nil {
+			return apiError(400, "invalid_body", "delete operations don't take a ttl")
+		}
+		return bp.remove(dt, name, vals, source)
+	}
+	return apiError(400, "invalid_op", "Unknown operation %q. Expected put or delete", op.Op)
+}
+
+// Apply a list of put and delete operations atomically, or report what they would change
+func ApiBatchRecords(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet) {
+	var batch ApiBatch
+	if err := readBody(w, r, &batch); err != nil {
+		ApiErr(w, err)
+		return
+	}
+	changes, err := runPlan(r, recs, batch.DryRun, func(bp *batchPlan) error {
+		return planBatch(bp, batch.Operations)
+	})
+	if err != nil {
+		ApiErr(w, err)
+		return
+	}
+	res := ApiBatchResult{DryRun: batch.DryRun, Changes: changes}
+	if res.Changes == nil {
+		res.Changes = []ApiChange{}
+	}
+	Json(w, res, 200)
+}
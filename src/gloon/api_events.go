@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	. "gloon/record_set"
+	"gloon/record_store"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Interval between keepalive comments on an idle event stream, so proxies don't drop it
+var eventKeepalive = 30 * time.Second
+
+// A record change as sent on the event stream
+type ApiEvent struct {
+	Seq uint64 `json:"seq"`
+	ApiChange
+	Source string `json:"source,omitempty"`
+}
+
+func newApiEvent(ev Event) ApiEvent {
+	var c ApiChange
+	switch ev.Op {
+	case EventTtl:
+		c = newApiTtlChange(ev.DnsType, ev.Host, ev.NewTtl())
+	case EventDel:
+		c = newApiChange("remove", ev.DnsType, ev.Host, ev.Val)
+	default:
+		c = newApiChange("add", ev.DnsType, ev.Host, ev.Val)
+	}
+	return ApiEvent{Seq: ev.Seq, ApiChange: c, Source: ev.Source}
+}
+
+// Write a server-sent event. id is left out when empty
+func writeEvent(w http.ResponseWriter, event, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// Write a record change, or a reset if changes from other instances may have been missed
+func writeChange(w http.ResponseWriter, ev Event) error {
+	id := strconv.FormatUint(ev.Seq, 10)
+	if ev.Op == EventReset {
+		return writeEvent(w, "reset", id, map[string]uint64{"seq": ev.Seq})
+	}
+	return writeEvent(w, "change", id, newApiEvent(ev))
+}
+
+// Stream record changes as server-sent events until the client goes away or done is closed. With
+// ?snapshot=1 every record is sent first. Clients resume with Last-Event-ID (or ?since=SEQ), and
+// are sent a reset event if the changes since then are no longer known. A reset is also sent when
+// changes made by other instances sharing the store may have been missed
+func ApiEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, recs *RecordSet, done <-chan struct{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ApiErr(w, apiError(500, "internal", "Streaming is not supported"))
+		return
+	}
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("since")
+	}
+	var since uint64
+	if id != "" {
+		var err error
+		if since, err = strconv.ParseUint(id, 10, 64); err != nil {
+			ApiErr(w, apiError(400, "invalid_since", "Invalid event id %q", id))
+			return
+		}
+	}
+	snapshot, _ := strconv.ParseBool(r.URL.Query().Get("snapshot"))
+
+	sub := recs.Subscribe()
+	defer sub.Unsubscribe()
+	var backlog []Event
+	resumed := false
+	if id != "" {
+		backlog, resumed = sub.Since(since)
+	}
+	// Read the snapshot before writing anything, so store errors can still be reported
+	var records []record_store.StoreRecord
+	if snapshot && !resumed {
+		var err error
+		if records, err = recs.All(); err != nil {
+			ApiErr(w, err)
+			return
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	seq := map[string]uint64{"seq": sub.Seq}
+	if id != "" && !resumed {
+		writeEvent(w, "reset", "", seq)
+	}
+	for _, rec := range records {
+		writeEvent(w, "record", "", newApiRecord(rec.DnsType, rec.Key, rec.Vals, ParseMeta(rec.Meta)))
+	}
+	for _, ev := range backlog {
+		writeChange(w, ev)
+	}
+	if err := writeEvent(w, "ready", strconv.FormatUint(sub.Seq, 10), seq); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				log.Printf("Event stream for %s fell behind. Closing it", r.RemoteAddr)
+				return
+			}
+			if err := writeChange(w, ev); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	event, id string
+	data      map[string]interface{}
+}
+
+// Open an event stream, and return a function that reads the next event
+func openEvents(t *testing.T, url, lastId string) (next func() sseEvent, close func()) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Got content type %s -- expected text/event-stream", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	next = func() (ev sseEvent) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal("Reading event stream:", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && ev.event != "":
+				return
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data)
+			}
+		}
+	}
+	return next, func() { resp.Body.Close() }
+}
+
+func expectEvent(t *testing.T, ev sseEvent, event string, fields map[string]interface{}) {
+	if ev.event != event {
+		t.Errorf("Got %s event %v -- expected %s", ev.event, ev.data, event)
+		return
+	}
+	for k, v := range fields {
+		if ev.data[k] != v {
+			t.Errorf("Got %s event %v -- expected %s=%v", event, ev.data, k, v)
+		}
+	}
+}
+
+func startEventApi(t *testing.T) (srv *http.Server, url string, recs *record_set.RecordSet) {
+	recs = record_set.Create(mem_rs.Create())
+	srv, err := NewApiServer(&Settings{}, recs.WithSource("api"), func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	return srv, "http://" + l.Addr().String(), recs
+}
+
+func TestApiEvents(t *testing.T) {
+	srv, url, recs := startEventApi(t)
+	defer srv.Close()
+	ttl := uint32(60)
+	recs.WithSource("docker").Put(dns.TypeA, "web.test", "10.0.0.1")
+	recs.SetTtl(dns.TypeA, "web.test", &ttl)
+
+	next, closeStream := openEvents(t, url+"/events?snapshot=1", "")
+	expectEvent(t, next(), "record", map[string]interface{}{"type": "PTR", "name": "1.0.0.10.in-addr.arpa"})
+	expectEvent(t, next(), "record", map[string]interface{}{"type": "A", "name": "web.test", "ttl": 60.0})
+	expectEvent(t, next(), "ready", map[string]interface{}{"seq": 2.0})
+
+	resp, err := http.Post(url+"/records", "application/json", strings.NewReader(`{"type": "A", "name": "db.test", "values": ["10.0.0.2"], "source": "terraform"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	recs.WithSource("docker").DelAddr(dns.TypeA, "web.test", "10.0.0.1")
+	ev := next()
+	expectEvent(t, ev, "change", map[string]interface{}{"seq": 3.0, "op": "add", "type": "A", "name": "db.test", "value": "10.0.0.2", "source": "terraform"})
+	if ev.id != "3" {
+		t.Errorf("Got event id %q -- expected 3", ev.id)
+	}
+	expectEvent(t, next(), "change", map[string]interface{}{"seq": 4.0, "op": "remove", "name": "web.test", "value": "10.0.0.1", "source": "docker"})
+	closeStream()
+
+	// Resume where we left off, with no snapshot
+	recs.Put(dns.TypeTXT, "db.test", "missed")
+	next, closeStream = openEvents(t, url+"/events?snapshot=1", "4")
+	expectEvent(t, next(), "change", map[string]interface{}{"seq": 5.0, "value": "missed"})
+	expectEvent(t, next(), "ready", map[string]interface{}{"seq": 5.0})
+	closeStream()
+
+	// An id we never gave out (ex. from before a restart) can't be resumed from
+	next, closeStream = openEvents(t, url+"/events?snapshot=true", "99")
+	expectEvent(t, next(), "reset", map[string]interface{}{"seq": 5.0})
+	expectEvent(t, next(), "record", map[string]interface{}{"name": "2.0.0.10.in-addr.arpa"})
+	closeStream()
+}
+
+func TestApiEventsShutdown(t *testing.T) {
+	srv, url, _ := startEventApi(t)
+	next, closeStream := openEvents(t, url+"/events", "")
+	defer closeStream()
+	expectEvent(t, next(), "ready", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Error("Shutdown() with an open event stream failed:", err)
+	}
+}
+
+// A store shared with other instances, that can be made to report missed notices
+type resetStore struct {
+	*mem_rs.MemRecordStore
+	notices chan record_set.StoreNotice
+}
+
+func (s *resetStore) Notify(n record_set.StoreNotice) error { return nil }
+
+func (s *resetStore) Watch(ctx context.Context, fn func(record_set.StoreNotice)) error {
+	for {
+		select {
+		case n := <-s.notices:
+			fn(n)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestApiEventsReset(t *testing.T) {
+	store := &resetStore{mem_rs.Create(), make(chan record_set.StoreNotice)}
+	recs := record_set.Create(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go recs.Watch(ctx)
+	srv, err := NewApiServer(&Settings{}, recs, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	url := "http://" + l.Addr().String()
+
+	recs.Put(dns.TypeA, "web.test", "10.0.0.1")
+	next, closeStream := openEvents(t, url+"/events", "")
+	expectEvent(t, next(), "ready", map[string]interface{}{"seq": 1.0})
+	store.notices <- record_set.StoreNotice{Reset: true}
+	ev := next()
+	expectEvent(t, ev, "reset", map[string]interface{}{"seq": 2.0})
+	if ev.id != "2" {
+		t.Errorf("Got reset id %q -- expected 2, so clients resume after it", ev.id)
+	}
+	closeStream()
+
+	// Clients resuming from before the reset are told about it too
+	next, closeStream = openEvents(t, url+"/events", "1")
+	expectEvent(t, next(), "reset", map[string]interface{}{"seq": 2.0})
+	expectEvent(t, next(), "ready", map[string]interface{}{"seq": 2.0})
+	closeStream()
+}
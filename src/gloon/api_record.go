@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	. "gloon/record_set"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Record types the api can manage
+var DnsTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"NS":    dns.TypeNS,
+	"PTR":   dns.TypePTR,
+	"SRV":   dns.TypeSRV,
+	"TXT":   dns.TypeTXT,
+}
+
+// Source recorded for api changes that don't name one
+const defaultApiSource = "api"
+
+// Sources of the records gloon publishes itself
+var internalSources = map[string]bool{"docker": true, "swarm": true, "hostfile": true, "zonefile": true, "static": true}
+
+// A record as sent to and returned by the api. Every value shares the TTL
+type ApiRecord struct {
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+	Ttl    *uint32  `json:"ttl,omitempty"` // Overrides the server TTL when set
+	Source string   `json:"source,omitempty"`
+}
+
+// Values to add to or remove from an existing record
+type ApiPatch struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+	Ttl    *uint32  `json:"ttl,omitempty"`
+	Source string   `json:"source,omitempty"`
+}
+
+// Error returned by the api as {"error": {...}}
+type ApiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+func apiError(status int, code, format string, args ...interface{}) *ApiError {
+	return &ApiError{status, code, fmt.Sprintf(format, args...)}
+}
+
+func parseType(t string) (uint16, error) {
+	dt, ok := DnsTypes[strings.ToUpper(t)]
+	if !ok {
+		return 0, apiError(http.StatusBadRequest, "invalid_type", "Unsupported record type %q", t)
+	}
+	return dt, nil
+}
+
+// Names are stored without the trailing dot. Wildcards (*.example.com) are allowed
+func parseName(name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", apiError(http.StatusBadRequest, "invalid_name", "Invalid record name %q", name)
+	}
+	return name, nil
+}
+
+// Validate a value and return it in the form the server stores it, the same as values loaded from zone files
+func parseValue(dnsType uint16, val string) (string, error) {
+	invalid := func(reason string) (string, error) {
+		return "", apiError(http.StatusBadRequest, "invalid_value", "Invalid %s value %q: %s", dns.TypeToString[dnsType], val, reason)
+	}
+	switch dnsType {
+	case dns.TypeA:
+		ip := net.ParseIP(val)
+		if ip == nil || ip.To4() == nil {
+			return invalid("not an IPv4 address")
+		}
+		return ip.String(), nil
+	case dns.TypeTXT:
+		return val, nil
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("example. 0 IN %s %s", dns.TypeToString[dnsType], val))
+	if err != nil || rr == nil {
+		return invalid("not valid record data")
+	}
+	return zoneValue(rr), nil
+}
+
+func parseValues(dnsType uint16, vals []string) (parsed []string, err error) {
+	for _, v := range vals {
+		p, err := parseValue(dnsType, v)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return
+}
+
+// Read a record as stored. Missing records are a not_found error
+func loadRecord(recs *RecordSet, dnsType uint16, name string) (rec *ApiRecord, err error) {
+	vals, err := recs.Values(dnsType, name)
+	if err != nil {
+		return
+	}
+	if len(vals) == 0 {
+		return nil, apiError(http.StatusNotFound, "not_found", "No %s record for %s", dns.TypeToString[dnsType], name)
+	}
+	meta, err := recs.Meta(dnsType, name)
+	if err != nil {
+		return
+	}
+	return newApiRecord(dnsType, name, vals, meta), nil
+}
+
+func newApiRecord(dnsType uint16, name string, vals []string, meta RecordMeta) *ApiRecord {
+	rec := &ApiRecord{Type: dns.TypeToString[dnsType], Name: name, Values: vals, Ttl: meta.Ttl, Source: meta.Source}
+	if rec.Values == nil {
+		rec.Values = []string{}
+	}
+	return rec
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestApi() (http.Handler, *record_set.RecordSet) {
+	recs := record_set.Create(mem_rs.Create())
+	srv, _ := NewApiServer(&Settings{}, recs, func() error { return nil })
+	return srv.Handler, recs
+}
+
+// Send a request and check the status. The decoded JSON response is returned
+func apiRequest(t *testing.T, h http.Handler, method, path, body string, status int) (resp map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != status {
+		t.Errorf("%s %s returned %d -- expected %d (%s)", method, path, rec.Code, status, rec.Body.String())
+	}
+	if rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s %s returned invalid JSON %q: %s", method, path, rec.Body.String(), err)
+		}
+	}
+	return
+}
+
+func expectValues(t *testing.T, resp map[string]interface{}, expected ...string) {
+	var vals []string
+	if v, ok := resp["values"].([]interface{}); ok {
+		for _, s := range v {
+			vals = append(vals, s.(string))
+		}
+	}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("Got values %v -- expected %v", vals, expected)
+	}
+}
+
+func expectErrorCode(t *testing.T, resp map[string]interface{}, code string) {
+	e, _ := resp["error"].(map[string]interface{})
+	if e["code"] != code {
+		t.Errorf("Got error %v -- expected code %s", resp, code)
+	}
+}
+
+func TestApiRecords(t *testing.T) {
+	h, recs := newTestApi()
+	resp := apiRequest(t, h, "POST", "/records", `{"type": "A", "name": "web.test", "values": ["10.0.0.2", "10.0.0.1"], "ttl": 60}`, 201)
+	expectValues(t, resp, "10.0.0.1", "10.0.0.2")
+	if resp["ttl"] != 60.0 || resp["source"] != "api" {
+		t.Errorf("Unexpected record %v", resp)
+	}
+	expectAddr(t, recs, "web.test.", "10.0.0.1")
+	if ttl, ok := recs.Ttl(dns.TypeA, "web.test."); !ok || ttl != 60 {
+		t.Errorf("Got TTL %d, %v -- expected 60", ttl, ok)
+	}
+
+	resp = apiRequest(t, h, "POST", "/records", `{"type": "A", "name": "web.test", "values": ["10.0.0.3"]}`, 409)
+	expectErrorCode(t, resp, "conflict")
+
+	resp = apiRequest(t, h, "PATCH", "/records/a/web.test", `{"add": ["10.0.0.3"], "remove": ["10.0.0.1"]}`, 200)
+	expectValues(t, resp, "10.0.0.2", "10.0.0.3")
+	if resp["ttl"] != 60.0 {
+		t.Errorf("PATCH lost the TTL: %v", resp)
+	}
+
+	resp = apiRequest(t, h, "PUT", "/records/A/web.test", `{"values": ["10.0.0.4"]}`, 200)
+	expectValues(t, resp, "10.0.0.4")
+	if _, ok := resp["ttl"]; ok || resp["source"] != "api" {
+		t.Errorf("Unexpected record after PUT %v", resp)
+	}
+	if host := recs.Get(dns.TypePTR, "4.0.0.10.in-addr.arpa."); host != "web.test" {
+		t.Errorf("Got PTR %q -- expected web.test", host)
+	}
+
+	resp = apiRequest(t, h, "GET", "/records/A/web.test.", "", 200)
+	expectValues(t, resp, "10.0.0.4")
+
+	apiRequest(t, h, "DELETE", "/records/A/web.test", "", 204)
+	resp = apiRequest(t, h, "GET", "/records/A/web.test", "", 404)
+	expectErrorCode(t, resp, "not_found")
+	apiRequest(t, h, "DELETE", "/records/A/web.test", "", 404)
+}
+
+func TestApiValidation(t *testing.T) {
+	h, _ := newTestApi()
+	for _, c := range []struct{ body, code string }{
+		{`{"type": "A", "name": "web.test", "values": ["10.0.0.300"]}`, "invalid_value"},
+		{`{"type": "A", "name": "web.test", "values": ["::1"]}`, "invalid_value"},
+		{`{"type": "A", "name": "web..test", "values": ["10.0.0.1"]}`, "invalid_name"},
+		{`{"type": "AAAA", "name": "web.test", "values": ["::1"]}`, "invalid_type"},
+		{`{"type": "MX", "name": "web.test", "values": ["mail.test."]}`, "invalid_value"},
+		{`{"type": "A", "name": "web.test", "values": []}`, "invalid_value"},
+		{`{"type": "A", "name": "web.test", "value": "10.0.0.1"}`, "invalid_body"},
+		{`not json`, "invalid_body"},
+	} {
+		resp := apiRequest(t, h, "POST", "/records", c.body, 400)
+		expectErrorCode(t, resp, c.code)
+	}
+	apiRequest(t, h, "PUT", "/records/A/web.test", `{"type": "A", "name": "other.test", "values": ["10.0.0.1"]}`, 400)
+	apiRequest(t, h, "PATCH", "/records/A/web.test", `{"add": ["10.0.0.1"]}`, 404)
+
+	resp := apiRequest(t, h, "POST", "/records", `{"type": "mx", "name": "test", "values": ["10 mail.test"]}`, 201)
+	expectValues(t, resp, "10 mail.test.")
+}
+
+func TestApiSources(t *testing.T) {
+	h, recs := newTestApi()
+	apiRequest(t, h, "POST", "/records", `{"type": "A", "name": "db.test", "values": ["10.0.0.1"], "source": "terraform"}`, 201)
+	resp := apiRequest(t, h, "PATCH", "/records/A/db.test", `{"add": ["10.0.0.2"]}`, 409)
+	expectErrorCode(t, resp, "conflict")
+	apiRequest(t, h, "DELETE", "/records/A/db.test", "", 409)
+	apiRequest(t, h, "PUT", "/records/A/db.test", `{"values": ["10.0.0.3"], "source": "terraform"}`, 200)
+	apiRequest(t, h, "DELETE", "/records/A/db.test?source=terraform", "", 204)
+
+	// Records from other publishers have no owner, and stay that way when changed through the api
+	recs.Put(dns.TypeA, "web.test", "10.0.0.5")
+	resp = apiRequest(t, h, "PATCH", "/records/A/web.test", `{"add": ["10.0.0.6"], "source": "terraform"}`, 200)
+	if _, ok := resp["source"]; ok {
+		t.Errorf("PATCH claimed an unowned record: %v", resp)
+	}
+
+	// Clients can't act as one of gloon's own sources
+	resp = apiRequest(t, h, "POST", "/records", `{"type": "A", "name": "fake.test", "values": ["10.0.0.7"], "source": "docker"}`, 400)
+	expectErrorCode(t, resp, "invalid_source")
+	apiRequest(t, h, "PATCH", "/records/A/web.test", `{"add": ["10.0.0.7"], "source": "hostfile"}`, 400)
+	apiRequest(t, h, "DELETE", "/records/A/web.test?source=zonefile", "", 400)
+	apiRequest(t, h, "POST", "/records/batch", `{"operations": [{"op": "put", "type": "A", "name": "fake.test", "values": ["10.0.0.7"], "source": "static"}]}`, 400)
+}
+
+func TestApiSingleValueRoutes(t *testing.T) {
+	h, recs := newTestApi()
+	resp := apiRequest(t, h, "PUT", "/records/A/web.test/10.0.0.1", "", 200)
+	expectValues(t, resp, "10.0.0.1")
+	apiRequest(t, h, "PUT", "/records/A/web.test/10.0.0.2", "", 200)
+	apiRequest(t, h, "PUT", "/records/A/web.test/bogus", "", 400)
+	resp = apiRequest(t, h, "DELETE", "/records/A/web.test/10.0.0.1", "", 200)
+	expectValues(t, resp, "10.0.0.2")
+	apiRequest(t, h, "DELETE", "/records/A/web.test/10.0.0.2", "", 204)
+	expectAddr(t, recs, "web.test.", "")
+}
+
+func TestApiBatch(t *testing.T) {
+	h, recs := newTestApi()
+	apiRequest(t, h, "POST", "/records", `{"type": "A", "name": "db.test", "values": ["10.0.0.1"]}`, 201)
+	batch := `{"dry_run": %s, "operations": [
+		{"op": "put", "type": "A", "name": "web.test", "values": ["10.0.0.1", "10.0.0.2"]},
+		{"op": "delete", "type": "A", "name": "db.test"},
+		{"op": "put", "type": "TXT", "name": "web.test", "values": ["env=test"]}
+	]}`
+	resp := apiRequest(t, h, "POST", "/records/batch", fmt.Sprintf(batch, "true"), 200)
+	if changes, _ := resp["changes"].([]interface{}); len(changes) != 4 || resp["dry_run"] != true {
+		t.Errorf("Unexpected dry run result %v", resp)
+	}
+	expectAddr(t, recs, "web.test.", "")
+	expectAddr(t, recs, "db.test.", "10.0.0.1")
+
+	apiRequest(t, h, "POST", "/records/batch", fmt.Sprintf(batch, "false"), 200)
+	expectAddr(t, recs, "db.test.", "")
+	if vals := recs.GetAll(dns.TypeA, "web.test."); len(vals) != 2 {
+		t.Errorf("Got values %v for web.test -- expected 2", vals)
+	}
+	// The address moved from db.test to web.test, and the PTR record with it
+	if host := recs.Get(dns.TypePTR, "1.0.0.10.in-addr.arpa."); host != "web.test" {
+		t.Errorf("Got PTR %q -- expected web.test", host)
+	}
+
+	// Nothing is applied when an operation fails
+	resp = apiRequest(t, h, "POST", "/records/batch", `{"operations": [
+		{"op": "delete", "type": "A", "name": "web.test"},
+		{"op": "put", "type": "A", "name": "api.test", "values": ["bogus"]}
+	]}`, 400)
+	expectErrorCode(t, resp, "invalid_value")
+	if vals := recs.GetAll(dns.TypeA, "web.test."); len(vals) != 2 {
+		t.Errorf("Got values %v for web.test after a failed batch -- expected 2", vals)
+	}
+	resp = apiRequest(t, h, "POST", "/records/batch", `{"operations": [{"op": "delete", "type": "A", "name": "db.test"}]}`, 404)
+	expectErrorCode(t, resp, "not_found")
+	resp = apiRequest(t, h, "POST", "/records/batch", `{"operations": [{"op": "upsert", "type": "A", "name": "db.test"}]}`, 400)
+	expectErrorCode(t, resp, "invalid_op")
+}
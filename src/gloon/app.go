@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A running gloon: the dns server and every record source, kept together so we can apply new
+// settings on reload
+type App struct {
+	sync.Mutex
+	args     []string // Command line, parsed again on reload
+	settings *Settings
+	server   *Server
+	api      *http.Server
+	monitors []*appMonitor
+	swarms   []*SwarmMonitor
+	sources  map[string]*fileSource // Hostfile, hostfile directory and zone file watchers, keyed by kind and path
+	hosts    *HostRefs              // Records from every hostfile
+	ctx      context.Context        // Cancelled on shutdown to stop the docker and swarm monitors
+	cancel   context.CancelFunc
+	running  sync.WaitGroup // Monitors that have not stopped yet
+	stopped  bool           // Set on shutdown. There is nothing left to reload
+}
+
+type appMonitor struct {
+	*DockerMonitor
+	swarm *SwarmMonitor // For the same daemon, with --docker-swarm
+	spec  string        // --docker-host value the monitor was created from. Empty for the default host
+}
+
+// A running file record source
+type fileSource struct {
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the watcher has stopped
+	clear  func()        // Removes the records the source loaded
+}
+
+func (fs *fileSource) stop() {
+	fs.halt()
+	fs.clear()
+}
+
+// Stop the watcher, leaving its records in place
+func (fs *fileSource) halt() {
+	fs.cancel()
+	<-fs.done
+}
+
+// Settings that can only change with a restart
+var restartSettings = []string{"ResolverAddr", "ApiAddr", "ApiTokensFile", "ApiTlsCert", "ApiTlsKey", "ApiClientCa", "Store", "StoreOpts", "StoreCache", "DisableDocker", "DockerHosts", "DockerSwarm", "HostfileReloadInterval"}
+
+// How long we wait for in-flight requests and record sources to finish on shutdown
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+func appMain(settings *Settings) (err error) {
+	log.Printf("gloon %s starting...", VERSION)
+	s, err := NewServer(settings.ResolverAddr, settings)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to create server: %s", err.Error()), EXIT_CONFIG)
+	}
+	app := &App{args: os.Args, settings: settings, server: s, sources: make(map[string]*fileSource)}
+	app.hosts = NewHostRefs(s.RecordSet.WithSource("hostfile"))
+	app.ctx, app.cancel = context.WithCancel(context.Background())
+	if settings.ApiAddr != "" {
+		if app.api, err = NewApiServer(settings, s.RecordSet.WithSource(defaultApiSource), app.Reload); err != nil {
+			return cli.NewExitError(err.Error(), EXIT_CONFIG)
+		}
+	}
+	// Changes other instances make to a shared store
+	app.running.Add(1)
+	go func() {
+		defer app.running.Done()
+		if err := s.RecordSet.Watch(app.ctx); err != nil {
+			log.Printf("WARNING: unable to watch for changes from other instances: %s", err.Error())
+		}
+	}()
+	if err = app.startDocker(); err != nil {
+		return cli.NewExitError(err.Error(), EXIT_CONFIG)
+	}
+	app.syncFileSources(settings)
+
+	// Listeners report here if they fail. Errors after we start shutting down are expected and ignored
+	failed := make(chan error, 2)
+	go func() {
+		failed <- s.ListenAndServe()
+	}()
+	if app.api != nil {
+		go func() {
+			var err error
+			if app.api.TLSConfig != nil {
+				err = app.api.ListenAndServeTLS("", "")
+			} else {
+				err = app.api.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				failed <- fmt.Errorf("api server: %s", err)
+			}
+		}()
+	}
+	stop := make(chan os.Signal, 1)
+	go app.handleSignals(stop)
+
+	code := EXIT_OK
+	select {
+	case sig := <-stop:
+		log.Printf("Got %s, shutting down...", sig)
+	case err := <-failed:
+		if err == nil {
+			err = fmt.Errorf("dns server stopped")
+		}
+		log.Printf("Unable to serve: %s. Shutting down...", err.Error())
+		code = EXIT_FAILURE
+	}
+	if err := app.Shutdown(SHUTDOWN_TIMEOUT); err != nil {
+		log.Printf("Shutdown incomplete: %s", err.Error())
+		if code == EXIT_OK {
+			code = EXIT_SHUTDOWN
+		}
+	}
+	if code != EXIT_OK {
+		return cli.NewExitError("", code)
+	}
+	log.Printf("Shutdown complete")
+	return
+}
+
+func (app *App) startDocker() error {
+	settings := app.settings
+	if settings.DisableDocker {
+		return nil
+	}
+	specs := settings.DockerHosts
+	if len(specs) == 0 {
+		specs = []string{""}
+	} else if _, err := ParseDockerHosts(specs, settings); err != nil {
+		return fmt.Errorf("Invalid docker host: %s", err.Error())
+	}
+	// One monitor per daemon. Each tracks only the records it published
+	for _, spec := range specs {
+		h, err := app.dockerHost(spec, settings)
+		if err != nil {
+			return fmt.Errorf("Invalid docker host: %s", err.Error())
+		}
+		src, err := NewDockerSource(h)
+		if err != nil {
+			log.Printf("WARNING: unable to connect to docker host %s: %s. Docker hostname support will be disabled for it", h, err.Error())
+			continue
+		}
+		dm, err := NewDockerMonitor(app.server.RecordSet.WithSource("docker"), settings, src, h.Domain)
+		if err != nil {
+			log.Printf("WARNING: unable to start docker monitor for %s: %s. Docker hostname support will be disabled for it", h, err.Error())
+			continue
+		}
+		m := &appMonitor{DockerMonitor: dm, spec: spec}
+		app.monitors = append(app.monitors, m)
+		app.running.Add(1)
+		go func(dm *DockerMonitor) {
+			defer app.running.Done()
+			if err := dm.Run(app.ctx); err != nil {
+				log.Printf("WARNING: docker monitor for %s stopped: %s", dm.source, err.Error())
+			}
+		}(dm)
+		if settings.DockerSwarm {
+			sm := NewSwarmMonitor(app.server.RecordSet.WithSource("swarm"), settings, src, h.Domain)
+			m.swarm = sm
+			app.swarms = append(app.swarms, sm)
+			app.running.Add(1)
+			go func(sm *SwarmMonitor) {
+				defer app.running.Done()
+				if err := sm.Run(app.ctx); err != nil {
+					log.Printf("WARNING: swarm monitor stopped: %s. Swarm service support will be disabled", err.Error())
+				}
+			}(sm)
+		}
+	}
+	return nil
+}
+
+func (app *App) dockerHost(spec string, settings *Settings) (*DockerHost, error) {
+	if spec == "" {
+		return &DockerHost{Domain: settings.AppendDomain}, nil
+	}
+	return ParseDockerHost(spec, settings)
+}
+
+// Start watchers for hostfiles and zone files that are new in settings, and stop (removing their
+// records) those that are no longer listed. Sources that stay are left alone
+func (app *App) syncFileSources(settings *Settings) {
+	interval := settings.HostfileReloadInterval
+	wanted := make(map[string]bool)
+	for _, fn := range settings.Hostfiles {
+		key := "hostfile:" + fn
+		wanted[key] = true
+		if _, ok := app.sources[key]; ok {
+			continue
+		}
+		if fi, err := os.Stat(fn); err == nil && fi.IsDir() {
+			hd := NewHostDir(fn, app.hosts, interval)
+			app.startSource(key, hd.Run, hd.clear)
+			continue
+		}
+		hf := NewHostfile(fn, app.hosts, interval)
+		app.startSource(key, hf.Run, hf.clear)
+	}
+	for _, fn := range settings.Zonefiles {
+		key := "zonefile:" + fn
+		wanted[key] = true
+		if _, ok := app.sources[key]; ok {
+			continue
+		}
+		zf := NewZonefile(fn, app.server.RecordSet.WithSource("zonefile"), interval)
+		app.startSource(key, zf.Run, zf.clear)
+	}
+	for key, fs := range app.sources {
+		if !wanted[key] {
+			log.Printf("Removing records from %s", key)
+			fs.stop()
+			delete(app.sources, key)
+		}
+	}
+}
+
+func (app *App) startSource(key string, run func(context.Context), clear func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &fileSource{cancel, make(chan struct{}), clear}
+	app.sources[key] = fs
+	go func() {
+		defer close(fs.done)
+		run(ctx)
+	}()
+}
+
+// Re-read the command line and config file, and apply the result. Everything is validated before
+// anything is changed, so a bad config leaves the running one in place
+func (app *App) Reload() (err error) {
+	app.Lock()
+	defer app.Unlock()
+	if app.stopped {
+		return fmt.Errorf("Shutting down")
+	}
+	log.Printf("Reloading configuration...")
+	settings, err := loadSettings(app.args)
+	if err != nil {
+		return
+	}
+	resolver, err := NewResolver(settings)
+	if err != nil {
+		return fmt.Errorf("Unable to create resolver: %s", err.Error())
+	}
+	// The hosts are restart only, but their default domain can change
+	if _, err := ParseDockerHosts(app.settings.DockerHosts, settings); err != nil {
+		return fmt.Errorf("Invalid docker host: %s", err.Error())
+	}
+	cfgs := make([]*MonitorConfig, len(app.monitors))
+	for i, m := range app.monitors {
+		h, err := app.dockerHost(m.spec, settings)
+		if err != nil {
+			return fmt.Errorf("Invalid docker host: %s", err.Error())
+		}
+		if cfgs[i], err = NewMonitorConfig(settings, h.Domain); err != nil {
+			return fmt.Errorf("Invalid docker settings: %s", err.Error())
+		}
+	}
+	old := reflect.ValueOf(*app.settings)
+	for _, name := range restartSettings {
+		if !reflect.DeepEqual(old.FieldByName(name).Interface(), reflect.ValueOf(*settings).FieldByName(name).Interface()) {
+			log.Printf("WARNING: %s changed. This takes effect on restart", name)
+		}
+	}
+	app.server.Reconfigure(settings, resolver)
+	for i, m := range app.monitors {
+		m.Reconfigure(cfgs[i])
+		if m.swarm != nil {
+			m.swarm.Reconfigure(settings, cfgs[i].domain)
+		}
+	}
+	// Keep the startup reload interval, which is restart only
+	settings.HostfileReloadInterval = app.settings.HostfileReloadInterval
+	app.syncFileSources(settings)
+	app.settings = settings
+	log.Printf("Configuration reloaded")
+	return
+}
+
+// Reload on SIGHUP. The first SIGINT or SIGTERM is passed on to stop, a second one exits right away
+func (app *App) handleSignals(stop chan<- os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	stopping := false
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			go func() {
+				if err := app.Reload(); err != nil {
+					log.Printf("Unable to reload configuration: %s", err.Error())
+				}
+			}()
+			continue
+		}
+		if stopping {
+			log.Printf("Got %s during shutdown, exiting", sig)
+			os.Exit(EXIT_SHUTDOWN)
+		}
+		stopping = true
+		stop <- sig
+	}
+}
+
+// Stop serving and stop every record source. Listeners are closed first and in-flight requests
+// drained, so nothing is answered from a half torn down record set. With CleanupOnExit, the
+// records we published are then removed from the store. The store is closed last
+func (app *App) Shutdown(timeout time.Duration) (err error) {
+	app.Lock()
+	defer app.Unlock()
+	app.stopped = true
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var errs []string
+	if app.api != nil {
+		if err := app.api.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("api server: %s", err.Error()))
+		}
+	}
+	if err := app.server.Stop(); err != nil {
+		errs = append(errs, fmt.Sprintf("dns server: %s", err.Error()))
+	}
+
+	app.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		app.running.Wait()
+		for _, fs := range app.sources {
+			fs.halt()
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// Sources and the store watcher may still be writing. Closing the store under them could
+		// lose or corrupt records, so it's left to the process exit
+		errs = append(errs, "record sources did not stop in time. Record store left open")
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	// Nothing else writes now. Closing the store also waits for any cache refreshes
+	if app.settings.CleanupOnExit {
+		log.Printf("Removing published records")
+		for _, m := range app.monitors {
+			m.clear()
+		}
+		for _, sm := range app.swarms {
+			sm.clear()
+		}
+		for _, fs := range app.sources {
+			fs.clear()
+		}
+		app.server.clearStatic()
+	}
+	if err := app.server.closeStore(); err != nil {
+		errs = append(errs, fmt.Sprintf("record store: %s", err.Error()))
+	}
+	if len(errs) > 0 {
+		err = fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return
+}
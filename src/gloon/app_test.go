@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/miekg/dns"
+	"gloon/file_rs"
+	"gloon/record_set"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A directory with a resolv.conf, so tests don't depend on the host's
+func testDir(t *testing.T) (dir, resolvConf string) {
+	dir, err := ioutil.TempDir("", "gloon-app")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	resolvConf = filepath.Join(dir, "resolv.conf")
+	writeHosts(t, resolvConf, "nameserver 192.0.2.1\n")
+	return
+}
+
+func TestServerReconfigure(t *testing.T) {
+	_, rc := testDir(t)
+	settings := &Settings{Store: "memory", ResolvFile: rc, Hostnames: []string{"a.test=10.0.0.1", "b.test=10.0.0.2"}}
+	s, err := NewServer("127.0.0.1:0", settings)
+	if err != nil {
+		t.Fatal("NewServer()", err)
+	}
+	expectAddr(t, s.RecordSet, "a.test.", "10.0.0.1")
+
+	next := &Settings{Store: "memory", ResolvFile: rc, Ttl: 60, Hostnames: []string{"b.test=10.0.0.2", "c.test=10.0.0.3"}}
+	resolver, err := NewResolver(next)
+	if err != nil {
+		t.Fatal("NewResolver()", err)
+	}
+	s.Reconfigure(next, resolver)
+	expectAddr(t, s.RecordSet, "a.test.", "")
+	expectAddr(t, s.RecordSet, "b.test.", "10.0.0.2")
+	expectAddr(t, s.RecordSet, "c.test.", "10.0.0.3")
+	if got, r := s.config(); got != next || r != resolver {
+		t.Error("Reconfigure() didn't swap in the new settings and resolver")
+	}
+
+	s.clearStatic()
+	expectAddr(t, s.RecordSet, "b.test.", "")
+}
+
+func TestAppReload(t *testing.T) {
+	dir, rc := testDir(t)
+	fn := filepath.Join(dir, "gloon.toml")
+	writeHosts(t, fn, `[[records]]
+name = "static.test"
+value = "10.0.0.1"
+
+[docker]
+append_domain = "docker"
+`)
+	args := []string{"gloon", "--config", fn, "--resolvconf", rc, "--store", "memory"}
+	settings, err := loadSettings(args)
+	if err != nil {
+		t.Fatal("loadSettings()", err)
+	}
+	s, err := NewServer("127.0.0.1:0", settings)
+	if err != nil {
+		t.Fatal("NewServer()", err)
+	}
+	app := &App{args: args, settings: settings, server: s, sources: make(map[string]*fileSource)}
+	app.hosts = NewHostRefs(s.RecordSet.WithSource("hostfile"))
+	app.ctx, app.cancel = context.WithCancel(context.Background())
+	defer app.cancel()
+
+	fs := newFakeSource()
+	fs.manager = true
+	fs.networks = map[string]string{"n1": "front"}
+	fs.set(&Container{ID: "0123456789abcdef", Name: "web", Hostname: "web", Networks: map[string]string{"bridge": "172.17.0.2"}})
+	fs.setSwarm([]swarm.Service{testService("s1", "api", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.1.2/24"})}, nil)
+	dm, err := NewDockerMonitor(s.RecordSet.WithSource("docker"), settings, fs, settings.AppendDomain)
+	if err != nil {
+		t.Fatal("NewDockerMonitor()", err)
+	}
+	sm := NewSwarmMonitor(s.RecordSet.WithSource("swarm"), settings, fs, settings.AppendDomain)
+	app.monitors = []*appMonitor{{DockerMonitor: dm, swarm: sm}}
+	app.swarms = []*SwarmMonitor{sm}
+	dm.addRecord("0123456789abcdef")
+	sm.sync()
+	expectAddr(t, s.RecordSet, "static.test.", "10.0.0.1")
+	expectAddr(t, s.RecordSet, "web.docker.", "172.17.0.2")
+	expectAddr(t, s.RecordSet, "api.docker.", "10.0.1.2")
+
+	// Every source picks up the new config
+	zone := filepath.Join(dir, "example.zone")
+	writeHosts(t, zone, "$ORIGIN example.test.\nwww 60 IN A 10.0.2.1\n")
+	writeHosts(t, fn, `ttl = 120
+
+[[records]]
+name = "other.test"
+value = "10.0.0.2"
+
+[docker]
+append_domain = "local"
+
+[hostfiles]
+zonefiles = ["`+zone+`"]
+`)
+	if err := app.Reload(); err != nil {
+		t.Fatal("Reload()", err)
+	}
+	if app.settings.Ttl != 120 {
+		t.Errorf("Got TTL %d after reload -- expected 120", app.settings.Ttl)
+	}
+	if cur, _ := s.config(); cur != app.settings {
+		t.Error("The server kept its old settings")
+	}
+	expectAddr(t, s.RecordSet, "static.test.", "")
+	expectAddr(t, s.RecordSet, "other.test.", "10.0.0.2")
+	expectAddr(t, s.RecordSet, "web.docker.", "")
+	expectAddr(t, s.RecordSet, "web.local.", "172.17.0.2")
+	expectAddr(t, s.RecordSet, "api.docker.", "")
+	expectAddr(t, s.RecordSet, "api.local.", "10.0.1.2")
+	if app.sources["zonefile:"+zone] == nil {
+		t.Errorf("No watcher started for %s: %v", zone, app.sources)
+	}
+
+	// A bad config changes nothing
+	writeHosts(t, fn, "[docker]\nhostname_filter = \"(\"\n")
+	if err := app.Reload(); err == nil {
+		t.Error("Reload() accepted an invalid hostname filter")
+	}
+	expectAddr(t, s.RecordSet, "other.test.", "10.0.0.2")
+	expectAddr(t, s.RecordSet, "web.local.", "172.17.0.2")
+
+	app.Shutdown(SHUTDOWN_TIMEOUT)
+	if err := app.Reload(); err == nil {
+		t.Error("Reload() after shutdown succeeded")
+	}
+}
+
+// With CleanupOnExit, our records are removed before the store is closed
+func TestAppShutdown(t *testing.T) {
+	dir, rc := testDir(t)
+	fn := filepath.Join(dir, "records.db")
+	settings := &Settings{Store: "file", StoreOpts: fn, ResolvFile: rc, CleanupOnExit: true, Hostnames: []string{"a.test=10.0.0.1"}}
+	s, err := NewServer("127.0.0.1:0", settings)
+	if err != nil {
+		t.Fatal("NewServer()", err)
+	}
+	s.RecordSet.Put(dns.TypeA, "other.test", "10.0.0.2")
+	app := &App{settings: settings, server: s, sources: make(map[string]*fileSource)}
+	app.ctx, app.cancel = context.WithCancel(context.Background())
+	if err := app.Shutdown(SHUTDOWN_TIMEOUT); err != nil {
+		t.Error("Shutdown()", err)
+	}
+	if err := s.RecordSet.Put(dns.TypeA, "late.test", "10.0.0.3"); err == nil {
+		t.Error("Put() after shutdown succeeded -- expected the store to be closed")
+	}
+
+	store, err := file_rs.Create(fn)
+	if err != nil {
+		t.Fatal("file_rs.Create()", err)
+	}
+	defer store.Close()
+	recs := record_set.Create(store)
+	expectAddr(t, recs, "a.test.", "")
+	expectAddr(t, recs, "other.test.", "10.0.0.2")
+}
+
+// The store stays open when record sources don't stop in time, since they may still write to it
+func TestAppShutdownTimeout(t *testing.T) {
+	dir, rc := testDir(t)
+	settings := &Settings{Store: "file", StoreOpts: filepath.Join(dir, "records.db"), ResolvFile: rc, CleanupOnExit: true}
+	s, err := NewServer("127.0.0.1:0", settings)
+	if err != nil {
+		t.Fatal("NewServer()", err)
+	}
+	app := &App{settings: settings, server: s, sources: make(map[string]*fileSource)}
+	app.ctx, app.cancel = context.WithCancel(context.Background())
+	app.running.Add(1)
+	if err := app.Shutdown(50 * time.Millisecond); err == nil {
+		t.Error("Shutdown() with a stuck source succeeded")
+	}
+	if err := s.RecordSet.Put(dns.TypeA, "late.test", "10.0.0.3"); err != nil {
+		t.Error("Put() after an incomplete shutdown failed:", err)
+	}
+	app.running.Done()
+	s.closeStore()
+}
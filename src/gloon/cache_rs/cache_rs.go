@@ -0,0 +1,227 @@
+package cache_rs
+
+import (
+	"context"
+	"gloon/record_set"
+	"gloon/record_store"
+	"log"
+	"sync"
+	"time"
+)
+
+// Most keys we cache. Once full, expired entries are dropped, and if that isn't enough new keys
+// aren't cached until there is room
+const MAX_ENTRIES = 100000
+
+type entry struct {
+	vals    []string // Metadata is kept as its only value
+	fetched time.Time
+}
+
+// Values and metadata of a store key are cached separately
+type cacheKey struct {
+	record_store.StoreKey
+	meta bool
+}
+
+// A RecordStore that keeps a local copy of what it reads from another store. Entries are fresh for
+// ttl and are dropped when we or (for stores that support it) other instances change them. An
+// expired entry is still served while it is refreshed in the background, and for as long as the
+// store can't be reached
+type CachedRecordStore struct {
+	sync.Mutex
+	store      record_set.RecordStore
+	ttl        time.Duration
+	entries    map[cacheKey]*entry
+	refreshing map[cacheKey]bool // Keys being refreshed, so each has at most one fetch in flight
+	refreshes  sync.WaitGroup    // Background refreshes still running
+	gen        uint64            // Bumped on every invalidation, so a fetch that raced with a write isn't cached
+	failing    bool              // The last fetch failed. Only used to log changes
+	closed     bool              // No more background refreshes are started
+	now        func() time.Time
+}
+
+func Create(store record_set.RecordStore, ttl time.Duration) (c *CachedRecordStore) {
+	return &CachedRecordStore{store: store, ttl: ttl, entries: make(map[cacheKey]*entry), refreshing: make(map[cacheKey]bool), now: time.Now}
+}
+
+func (c *CachedRecordStore) GetAll(dnsType uint16, key string) (vals []string, err error) {
+	return c.get(cacheKey{record_store.StoreKey{DnsType: dnsType, Key: key}, false}, func() ([]string, error) {
+		return c.store.GetAll(dnsType, key)
+	})
+}
+
+func (c *CachedRecordStore) GetMeta(dnsType uint16, key string) (meta string, err error) {
+	vals, err := c.get(cacheKey{record_store.StoreKey{DnsType: dnsType, Key: key}, true}, func() ([]string, error) {
+		meta, err := c.store.GetMeta(dnsType, key)
+		return []string{meta}, err
+	})
+	if len(vals) > 0 {
+		meta = vals[0]
+	}
+	return
+}
+
+// Cached values for k, or what fetch gets from the store. Expired values are returned as they are,
+// and fetched again in the background
+func (c *CachedRecordStore) get(k cacheKey, fetch func() ([]string, error)) (vals []string, err error) {
+	c.Lock()
+	e, gen := c.entries[k], c.gen
+	if e != nil {
+		if c.now().Sub(e.fetched) >= c.ttl && !c.refreshing[k] && !c.closed {
+			c.refreshing[k] = true
+			c.refreshes.Add(1)
+			go c.refresh(k, gen, fetch)
+		}
+		c.Unlock()
+		return copyVals(e.vals), nil
+	}
+	c.Unlock()
+	vals, err = fetch()
+	c.Lock()
+	defer c.Unlock()
+	if c.fetched(err) && gen == c.gen {
+		c.put(k, vals)
+	}
+	return
+}
+
+// Fetch an expired entry again. If the store fails, the old values stay in place
+func (c *CachedRecordStore) refresh(k cacheKey, gen uint64, fetch func() ([]string, error)) {
+	defer c.refreshes.Done()
+	vals, err := fetch()
+	c.Lock()
+	defer c.Unlock()
+	delete(c.refreshing, k)
+	if c.fetched(err) && gen == c.gen {
+		c.put(k, vals)
+	}
+}
+
+// Log when the store starts and stops failing. Called with the lock held
+func (c *CachedRecordStore) fetched(err error) bool {
+	if err != nil {
+		if !c.failing {
+			log.Printf("WARNING: record store failed (%s). Serving cached records", err.Error())
+			c.failing = true
+		}
+		return false
+	}
+	if c.failing {
+		log.Printf("Record store is back")
+		c.failing = false
+	}
+	return true
+}
+
+// Cache vals for k. Called with the lock held
+func (c *CachedRecordStore) put(k cacheKey, vals []string) {
+	if _, ok := c.entries[k]; !ok && len(c.entries) >= MAX_ENTRIES {
+		now := c.now()
+		for ek, e := range c.entries {
+			if now.Sub(e.fetched) >= c.ttl {
+				delete(c.entries, ek)
+			}
+		}
+		if len(c.entries) >= MAX_ENTRIES {
+			return
+		}
+	}
+	c.entries[k] = &entry{copyVals(vals), c.now()}
+}
+
+func (c *CachedRecordStore) invalidate(keys ...record_store.StoreKey) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	for _, k := range keys {
+		delete(c.entries, cacheKey{k, false})
+		delete(c.entries, cacheKey{k, true})
+	}
+}
+
+func (c *CachedRecordStore) PutVal(dnsType uint16, key, val string) error {
+	defer c.invalidate(record_store.StoreKey{DnsType: dnsType, Key: key})
+	return c.store.PutVal(dnsType, key, val)
+}
+
+func (c *CachedRecordStore) DelKey(dnsType uint16, key string) error {
+	defer c.invalidate(record_store.StoreKey{DnsType: dnsType, Key: key})
+	return c.store.DelKey(dnsType, key)
+}
+
+func (c *CachedRecordStore) DelVal(dnsType uint16, key, val string) error {
+	defer c.invalidate(record_store.StoreKey{DnsType: dnsType, Key: key})
+	return c.store.DelVal(dnsType, key, val)
+}
+
+func (c *CachedRecordStore) Apply(ops []record_store.StoreOp) error {
+	keys := make([]record_store.StoreKey, len(ops))
+	for i, op := range ops {
+		keys[i] = record_store.StoreKey{DnsType: op.DnsType, Key: op.Key}
+	}
+	defer c.invalidate(keys...)
+	return c.store.Apply(ops)
+}
+
+// Listing always goes to the store
+func (c *CachedRecordStore) All() ([]record_store.StoreRecord, error) {
+	return c.store.All()
+}
+
+func (c *CachedRecordStore) Clear() error {
+	defer c.reset()
+	return c.store.Clear()
+}
+
+func (c *CachedRecordStore) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.entries = make(map[cacheKey]*entry)
+}
+
+// Passed on to the store, if it supports notices
+func (c *CachedRecordStore) Notify(n record_set.StoreNotice) error {
+	if sn, ok := c.store.(record_set.StoreNotifier); ok {
+		return sn.Notify(n)
+	}
+	return nil
+}
+
+// Drop entries other instances change, and everything if notices may have been missed. Returns
+// at once if the store doesn't support notices
+func (c *CachedRecordStore) Watch(ctx context.Context, fn func(record_set.StoreNotice)) error {
+	sn, ok := c.store.(record_set.StoreNotifier)
+	if !ok {
+		return nil
+	}
+	return sn.Watch(ctx, func(n record_set.StoreNotice) {
+		if n.Reset {
+			c.reset()
+		} else {
+			c.invalidate(n.Keys...)
+		}
+		fn(n)
+	})
+}
+
+// Stop starting refreshes, wait for those running, then close the store underneath
+func (c *CachedRecordStore) Close() (err error) {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	c.refreshes.Wait()
+	switch s := c.store.(type) {
+	case interface{ Close() error }:
+		err = s.Close()
+	case interface{ Close() }:
+		s.Close()
+	}
+	return
+}
+
+// Callers may sort the values they get, so they can't share our copy
+func copyVals(vals []string) []string {
+	return append([]string{}, vals...)
+}
@@ -0,0 +1,216 @@
+package cache_rs
+
+import (
+	"context"
+	"errors"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"gloon/record_store"
+	"gloon/rstest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A store that counts reads, and can be made to fail
+type flakyStore struct {
+	*mem_rs.MemRecordStore
+	sync.Mutex
+	reads int
+	down  bool
+}
+
+func (f *flakyStore) GetAll(dnsType uint16, key string) ([]string, error) {
+	f.Lock()
+	f.reads++
+	down := f.down
+	f.Unlock()
+	if down {
+		return nil, errors.New("connection refused")
+	}
+	return f.MemRecordStore.GetAll(dnsType, key)
+}
+
+func (f *flakyStore) setDown(down bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.down = down
+}
+
+func (f *flakyStore) readCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.reads
+}
+
+func newTestCache() (c *CachedRecordStore, f *flakyStore, clock *time.Time) {
+	f = &flakyStore{MemRecordStore: mem_rs.Create()}
+	c = Create(f, 10*time.Second)
+	now := time.Now()
+	clock = &now
+	c.now = func() time.Time { return *clock }
+	return
+}
+
+func expectVals(t *testing.T, c *CachedRecordStore, key string, expected ...string) {
+	vals, err := c.GetAll(1, key)
+	if err != nil {
+		t.Errorf("GetAll(%s) failed: %s", key, err)
+	}
+	if len(vals) != len(expected) || (len(vals) > 0 && vals[0] != expected[0]) {
+		t.Errorf("Got %v for %s -- expected %v", vals, key, expected)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c, f, clock := newTestCache()
+	f.PutVal(1, "foo.bar.", "127.0.0.1")
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+	expectVals(t, c, "*.bar.")
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+	expectVals(t, c, "*.bar.")
+	if n := f.readCount(); n != 2 {
+		t.Errorf("Store was read %d times -- expected 2", n)
+	}
+
+	// Changes made through the cache are seen at once
+	c.PutVal(1, "*.bar.", "127.0.0.2")
+	expectVals(t, c, "*.bar.", "127.0.0.2")
+	c.Apply([]record_store.StoreOp{{Type: record_store.StoreDelKey, DnsType: 1, Key: "*.bar."}})
+	expectVals(t, c, "*.bar.")
+
+	// Changes made behind its back are seen once the entry expires. The expired entry is served
+	// while a single background fetch refreshes it
+	f.PutVal(1, "foo.bar.", "127.0.0.3")
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+	*clock = clock.Add(11 * time.Second)
+	reads := f.readCount()
+	for i := 0; i < 3; i++ {
+		expectVals(t, c, "foo.bar.", "127.0.0.1")
+	}
+	c.refreshes.Wait()
+	if n := f.readCount() - reads; n != 1 {
+		t.Errorf("Store was read %d times to refresh an entry -- expected 1", n)
+	}
+	vals, _ := c.GetAll(1, "foo.bar.")
+	if len(vals) != 2 {
+		t.Errorf("Got %v after the entry was refreshed -- expected 2 values", vals)
+	}
+
+	// Expired entries are served while the store is down
+	f.setDown(true)
+	*clock = clock.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if vals, err := c.GetAll(1, "foo.bar."); err != nil || len(vals) != 2 {
+			t.Errorf("Got %v, %v with the store down -- expected the cached values", vals, err)
+		}
+		c.refreshes.Wait()
+	}
+	if _, err := c.GetAll(1, "new.bar."); err == nil {
+		t.Error("GetAll() of an uncached key succeeded with the store down")
+	}
+	f.setDown(false)
+	c.Clear()
+	expectVals(t, c, "foo.bar.")
+}
+
+func TestConformance(t *testing.T) {
+	rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+		return Create(mem_rs.Create(), time.Hour)
+	})
+}
+
+// Passes notices given to Notify to the Watch callback, as if they came from another instance
+type noticeStore struct {
+	*mem_rs.MemRecordStore
+	notices chan record_set.StoreNotice
+}
+
+func (n *noticeStore) Notify(notice record_set.StoreNotice) error {
+	n.notices <- notice
+	return nil
+}
+
+func (n *noticeStore) Watch(ctx context.Context, fn func(record_set.StoreNotice)) error {
+	for {
+		select {
+		case notice := <-n.notices:
+			fn(notice)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestCacheNotices(t *testing.T) {
+	ns := &noticeStore{mem_rs.Create(), make(chan record_set.StoreNotice)}
+	c := Create(ns, time.Hour)
+	ns.PutVal(1, "foo.bar.", "127.0.0.1")
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seen := make(chan record_set.StoreNotice)
+	go c.Watch(ctx, func(n record_set.StoreNotice) { seen <- n })
+
+	ns.DelKey(1, "foo.bar.")
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+	c.Notify(record_set.StoreNotice{Keys: []record_store.StoreKey{{DnsType: 1, Key: "foo.bar."}}})
+	<-seen
+	expectVals(t, c, "foo.bar.")
+
+	ns.PutVal(1, "foo.bar.", "127.0.0.2")
+	c.Notify(record_set.StoreNotice{Reset: true})
+	<-seen
+	expectVals(t, c, "foo.bar.", "127.0.0.2")
+}
+
+// A store whose reads wait until released, and that records being closed
+type slowStore struct {
+	*mem_rs.MemRecordStore
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (s *slowStore) GetAll(dnsType uint16, key string) ([]string, error) {
+	<-s.release
+	return s.MemRecordStore.GetAll(dnsType, key)
+}
+
+func (s *slowStore) Close() error {
+	close(s.closed)
+	return nil
+}
+
+// Close waits for a running refresh before closing the store, and starts no new ones
+func TestCacheClose(t *testing.T) {
+	s := &slowStore{mem_rs.Create(), make(chan struct{}, 1), make(chan struct{})}
+	c := Create(s, 10*time.Second)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	s.PutVal(1, "foo.bar.", "127.0.0.1")
+	s.release <- struct{}{}
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+
+	now = now.Add(time.Minute)
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+	done := make(chan error)
+	go func() { done <- c.Close() }()
+	select {
+	case <-s.closed:
+		t.Fatal("Store closed while a refresh was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Error("Close()", err)
+	}
+	select {
+	case <-s.closed:
+	default:
+		t.Error("Store not closed")
+	}
+	// Served from the cache, without a refresh that would block on the closed store
+	now = now.Add(time.Minute)
+	expectVals(t, c, "foo.bar.", "127.0.0.1")
+}
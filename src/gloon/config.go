@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"strings"
+)
+
+// TOML configuration file. Every value is optional, and command line flags override file values.
+// Pointers let us tell values that are missing from the file from zero values
+type Config struct {
+	Debug      *bool            `toml:"debug"`
+	Ttl        *int             `toml:"ttl"`
+	NoPtr      *bool            `toml:"no_ptr"`
+	Listeners  ListenersConfig  `toml:"listeners"`
+	Store      StoreConfig      `toml:"store"`
+	Docker     DockerConfig     `toml:"docker"`
+	Hostfiles  HostfilesConfig  `toml:"hostfiles"`
+	Records    []RecordConfig   `toml:"records"`
+	Forwarding ForwardingConfig `toml:"forwarding"`
+	Api        ApiConfig        `toml:"api"`
+}
+
+type ListenersConfig struct {
+	Dns *string `toml:"dns"`
+	Api *string `toml:"api"`
+}
+
+type ApiConfig struct {
+	Tokens   *string `toml:"tokens"`
+	TlsCert  *string `toml:"tls_cert"`
+	TlsKey   *string `toml:"tls_key"`
+	ClientCa *string `toml:"client_ca"`
+}
+
+type StoreConfig struct {
+	Type          *string `toml:"type"`
+	Opts          *string `toml:"opts"`
+	Cache         *int    `toml:"cache"`
+	CleanupOnExit *bool   `toml:"cleanup_on_exit"`
+}
+
+type DockerConfig struct {
+	Enabled          *bool    `toml:"enabled"`
+	Hosts            []string `toml:"hosts"`
+	Network          *string  `toml:"network"`
+	HostnameFilter   *string  `toml:"hostname_filter"`
+	HostnameTemplate *string  `toml:"hostname_template"`
+	AppendDomain     *string  `toml:"append_domain"`
+	WithdrawPaused   *bool    `toml:"withdraw_paused"`
+	RequireHealthy   *bool    `toml:"require_healthy"`
+	Swarm            *bool    `toml:"swarm"`
+	Txt              *bool    `toml:"txt"`
+	TxtLabels        []string `toml:"txt_labels"`
+}
+
+type HostfilesConfig struct {
+	Files          []string `toml:"files"`
+	Zonefiles      []string `toml:"zonefiles"`
+	ReloadInterval *int     `toml:"reload_interval"`
+}
+
+// Static record, same as --hostname
+type RecordConfig struct {
+	Name  string `toml:"name"`
+	Type  string `toml:"type"`
+	Value string `toml:"value"`
+}
+
+type ForwardingConfig struct {
+	Enabled    *bool   `toml:"enabled"`
+	Resolvconf *string `toml:"resolvconf"`
+	Timeout    *int    `toml:"timeout"`
+}
+
+// Load a configuration file. Keys we do not know about are an error, so typos don't go unnoticed
+func LoadConfig(fn string) (cfg *Config, err error) {
+	cfg = &Config{}
+	md, err := toml.DecodeFile(fn, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("Unknown configuration keys in %s: %s", fn, strings.Join(keys, ", "))
+	}
+	for _, r := range cfg.Records {
+		if r.Name == "" || r.Value == "" {
+			return nil, fmt.Errorf("Records in %s need a name and a value", fn)
+		}
+		if r.Type != "" && strings.ToUpper(r.Type) != "A" {
+			return nil, fmt.Errorf("Unsupported type %s for record %s in %s. Only A records are supported", r.Type, r.Name, fn)
+		}
+	}
+	return
+}
+
+// Copy file values into settings, skipping anything set by the flag of the same name
+func (cfg *Config) Apply(s *Settings, isSet func(flag string) bool) {
+	str := func(flag string, v *string, dst *string) {
+		if v != nil && !isSet(flag) {
+			*dst = *v
+		}
+	}
+	num := func(flag string, v *int, dst *int) {
+		if v != nil && !isSet(flag) {
+			*dst = *v
+		}
+	}
+	boolean := func(flag string, v *bool, dst *bool, invert bool) {
+		if v != nil && !isSet(flag) {
+			*dst = *v != invert
+		}
+	}
+	slice := func(flag string, v []string, dst *[]string) {
+		if v != nil && !isSet(flag) {
+			*dst = v
+		}
+	}
+	boolean("debug", cfg.Debug, &s.Debug, false)
+	num("ttl", cfg.Ttl, &s.Ttl)
+	boolean("no-ptr", cfg.NoPtr, &s.NoPtr, false)
+
+	str("listen", cfg.Listeners.Dns, &s.ResolverAddr)
+	str("api-addr", cfg.Listeners.Api, &s.ApiAddr)
+	str("api-tokens", cfg.Api.Tokens, &s.ApiTokensFile)
+	str("api-tls-cert", cfg.Api.TlsCert, &s.ApiTlsCert)
+	str("api-tls-key", cfg.Api.TlsKey, &s.ApiTlsKey)
+	str("api-client-ca", cfg.Api.ClientCa, &s.ApiClientCa)
+
+	str("store", cfg.Store.Type, &s.Store)
+	str("store-opts", cfg.Store.Opts, &s.StoreOpts)
+	num("store-cache", cfg.Store.Cache, &s.StoreCache)
+	boolean("cleanup-on-exit", cfg.Store.CleanupOnExit, &s.CleanupOnExit, false)
+
+	boolean("disable-docker", cfg.Docker.Enabled, &s.DisableDocker, true)
+	slice("docker-host", cfg.Docker.Hosts, &s.DockerHosts)
+	str("docker-network", cfg.Docker.Network, &s.DockerNetwork)
+	str("hostname-filter", cfg.Docker.HostnameFilter, &s.HostnameFilter)
+	str("hostname-template", cfg.Docker.HostnameTemplate, &s.HostnameTemplate)
+	str("append-domain", cfg.Docker.AppendDomain, &s.AppendDomain)
+	boolean("docker-withdraw-paused", cfg.Docker.WithdrawPaused, &s.DockerWithdrawPaused, false)
+	boolean("docker-require-healthy", cfg.Docker.RequireHealthy, &s.DockerRequireHealthy, false)
+	boolean("docker-swarm", cfg.Docker.Swarm, &s.DockerSwarm, false)
+	boolean("docker-txt", cfg.Docker.Txt, &s.DockerTxt, false)
+	slice("docker-txt-label", cfg.Docker.TxtLabels, &s.DockerTxtLabels)
+
+	slice("hostfile", cfg.Hostfiles.Files, &s.Hostfiles)
+	slice("zonefile", cfg.Hostfiles.Zonefiles, &s.Zonefiles)
+	num("reload-interval", cfg.Hostfiles.ReloadInterval, &s.HostfileReloadInterval)
+
+	if len(cfg.Records) > 0 && !isSet("hostname") {
+		s.Hostnames = nil
+		for _, r := range cfg.Records {
+			s.Hostnames = append(s.Hostnames, r.Name+"="+r.Value)
+		}
+	}
+
+	boolean("disable-forward", cfg.Forwarding.Enabled, &s.DisableForwarding, true)
+	str("resolvconf", cfg.Forwarding.Resolvconf, &s.ResolvFile)
+	num("resolver-timeout", cfg.Forwarding.Timeout, &s.ResolverTimeout)
+}
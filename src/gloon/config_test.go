@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("../../gloon.toml")
+	if err != nil {
+		t.Fatal("LoadConfig()", err)
+	}
+	s := Settings{ResolverAddr: ":5053", Ttl: 3600}
+	// --listen given on the command line
+	cfg.Apply(&s, func(flag string) bool { return flag == "listen" })
+	if s.ResolverAddr != ":5053" {
+		t.Errorf("Flag value %s was overridden by config file", s.ResolverAddr)
+	}
+	if s.ApiAddr != "127.0.0.1:8080" || s.AppendDomain != "docker" || s.DisableDocker || s.DisableForwarding {
+		t.Errorf("Config file values not applied: %#v", s)
+	}
+	if len(s.Hostnames) != 2 || s.Hostnames[0] != "*.docker=192.168.1.2" {
+		t.Errorf("Unexpected static records: %#v", s.Hostnames)
+	}
+}
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-config")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "gloon.toml")
+	writeHosts(t, fn, "[docker]\nnetwrok = \"front\"\n")
+	if _, err := LoadConfig(fn); err == nil || !strings.Contains(err.Error(), "docker.netwrok") {
+		t.Errorf("Expected unknown key error, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+)
+
+// Runtime independent view of a container, with everything we need to publish records for it
+type Container struct {
+	ID       string
+	Name     string // Container name without the leading slash
+	Hostname string
+	Image    string
+	Labels   map[string]string
+	Networks map[string]string // IPv4 address keyed by network name
+	Health   string            // Healthcheck status. Empty if the container has no healthcheck
+	Paused   bool
+}
+
+// Container lifecycle event. Actions are normalized to the docker names: start, die, stop, destroy,
+// pause, unpause, rename and health_status
+type ContainerEvent struct {
+	ID     string
+	Action string
+}
+
+// A container runtime we can publish records for
+type ContainerSource interface {
+	List(ctx context.Context) ([]string, error)                       // IDs of running containers
+	Inspect(ctx context.Context, ID string) (*Container, error)       // Current state of a container
+	Events(ctx context.Context) (<-chan ContainerEvent, <-chan error) // Event stream. Stops when ctx is cancelled or on error
+	String() string                                                   // Name used in logs
+}
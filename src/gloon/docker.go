@@ -4,27 +4,55 @@ import (
 	"context"
 	"fmt"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
 	"github.com/miekg/dns"
 	. "gloon/record_set"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// Container label that turns waiting for a healthy healthcheck on or off for a single container
+const requireHealthyLabel = "gloon.require-healthy"
+
+// Records published on behalf of a container
+type containerRecord struct {
+	hostname, ip string
+	txt          []string // TXT values describing the container, if enabled
+}
+
+// TXT values from an earlier publication that are no longer part of cr
+func (cr containerRecord) staleTxt(old containerRecord) (stale []string) {
+	if old.hostname != cr.hostname {
+		return old.txt
+	}
+	for _, v := range old.txt {
+		if !containsString(cr.txt, v) {
+			stale = append(stale, v)
+		}
+	}
+	return
+}
+
+// Publishes records for the containers of a single ContainerSource (docker, podman)
 type DockerMonitor struct {
-	recs            *RecordSet
+	recs   *RecordSet
+	source ContainerSource
+	sync.Mutex
+	cfg        *MonitorConfig
+	containers map[string]containerRecord // Published records, keyed by container ID
+}
+
+// Settings dependent state of a monitor. Replaced as a whole on reload
+type MonitorConfig struct {
 	settings        *Settings
-	cli             *client.Client
+	domain          string
 	hostname_filter *regexp.Regexp
+	hostname_tmpl   *HostnameTemplate
 }
 
-func NewDockerMonitor(recs *RecordSet, settings *Settings) (dm *DockerMonitor, err error) {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		return
-	}
+func NewMonitorConfig(settings *Settings, domain string) (cfg *MonitorConfig, err error) {
 	var hostname_filter *regexp.Regexp
 	if settings.HostnameFilter != "" {
 		hostname_filter, err = regexp.Compile(settings.HostnameFilter)
@@ -32,110 +60,288 @@ func NewDockerMonitor(recs *RecordSet, settings *Settings) (dm *DockerMonitor, e
 			return
 		}
 	}
-	dm = &DockerMonitor{recs, settings, cli, hostname_filter}
+	var hostname_tmpl *HostnameTemplate
+	if settings.HostnameTemplate != "" {
+		hostname_tmpl, err = NewHostnameTemplate(settings.HostnameTemplate)
+		if err != nil {
+			return
+		}
+	}
+	cfg = &MonitorConfig{settings, domain, hostname_filter, hostname_tmpl}
 	return
 }
 
-func (dm *DockerMonitor) Run() (err error) {
-	log.Printf("Starting docker monitor...")
+func NewDockerMonitor(recs *RecordSet, settings *Settings, source ContainerSource, domain string) (dm *DockerMonitor, err error) {
+	cfg, err := NewMonitorConfig(settings, domain)
+	if err != nil {
+		return
+	}
+	dm = &DockerMonitor{recs: recs, source: source, cfg: cfg, containers: make(map[string]containerRecord)}
+	return
+}
+
+// Apply new settings, and republish all containers under them
+func (dm *DockerMonitor) Reconfigure(cfg *MonitorConfig) {
+	dm.Lock()
+	dm.cfg = cfg
+	dm.Unlock()
+	IDs, err := dm.source.List(context.Background())
+	if err != nil {
+		log.Printf("Unable to list containers on %s: %s", dm.source, err.Error())
+		return
+	}
+	running := make(map[string]bool)
+	for _, ID := range IDs {
+		running[ID] = true
+		if err := dm.addRecord(ID); err != nil {
+			log.Printf("Unable to add container IP  %s - %s", shortID(ID), err.Error())
+		}
+	}
+	dm.Lock()
+	var gone []string
+	for ID := range dm.containers {
+		if !running[ID] {
+			gone = append(gone, ID)
+		}
+	}
+	dm.Unlock()
+	for _, ID := range gone {
+		dm.delRecord(ID)
+	}
+}
+
+func (dm *DockerMonitor) config() *MonitorConfig {
+	dm.Lock()
+	defer dm.Unlock()
+	return dm.cfg
+}
+
+// Publish running containers, then follow container events until ctx is cancelled or the event
+// stream fails
+func (dm *DockerMonitor) Run(ctx context.Context) (err error) {
+	log.Printf("Starting docker monitor for %s...", dm.source)
+	// Handle panics here
+	defer func() {
+		if r := recover(); r != nil {
+			handlePanic(r)
+		}
+	}()
 	// See if we need to create any A records since we've just come up
-	containers, err := dm.cli.ContainerList(context.Background(), types.ContainerListOptions{})
+	IDs, err := dm.source.List(ctx)
 	if err != nil {
 		return err
 	}
-	for _, container := range containers {
-		err := dm.addRecord(container.ID)
+	for _, ID := range IDs {
+		err := dm.addRecord(ID)
 		if err != nil {
-			log.Printf("Unable to add container IP  %s - %s", container.ID[:10], err.Error())
+			log.Printf("Unable to add container IP  %s - %s", shortID(ID), err.Error())
 			continue
 		}
 	}
-	// Loop  on docker events forever, adding and removing records as needed
-events:
+	// Loop on docker events, adding and removing records as needed
+	ev, ev_err := dm.source.Events(ctx)
 	for {
-		// Handle panics here
-		defer func() {
-			if r := recover(); r != nil {
-				handlePanic(r)
+		select {
+		case event := <-ev:
+			log.Printf("Got event from %s: %s %s", dm.source, event.Action, shortID(event.ID))
+			if err := dm.handleEvent(event); err != nil {
+				log.Printf("Unable to process %s event: %s", event.Action, err.Error())
 			}
-		}()
-		ev, ev_err := dm.cli.Events(context.Background(), types.EventsOptions{})
-		for {
-			select {
-			case event := <-ev:
-				var err error
-				log.Printf("Got event: %s %s %s %s", event.Type, event.Action, event.Status, event.Actor.ID[:10])
-				if event.Type == "container" && event.Action == "start" && event.Status == "start" {
-					err = dm.addRecord(event.Actor.ID)
-				} else if event.Type == "container" && event.Action == "die" && event.Status == "die" {
-					err = dm.delRecord(event.Actor.ID)
-				}
-				if err != nil {
-					log.Printf("Unable to process %s event: %s", event.Action, err.Error())
-				}
-			case err := <-ev_err:
-				log.Printf("Got error event: %s", err.Error())
-				break events
+		case err := <-ev_err:
+			if ctx.Err() != nil {
+				return nil
 			}
+			log.Printf("Got error event: %s", err.Error())
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Remove every record the monitor published
+func (dm *DockerMonitor) clear() {
+	dm.Lock()
+	var IDs []string
+	for ID := range dm.containers {
+		IDs = append(IDs, ID)
+	}
+	dm.Unlock()
+	for _, ID := range IDs {
+		dm.delRecord(ID)
+	}
+}
+
+func (dm *DockerMonitor) handleEvent(event ContainerEvent) (err error) {
+	ID := event.ID
+	settings := dm.config().settings
+	switch event.Action {
+	case "start", "health_status":
+		// addRecord withdraws the record when health is required but the container is not healthy
+		err = dm.addRecord(ID)
+	case "unpause":
+		if settings.DockerWithdrawPaused {
+			err = dm.addRecord(ID)
+		}
+	case "pause":
+		if settings.DockerWithdrawPaused {
+			err = dm.delRecord(ID)
+		}
+	case "die", "stop", "destroy":
+		err = dm.delRecord(ID)
+	case "rename":
+		// Drop whatever we published under the old name, then publish again from current container state
+		if err = dm.delRecord(ID); err == nil {
+			err = dm.addRecord(ID)
 		}
 	}
 	return
 }
 
+// Remove the record we published for a container, if any. We rely on our own bookkeeping
+// rather than inspecting the container, since it may already be gone (destroy)
 func (dm *DockerMonitor) delRecord(ID string) (err error) {
-	r := dm.recs
-	cli := dm.cli
-	container_json, err := cli.ContainerInspect(context.Background(), ID)
-	if err != nil {
-		log.Printf("Unable to inspect container %s - %s", ID[:10], err.Error())
+	dm.Lock()
+	cr, ok := dm.containers[ID]
+	delete(dm.containers, ID)
+	dm.Unlock()
+	if !ok {
 		return
 	}
-	hostname := container_json.Config.Hostname
-	log.Printf("Removing A record: %s %s %s", ID[:10], container_json.Name, hostname)
-	r.Del(dns.TypeA, hostname)
+	log.Printf("Removing A record: %s %s %s", shortID(ID), cr.hostname, cr.ip)
+	dm.recs.DelAddr(dns.TypeA, cr.hostname, cr.ip)
+	for _, v := range cr.txt {
+		dm.recs.DelAddr(dns.TypeTXT, cr.hostname, v)
+	}
 	return
 }
 
 func (dm *DockerMonitor) addRecord(ID string) (err error) {
-	cli := dm.cli
 	recs := dm.recs
-	container_json, err := cli.ContainerInspect(context.Background(), ID)
+	cfg := dm.config()
+	settings := cfg.settings
+	container, err := dm.source.Inspect(context.Background(), ID)
 	if err != nil {
-		log.Printf("Unable to inspect container %s - %s", ID[:10], err.Error())
+		log.Printf("Unable to inspect container %s - %s", shortID(ID), err.Error())
 		return
 	}
-	hostname := container_json.Config.Hostname
-	// Only publish non-default hostnames
-	if strings.Index(ID, hostname) == 0 {
+	nw, ip := getContainerIpV4(container, settings.DockerNetwork)
+	hostname := container.Hostname
+	if cfg.hostname_tmpl != nil {
+		hostname, err = cfg.hostname_tmpl.Hostname(newHostnameData(container, nw, cfg.domain))
+		if err != nil {
+			log.Printf("WARNING: hostname template failed for container %s (%s): %s. Ignoring.", shortID(ID), container.Name, err.Error())
+			return dm.delRecord(ID)
+		}
+	} else if strings.Index(ID, hostname) == 0 {
+		// Only publish non-default hostnames
 		log.Printf("Ignoring host %s", hostname)
-		return
+		return dm.delRecord(ID)
 	}
-	if dm.hostname_filter != nil && !dm.hostname_filter.MatchString(hostname) {
-		log.Printf("NOTE: hostname %s does not match filter %s. Ignoring.", hostname, dm.settings.HostnameFilter)
-		return
+	if cfg.hostname_filter != nil && !cfg.hostname_filter.MatchString(hostname) {
+		log.Printf("NOTE: hostname %s does not match filter %s. Ignoring.", hostname, settings.HostnameFilter)
+		return dm.delRecord(ID)
+	}
+	if settings.DockerWithdrawPaused && container.Paused {
+		log.Printf("NOTE: container %s (%s) is paused. Not publishing.", shortID(ID), hostname)
+		return dm.delRecord(ID)
+	}
+	if requireHealthy(container, settings) && !isHealthy(container) {
+		log.Printf("NOTE: container %s (%s) is not healthy yet. Not publishing.", shortID(ID), hostname)
+		return dm.delRecord(ID)
+	}
+	if ip == "" {
+		log.Printf("NOTE: container %s (%s) has no IPv4 address (nw = %s). Not publishing.", shortID(ID), hostname, settings.DockerNetwork)
+		return dm.delRecord(ID)
 	}
-	ip := getContainerIpV4(container_json, dm.settings.DockerNetwork)
-	if dm.settings.AppendDomain != "" {
-		hostname = fmt.Sprintf("%s.%s", hostname, dm.settings.AppendDomain)
+	// Templates produce fully qualified names
+	if cfg.domain != "" && cfg.hostname_tmpl == nil {
+		hostname = fmt.Sprintf("%s.%s", hostname, cfg.domain)
 	}
-	log.Printf("Adding A record: %s %s %s %s (nw = %s)", ID[:10], container_json.Name, hostname, ip, dm.settings.DockerNetwork)
+	cr := containerRecord{hostname: hostname, ip: ip}
+	if settings.DockerTxt {
+		cr.txt = containerTxt(container, settings.DockerTxtLabels)
+	}
+	dm.Lock()
+	old, ok := dm.containers[ID]
+	dm.containers[ID] = cr
+	dm.Unlock()
+	if ok && (old.hostname != cr.hostname || old.ip != cr.ip) {
+		log.Printf("Replacing A record: %s %s %s", shortID(ID), old.hostname, old.ip)
+		recs.DelAddr(dns.TypeA, old.hostname, old.ip)
+	}
+	if ok {
+		for _, v := range cr.staleTxt(old) {
+			recs.DelAddr(dns.TypeTXT, old.hostname, v)
+		}
+	}
+	log.Printf("Adding A record: %s %s %s %s (nw = %s)", shortID(ID), container.Name, hostname, ip, settings.DockerNetwork)
 	recs.Put(dns.TypeA, hostname, ip)
+	for _, v := range cr.txt {
+		recs.Put(dns.TypeTXT, hostname, v)
+	}
 	return
 }
 
-func getContainerIpV4(data types.ContainerJSON, nw string) (ip string) {
-	var ep *network.EndpointSettings
+// TXT values describing a container: its ID, image and compose service, plus any whitelisted labels
+func containerTxt(c *Container, labels []string) (txt []string) {
+	txt = append(txt, "id="+shortID(c.ID))
+	if c.Image != "" {
+		txt = append(txt, "image="+c.Image)
+	}
+	if svc := c.Labels[composeServiceLabel]; svc != "" {
+		txt = append(txt, "service="+svc)
+	}
+	for _, l := range labels {
+		if v, ok := c.Labels[l]; ok {
+			txt = append(txt, l+"="+v)
+		}
+	}
+	return
+}
+
+// Health gating is off by default. The global setting can be overridden per container by label
+func requireHealthy(c *Container, settings *Settings) bool {
+	if v, ok := c.Labels[requireHealthyLabel]; ok {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+		log.Printf("WARNING: invalid %s label value %q on %s", requireHealthyLabel, v, c.Name)
+	}
+	return settings.DockerRequireHealthy
+}
+
+// Containers without a healthcheck have nothing to wait for, so we treat them as healthy
+func isHealthy(c *Container) bool {
+	return c.Health == "" || c.Health == types.Healthy
+}
+
+// Container address, and the network it belongs to
+func getContainerIpV4(c *Container, nw string) (network, ip string) {
 	if nw != "" {
-		ep = data.NetworkSettings.Networks[nw]
-	} else {
-		// else just pick a random one
-		for _, v := range data.NetworkSettings.Networks {
-			ep = v
-			break
+		return nw, c.Networks[nw]
+	}
+	// else just pick a random one
+	for k, v := range c.Networks {
+		return k, v
+	}
+	return
+}
+
+func containsString(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
 		}
 	}
-	if ep != nil {
-		ip = ep.IPAddress
+	return false
+}
+
+// Truncated container ID for logging
+func shortID(ID string) string {
+	if len(ID) > 10 {
+		return ID[:10]
 	}
-	return ip
+	return ID
 }
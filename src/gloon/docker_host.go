@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A docker daemon to monitor. Parsed from --docker-host values of the form
+// HOST[,domain=DOMAIN][,tlscacert=FILE][,tlscert=FILE][,tlskey=FILE][,tlsverify][,tlsskipverify]
+type DockerHost struct {
+	Host          string // Daemon address, ex. tcp://10.1.2.3:2376. Empty means use the DOCKER_* environment
+	Domain        string // Domain appended to records from this daemon. Defaults to --append-domain
+	TlsCaCert     string // CA certificate used to verify the daemon. The system roots are used without one
+	TlsCert       string // Client certificate
+	TlsKey        string // Client key
+	TlsVerify     bool   // Use TLS, even without certificates
+	TlsSkipVerify bool   // Don't verify the daemon certificate. Only without a CA certificate
+}
+
+func ParseDockerHost(spec string, settings *Settings) (h *DockerHost, err error) {
+	parts := strings.Split(spec, ",")
+	h = &DockerHost{Host: strings.TrimSpace(parts[0]), Domain: settings.AppendDomain}
+	if h.Host == "" {
+		return nil, fmt.Errorf("No daemon address in docker host %q", spec)
+	}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		val := ""
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+		switch kv[0] {
+		case "domain":
+			h.Domain = val
+		case "tlscacert":
+			h.TlsCaCert = val
+		case "tlscert":
+			h.TlsCert = val
+		case "tlskey":
+			h.TlsKey = val
+		case "tlsverify", "tlsskipverify":
+			on := true
+			if val != "" {
+				if on, err = strconv.ParseBool(val); err != nil {
+					return nil, fmt.Errorf("Invalid %s value in docker host %q", kv[0], spec)
+				}
+			}
+			if kv[0] == "tlsskipverify" {
+				h.TlsSkipVerify = on
+			} else if h.TlsVerify = on; !on {
+				// Turning checks off has to be asked for by name
+				return nil, fmt.Errorf("tlsverify=false in docker host %q. Use tlsskipverify to connect without verifying the daemon", spec)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown option %q in docker host %q", kv[0], spec)
+		}
+	}
+	if h.TlsSkipVerify && h.TlsCaCert != "" {
+		return nil, fmt.Errorf("Docker host %q has a tlscacert, so the daemon is always verified. Remove tlsskipverify", spec)
+	}
+	return
+}
+
+// Parse several --docker-host values. Each daemon needs a domain of its own, or containers with
+// the same name on two daemons would publish the same host name and overwrite each other
+func ParseDockerHosts(specs []string, settings *Settings) (hosts []*DockerHost, err error) {
+	domains := make(map[string]string)
+	for _, spec := range specs {
+		h, err := ParseDockerHost(spec, settings)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := domains[h.Domain]; ok {
+			return nil, fmt.Errorf("Docker hosts %s and %s both use domain %q. Give each a domain= of its own", other, h, h.Domain)
+		}
+		domains[h.Domain] = h.String()
+		hosts = append(hosts, h)
+	}
+	return
+}
+
+// Name used to identify the daemon in logs
+func (h *DockerHost) String() string {
+	if h.Host == "" {
+		return "default"
+	}
+	return h.Host
+}
+
+func (h *DockerHost) useTls() bool {
+	return h.TlsVerify || h.TlsSkipVerify || h.TlsCaCert != "" || h.TlsCert != "" || h.TlsKey != ""
+}
+
+// Build a client for the daemon. Hosts without an address get the standard docker environment client,
+// or a podman socket if there is no docker daemon
+func (h *DockerHost) NewClient() (cli *client.Client, err error) {
+	if h.Host == "" {
+		if sock := detectPodmanSocket(); sock != "" {
+			log.Printf("No docker daemon found. Using podman socket %s", sock)
+			return client.NewClient("unix://"+sock, client.DefaultVersion, nil, nil)
+		}
+		return client.NewEnvClient()
+	}
+	var httpClient *http.Client
+	if h.useTls() {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             h.TlsCaCert,
+			CertFile:           h.TlsCert,
+			KeyFile:            h.TlsKey,
+			InsecureSkipVerify: h.TlsSkipVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsc}}
+	}
+	return client.NewClient(h.Host, client.DefaultVersion, httpClient, nil)
+}
+
+// Look for podman's docker compatible API socket, rootless locations first. We only do this when
+// DOCKER_HOST is unset and the default docker socket does not exist
+func detectPodmanSocket() string {
+	if os.Getenv("DOCKER_HOST") != "" || !strings.HasPrefix(client.DefaultDockerHost, "unix://") {
+		return ""
+	}
+	if isSocket(strings.TrimPrefix(client.DefaultDockerHost, "unix://")) {
+		return ""
+	}
+	var candidates []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates,
+		fmt.Sprintf("/run/user/%d/podman/podman.sock", os.Getuid()),
+		"/run/podman/podman.sock",
+	)
+	for _, sock := range candidates {
+		if isSocket(sock) {
+			return sock
+		}
+	}
+	return ""
+}
+
+func isSocket(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeSocket != 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDockerHost(t *testing.T) {
+	settings := &Settings{AppendDomain: "docker"}
+	tests := []struct {
+		spec     string
+		expected DockerHost
+	}{
+		{"tcp://10.1.2.3:2375", DockerHost{Host: "tcp://10.1.2.3:2375", Domain: "docker"}},
+		{"unix:///var/run/docker.sock,domain=local", DockerHost{Host: "unix:///var/run/docker.sock", Domain: "local"}},
+		{"tcp://10.1.2.3:2375,domain=", DockerHost{Host: "tcp://10.1.2.3:2375"}},
+		{" tcp://10.1.2.3:2376 , tlsverify , tlscacert=/etc/ca.pem,tlscert=/etc/cert.pem,tlskey=/etc/key.pem", DockerHost{
+			Host: "tcp://10.1.2.3:2376", Domain: "docker", TlsCaCert: "/etc/ca.pem", TlsCert: "/etc/cert.pem", TlsKey: "/etc/key.pem", TlsVerify: true}},
+		{"tcp://10.1.2.3:2376,tlscacert=/etc/ca.pem", DockerHost{Host: "tcp://10.1.2.3:2376", Domain: "docker", TlsCaCert: "/etc/ca.pem"}},
+		{"tcp://10.1.2.3:2376,tlsskipverify", DockerHost{Host: "tcp://10.1.2.3:2376", Domain: "docker", TlsSkipVerify: true}},
+		{"tcp://10.1.2.3:2376,tlsskipverify=false", DockerHost{Host: "tcp://10.1.2.3:2376", Domain: "docker"}},
+	}
+	for _, test := range tests {
+		h, err := ParseDockerHost(test.spec, settings)
+		if err != nil {
+			t.Errorf("ParseDockerHost(%q) failed: %s", test.spec, err)
+		} else if !reflect.DeepEqual(*h, test.expected) {
+			t.Errorf("ParseDockerHost(%q) returned %+v -- expected %+v", test.spec, *h, test.expected)
+		}
+	}
+	for _, spec := range []string{"", ",domain=local", "tcp://10.1.2.3:2376,tlsverify=maybe", "tcp://10.1.2.3:2376,tls", "tcp://10.1.2.3:2376,domain=a,bogus=1",
+		"tcp://10.1.2.3:2376,tlsverify=false", "tcp://10.1.2.3:2376,tlscacert=/etc/ca.pem,tlsskipverify"} {
+		if _, err := ParseDockerHost(spec, settings); err == nil {
+			t.Errorf("ParseDockerHost(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestDockerHostTls(t *testing.T) {
+	for spec, expected := range map[string]bool{
+		"tcp://10.1.2.3:2375":                      false,
+		"tcp://10.1.2.3:2376,tlsverify":            true,
+		"tcp://10.1.2.3:2376,tlscert=/nonexistent": true,
+		"tcp://10.1.2.3:2376,tlsskipverify":        true,
+	} {
+		h, _ := ParseDockerHost(spec, &Settings{})
+		if h.useTls() != expected {
+			t.Errorf("useTls() for %q = %v -- expected %v", spec, h.useTls(), expected)
+		}
+	}
+	h, _ := ParseDockerHost("tcp://10.1.2.3:2376,tlscacert=/nonexistent/ca.pem,tlsverify", &Settings{})
+	if _, err := h.NewClient(); err == nil {
+		t.Error("NewClient() with a missing CA certificate succeeded")
+	}
+	h, _ = ParseDockerHost("tcp://10.1.2.3:2375", &Settings{})
+	if _, err := h.NewClient(); err != nil {
+		t.Error("NewClient()", err)
+	}
+}
+
+func TestParseDockerHosts(t *testing.T) {
+	settings := &Settings{AppendDomain: "docker"}
+	hosts, err := ParseDockerHosts([]string{"tcp://10.1.2.3:2375", "tcp://10.1.2.4:2375,domain=vm2.docker"}, settings)
+	if err != nil {
+		t.Fatal("ParseDockerHosts()", err)
+	}
+	if len(hosts) != 2 || hosts[0].Domain != "docker" || hosts[1].Domain != "vm2.docker" {
+		t.Errorf("ParseDockerHosts() returned %v", hosts)
+	}
+	// Both default to --append-domain
+	if _, err := ParseDockerHosts([]string{"tcp://10.1.2.3:2375", "tcp://10.1.2.4:2375"}, settings); err == nil {
+		t.Error("ParseDockerHosts() with a shared domain succeeded")
+	}
+	if _, err := ParseDockerHosts([]string{"tcp://10.1.2.3:2375,domain=a", "tcp://10.1.2.4:2375,domain=a"}, settings); err == nil {
+		t.Error("ParseDockerHosts() with the same domain= succeeded")
+	}
+}
+
+// --docker-host can be given more than once, one monitor each
+func TestDockerHostFlags(t *testing.T) {
+	settings, err := loadSettings([]string{"gloon", "--docker-host", "tcp://10.1.2.3:2375,domain=a", "--docker-host", "tcp://10.1.2.4:2375"})
+	if err != nil {
+		t.Fatal("loadSettings()", err)
+	}
+	expected := []string{"tcp://10.1.2.3:2375,domain=a", "tcp://10.1.2.4:2375"}
+	if !reflect.DeepEqual(settings.DockerHosts, expected) {
+		t.Errorf("Got docker hosts %v -- expected %v", settings.DockerHosts, expected)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"strings"
+)
+
+// Container events we ask the daemon to send us. Podman's docker compatible API has reported
+// some of these under its own names (died, remove), so we ask for those too
+var dockerEventActions = []string{"start", "die", "died", "stop", "destroy", "remove", "pause", "unpause", "rename", "health_status"}
+
+// Podman event names mapped to their docker equivalents
+var podmanEventActions = map[string]string{"died": "die", "remove": "destroy"}
+
+// Container source for the docker engine API, or anything compatible with it (podman)
+type DockerSource struct {
+	host *DockerHost
+	cli  *client.Client
+}
+
+func NewDockerSource(host *DockerHost) (ds *DockerSource, err error) {
+	cli, err := host.NewClient()
+	if err != nil {
+		return
+	}
+	ds = &DockerSource{host, cli}
+	return
+}
+
+func (ds *DockerSource) String() string {
+	return ds.host.String()
+}
+
+func (ds *DockerSource) List(ctx context.Context) (IDs []string, err error) {
+	containers, err := ds.cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return
+	}
+	for _, c := range containers {
+		IDs = append(IDs, c.ID)
+	}
+	return
+}
+
+func (ds *DockerSource) Inspect(ctx context.Context, ID string) (c *Container, err error) {
+	data, err := ds.cli.ContainerInspect(ctx, ID)
+	if err != nil {
+		return
+	}
+	c = &Container{
+		ID:       data.ID,
+		Name:     strings.TrimPrefix(data.Name, "/"),
+		Networks: make(map[string]string),
+	}
+	if data.Config != nil {
+		c.Hostname = data.Config.Hostname
+		c.Image = data.Config.Image
+		c.Labels = data.Config.Labels
+	}
+	if data.State != nil {
+		c.Paused = data.State.Paused
+		if data.State.Health != nil && data.State.Health.Status != types.NoHealthcheck {
+			c.Health = data.State.Health.Status
+		}
+	}
+	if data.NetworkSettings != nil {
+		for name, ep := range data.NetworkSettings.Networks {
+			// Rootless podman (slirp4netns) containers have no address of their own
+			if ep != nil && ep.IPAddress != "" {
+				c.Networks[name] = ep.IPAddress
+			}
+		}
+	}
+	return
+}
+
+func (ds *DockerSource) Events(ctx context.Context) (<-chan ContainerEvent, <-chan error) {
+	msgs, errs := ds.cli.Events(ctx, types.EventsOptions{Filters: eventFilters()})
+	out := make(chan ContainerEvent)
+	go func() {
+		for {
+			select {
+			case msg := <-msgs:
+				if msg.Type != events.ContainerEventType {
+					continue
+				}
+				select {
+				case out <- ContainerEvent{msg.Actor.ID, normalizeEventAction(msg.Action)}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+// Filter events server side so we only see the container lifecycle events we care about
+func eventFilters() filters.Args {
+	f := filters.NewArgs()
+	f.Add("type", events.ContainerEventType)
+	for _, action := range dockerEventActions {
+		f.Add("event", action)
+	}
+	return f
+}
+
+// Health events carry the new status in the action, ex. "health_status: healthy"
+func normalizeEventAction(action string) string {
+	action = strings.TrimSpace(strings.SplitN(action, ":", 2)[0])
+	if a, ok := podmanEventActions[action]; ok {
+		return a
+	}
+	return action
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/miekg/dns"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"sync"
+	"testing"
+)
+
+// A container runtime, and a swarm manager (see swarm_test.go)
+type fakeSource struct {
+	sync.Mutex
+	containers  map[string]*Container
+	events      chan ContainerEvent
+	errs        chan error
+	manager     bool
+	services    []swarm.Service
+	tasks       []swarm.Task
+	networks    map[string]string
+	swarmEvents chan events.Message
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{containers: make(map[string]*Container), events: make(chan ContainerEvent), errs: make(chan error, 1),
+		networks: make(map[string]string), swarmEvents: make(chan events.Message)}
+}
+
+func (fs *fakeSource) String() string {
+	return "fake"
+}
+
+func (fs *fakeSource) List(ctx context.Context) (IDs []string, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	for ID := range fs.containers {
+		IDs = append(IDs, ID)
+	}
+	return
+}
+
+func (fs *fakeSource) Inspect(ctx context.Context, ID string) (*Container, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	c, ok := fs.containers[ID]
+	if !ok {
+		return nil, fmt.Errorf("No such container: %s", ID)
+	}
+	cp := *c
+	return &cp, nil
+}
+
+func (fs *fakeSource) Events(ctx context.Context) (<-chan ContainerEvent, <-chan error) {
+	return fs.events, fs.errs
+}
+
+func (fs *fakeSource) set(c *Container) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.containers[c.ID] = c
+}
+
+func (fs *fakeSource) remove(ID string) {
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.containers, ID)
+}
+
+func newTestMonitor(t *testing.T, settings *Settings) (*DockerMonitor, *fakeSource, *record_set.RecordSet) {
+	fs := newFakeSource()
+	recs := record_set.Create(mem_rs.Create())
+	dm, err := NewDockerMonitor(recs, settings, fs, "docker")
+	if err != nil {
+		t.Fatal("NewDockerMonitor()", err)
+	}
+	return dm, fs, recs
+}
+
+func expectAddr(t *testing.T, recs *record_set.RecordSet, host, expected string) {
+	if addr := recs.Get(dns.TypeA, host); addr != expected {
+		t.Errorf("Got %q for %s -- expected %q", addr, host, expected)
+	}
+}
+
+func TestContainerLifecycle(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{DockerWithdrawPaused: true})
+	fs.set(&Container{ID: "0123456789abcdef", Name: "web", Hostname: "web", Networks: map[string]string{"bridge": "172.17.0.2"}})
+	dm.handleEvent(ContainerEvent{"0123456789abcdef", "start"})
+	expectAddr(t, recs, "web.docker.", "172.17.0.2")
+
+	dm.handleEvent(ContainerEvent{"0123456789abcdef", "pause"})
+	expectAddr(t, recs, "web.docker.", "")
+	dm.handleEvent(ContainerEvent{"0123456789abcdef", "unpause"})
+	expectAddr(t, recs, "web.docker.", "172.17.0.2")
+
+	fs.set(&Container{ID: "0123456789abcdef", Name: "api", Hostname: "api", Networks: map[string]string{"bridge": "172.17.0.2"}})
+	dm.handleEvent(ContainerEvent{"0123456789abcdef", "rename"})
+	expectAddr(t, recs, "web.docker.", "")
+	expectAddr(t, recs, "api.docker.", "172.17.0.2")
+
+	// Destroyed containers can no longer be inspected
+	fs.remove("0123456789abcdef")
+	dm.handleEvent(ContainerEvent{"0123456789abcdef", "destroy"})
+	expectAddr(t, recs, "api.docker.", "")
+}
+
+func TestRequireHealthy(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{DockerRequireHealthy: true})
+	c := &Container{ID: "0123456789abcdef", Name: "db", Hostname: "db", Health: "starting", Networks: map[string]string{"bridge": "172.17.0.3"}}
+	fs.set(c)
+	dm.handleEvent(ContainerEvent{c.ID, "start"})
+	expectAddr(t, recs, "db.docker.", "")
+
+	c.Health = "healthy"
+	dm.handleEvent(ContainerEvent{c.ID, "health_status"})
+	expectAddr(t, recs, "db.docker.", "172.17.0.3")
+
+	c.Health = "unhealthy"
+	dm.handleEvent(ContainerEvent{c.ID, "health_status"})
+	expectAddr(t, recs, "db.docker.", "")
+
+	// Label overrides the global setting
+	c.Labels = map[string]string{requireHealthyLabel: "false"}
+	dm.handleEvent(ContainerEvent{c.ID, "health_status"})
+	expectAddr(t, recs, "db.docker.", "172.17.0.3")
+}
+
+func TestNormalizeEventAction(t *testing.T) {
+	for action, expected := range map[string]string{"start": "start", "health_status: healthy": "health_status", "died": "die", "remove": "destroy"} {
+		if a := normalizeEventAction(action); a != expected {
+			t.Errorf("normalizeEventAction(%q) = %q -- expected %q", action, a, expected)
+		}
+	}
+}
+
+func TestHostnameTemplate(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{HostnameTemplate: `{{.Label "team"}}-{{.Name}}.{{.Network}}.docker`})
+	c := &Container{ID: "0123456789abcdef", Name: "web", Hostname: "0123456789ab", Labels: map[string]string{"team": "search"}, Networks: map[string]string{"front": "10.0.0.2"}}
+	fs.set(c)
+	dm.handleEvent(ContainerEvent{c.ID, "start"})
+	expectAddr(t, recs, "search-web.front.docker.", "10.0.0.2")
+
+	// Missing label produces an invalid name, which is rejected
+	c.Labels = nil
+	dm.handleEvent(ContainerEvent{c.ID, "rename"})
+	expectAddr(t, recs, "search-web.front.docker.", "")
+	expectAddr(t, recs, "-web.front.docker.", "")
+}
+
+func TestContainerTxt(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{DockerTxt: true, DockerTxtLabels: []string{"team"}})
+	c := &Container{ID: "0123456789abcdef", Name: "web", Hostname: "web", Image: "nginx:1.13",
+		Labels: map[string]string{"team": "search", "secret": "x", composeServiceLabel: "frontend"}, Networks: map[string]string{"bridge": "172.17.0.2"}}
+	fs.set(c)
+	dm.handleEvent(ContainerEvent{c.ID, "start"})
+	txt := recs.GetAll(dns.TypeTXT, "web.docker.")
+	expected := []string{"id=0123456789", "image=nginx:1.13", "service=frontend", "team=search"}
+	if fmt.Sprint(txt) != fmt.Sprint(expected) {
+		t.Errorf("Got TXT %#v -- expected %#v", txt, expected)
+	}
+
+	c.Image = "nginx:1.14"
+	dm.handleEvent(ContainerEvent{c.ID, "start"})
+	txt = recs.GetAll(dns.TypeTXT, "web.docker.")
+	expected = []string{"id=0123456789", "image=nginx:1.14", "service=frontend", "team=search"}
+	if fmt.Sprint(txt) != fmt.Sprint(expected) {
+		t.Errorf("Got TXT %#v -- expected %#v", txt, expected)
+	}
+
+	dm.handleEvent(ContainerEvent{c.ID, "die"})
+	if txt = recs.GetAll(dns.TypeTXT, "web.docker."); len(txt) != 0 {
+		t.Errorf("Got TXT %#v -- expected none", txt)
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{})
+	fs.set(&Container{ID: "0123456789abcdef", Name: "web", Hostname: "web", Networks: map[string]string{"bridge": "172.17.0.2"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- dm.Run(ctx)
+	}()
+	fs.set(&Container{ID: "fedcba9876543210", Name: "api", Hostname: "api", Networks: map[string]string{"bridge": "172.17.0.3"}})
+	fs.events <- ContainerEvent{"fedcba9876543210", "start"}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error("Run() after cancel", err)
+	}
+	expectAddr(t, recs, "web.docker.", "172.17.0.2")
+	expectAddr(t, recs, "api.docker.", "172.17.0.3")
+
+	dm.clear()
+	expectAddr(t, recs, "web.docker.", "")
+	expectAddr(t, recs, "api.docker.", "")
+}
+
+// The label turns health gating on for one container, and containers without a healthcheck are
+// published right away
+func TestRequireHealthyLabel(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{})
+	c := &Container{ID: "0123456789abcdef", Name: "db", Hostname: "db", Health: "unhealthy",
+		Labels: map[string]string{requireHealthyLabel: "true"}, Networks: map[string]string{"bridge": "172.17.0.3"}}
+	fs.set(c)
+	fs.set(&Container{ID: "fedcba9876543210", Name: "web", Hostname: "web", Labels: map[string]string{requireHealthyLabel: "true"},
+		Networks: map[string]string{"bridge": "172.17.0.4"}})
+	dm.handleEvent(ContainerEvent{c.ID, "start"})
+	dm.handleEvent(ContainerEvent{"fedcba9876543210", "start"})
+	expectAddr(t, recs, "db.docker.", "")
+	expectAddr(t, recs, "web.docker.", "172.17.0.4")
+
+	for _, step := range []struct{ health, expected string }{
+		{"healthy", "172.17.0.3"},
+		{"unhealthy", ""},
+		{"healthy", "172.17.0.3"},
+	} {
+		fs.set(&Container{ID: c.ID, Name: "db", Hostname: "db", Health: step.health, Labels: c.Labels, Networks: c.Networks})
+		dm.handleEvent(ContainerEvent{c.ID, normalizeEventAction("health_status: " + step.health)})
+		expectAddr(t, recs, "db.docker.", step.expected)
+	}
+
+	// An invalid label falls back to the global setting
+	fs.set(&Container{ID: c.ID, Name: "db", Hostname: "db", Health: "unhealthy", Labels: map[string]string{requireHealthyLabel: "maybe"}, Networks: c.Networks})
+	dm.handleEvent(ContainerEvent{c.ID, "health_status"})
+	expectAddr(t, recs, "db.docker.", "172.17.0.3")
+}
+
+func TestDockerReconfigure(t *testing.T) {
+	dm, fs, recs := newTestMonitor(t, &Settings{HostnameTemplate: "{{.Name}}.docker"})
+	fs.set(&Container{ID: "0123456789abcdef", Name: "web", Hostname: "0123456789ab", Networks: map[string]string{"bridge": "172.17.0.2"}})
+	fs.set(&Container{ID: "fedcba9876543210", Name: "db", Hostname: "db", Networks: map[string]string{"bridge": "172.17.0.3"}})
+	dm.handleEvent(ContainerEvent{"0123456789abcdef", "start"})
+	dm.handleEvent(ContainerEvent{"fedcba9876543210", "start"})
+	expectAddr(t, recs, "web.docker.", "172.17.0.2")
+	expectAddr(t, recs, "db.docker.", "172.17.0.3")
+
+	// Without the template, web is left with its default hostname, and the filter drops db
+	cfg, err := NewMonitorConfig(&Settings{HostnameFilter: "^api"}, "docker")
+	if err != nil {
+		t.Fatal("NewMonitorConfig()", err)
+	}
+	dm.Reconfigure(cfg)
+	expectAddr(t, recs, "web.docker.", "")
+	expectAddr(t, recs, "db.docker.", "")
+
+	// Containers that stopped while we weren't looking go too
+	cfg, _ = NewMonitorConfig(&Settings{}, "local")
+	dm.Reconfigure(cfg)
+	expectAddr(t, recs, "db.local.", "172.17.0.3")
+	fs.remove("fedcba9876543210")
+	dm.Reconfigure(cfg)
+	expectAddr(t, recs, "db.local.", "")
+
+	if _, err := NewMonitorConfig(&Settings{HostnameFilter: "("}, "docker"); err == nil {
+		t.Error("NewMonitorConfig() accepted an invalid filter")
+	}
+}
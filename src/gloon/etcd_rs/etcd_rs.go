@@ -0,0 +1,741 @@
+package etcd_rs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gloon/record_set"
+	"gloon/record_store"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout for requests other than watches
+const REQUEST_TIMEOUT = 5 * time.Second
+
+// Longest pause before retrying a change that raced with another writer
+const maxApplyPause = 50 * time.Millisecond
+
+// Most operations etcd takes in one transaction, by default
+const maxTxnOps = 128
+
+// A RecordStore on etcd v3, through its JSON gateway (/v3/...), so no client library is needed.
+// Each value is a key of its own, "/<namespace>/<type>/<key>/<value>", and a record is the keys
+// under its prefix. Metadata is kept in "/<namespace>/meta/<type>/<key>"
+type EtcdRecordStore struct {
+	endpoint  string
+	namespace string
+	client    *http.Client // For everything but watches, which stay open
+	watcher   *http.Client
+
+	// Held (shared) by writes until their revision is recorded, so the watch can tell them apart
+	// from changes made by others. Republishing holds it alone
+	writing sync.RWMutex
+
+	mu       sync.Mutex
+	lease    int64 // Attached to every value we put, when leases are on. 0 if not
+	ttl      int64
+	cancel   context.CancelFunc // Stops the lease keepalive
+	owned    map[string]string  // Keys we put with our lease, and their values, to put again if it expires
+	ours     map[int64]bool     // Revisions of our writes the watch hasn't reached yet
+	watching int                // Running watches. Revisions are only recorded while there are any
+}
+
+// opts is "ENDPOINT,NAMESPACE,LEASE", ex. "http://10.0.0.5:2379,gloon,30". With LEASE (seconds),
+// the values we put expire that long after this process stops renewing them, ex. if it crashes
+func Create(opts string) (r *EtcdRecordStore, err error) {
+	options := strings.Split(opts, ",")
+	r = &EtcdRecordStore{
+		endpoint:  "http://127.0.0.1:2379",
+		namespace: "gloon",
+		client:    &http.Client{Timeout: REQUEST_TIMEOUT},
+		watcher:   &http.Client{},
+		owned:     make(map[string]string),
+		ours:      make(map[int64]bool),
+	}
+	if len(options) >= 1 && options[0] != "" {
+		r.endpoint = strings.TrimSuffix(options[0], "/")
+	}
+	if len(options) >= 2 && options[1] != "" {
+		r.namespace = options[1]
+	}
+	if len(options) >= 3 && options[2] != "" {
+		if r.ttl, err = strconv.ParseInt(options[2], 10, 64); err != nil || r.ttl < 0 {
+			return nil, fmt.Errorf("Invalid lease %q. Expected a number of seconds", options[2])
+		}
+	}
+	if r.ttl > 0 {
+		if err = r.grantLease(); err != nil {
+			return nil, fmt.Errorf("Unable to get an etcd lease: %s", err.Error())
+		}
+		var ctx context.Context
+		ctx, r.cancel = context.WithCancel(context.Background())
+		go r.keepAlive(ctx)
+	}
+	return
+}
+
+// Stop renewing our lease. Values we put expire once it runs out
+func (r *EtcdRecordStore) Close() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// etcd's gateway sends int64 values as strings
+type int64s int64
+
+func (n *int64s) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*n = int64s(v)
+	return err
+}
+
+type keyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64s `json:"mod_revision"`
+	Lease       int64s `json:"lease,omitempty"`
+}
+
+type responseHeader struct {
+	Revision int64s `json:"revision"`
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []keyValue     `json:"kvs"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,omitempty"`
+}
+
+type deleteRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type compare struct {
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	Key         []byte `json:"key"`
+	RangeEnd    []byte `json:"range_end,omitempty"`
+	ModRevision int64  `json:"mod_revision"`
+}
+
+type requestOp struct {
+	Put    *putRequest    `json:"request_put,omitempty"`
+	Delete *deleteRequest `json:"request_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare,omitempty"`
+	Success []requestOp `json:"success"`
+}
+
+// Response to a put, delete or transaction
+type writeResponse struct {
+	Header    responseHeader `json:"header"`
+	Deleted   int64s         `json:"deleted"`   // For deletes
+	Succeeded bool           `json:"succeeded"` // For transactions
+	Responses []struct {
+		Put    *struct{} `json:"response_put"`
+		Delete *struct {
+			Deleted int64s `json:"deleted"`
+		} `json:"response_delete_range"`
+	} `json:"responses"`
+}
+
+// Whether the write made a new revision. etcd doesn't for deletes that found nothing
+func (resp *writeResponse) changed(path string) bool {
+	switch path {
+	case "/v3/kv/put":
+		return true
+	case "/v3/kv/deleterange":
+		return resp.Deleted > 0
+	}
+	if !resp.Succeeded {
+		return false
+	}
+	for _, op := range resp.Responses {
+		if op.Put != nil || (op.Delete != nil && op.Delete.Deleted > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// POST req to a gateway endpoint, decoding the response into resp
+func (r *EtcdRecordStore) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Post(r.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var e struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		if e.Message == "" {
+			e.Message = e.Error
+		}
+		return fmt.Errorf("etcd %s failed: %s %s", path, res.Status, e.Message)
+	}
+	if resp == nil {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Make a change. ops are the puts and deletes it makes, kept track of for republishing
+func (r *EtcdRecordStore) write(path string, req interface{}, ops ...requestOp) (resp writeResponse, err error) {
+	r.writing.RLock()
+	defer r.writing.RUnlock()
+	return r.writeLocked(path, req, ops...)
+}
+
+// write, with r.writing held
+func (r *EtcdRecordStore) writeLocked(path string, req interface{}, ops ...requestOp) (resp writeResponse, err error) {
+	if err = r.call(path, req, &resp); err != nil || !resp.changed(path) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watching > 0 {
+		r.ours[int64(resp.Header.Revision)] = true
+	}
+	for _, op := range ops {
+		if op.Put != nil {
+			if op.Put.Lease != 0 {
+				r.owned[string(op.Put.Key)] = string(op.Put.Value)
+			}
+			continue
+		}
+		for k := range r.owned {
+			if inRange(k, op.Delete.Key, op.Delete.RangeEnd) {
+				delete(r.owned, k)
+			}
+		}
+	}
+	return
+}
+
+// Whether k is key, or in [key, end) if end is set
+func inRange(k string, key, end []byte) bool {
+	if len(end) == 0 {
+		return k == string(key)
+	}
+	return k >= string(key) && k < string(end)
+}
+
+// Prefix of every value of a record
+func (r *EtcdRecordStore) keyPath(dnsType uint16, key string) string {
+	return fmt.Sprintf("/%s/%d/%s/", r.namespace, dnsType, key)
+}
+
+// The end of the range of keys starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+func (r *EtcdRecordStore) get(prefix string) (resp rangeResponse, err error) {
+	err = r.call("/v3/kv/range", map[string][]byte{"key": []byte(prefix), "range_end": prefixEnd(prefix)}, &resp)
+	return
+}
+
+func (r *EtcdRecordStore) metaPath(dnsType uint16, key string) string {
+	return fmt.Sprintf("/%s/meta/%d/%s", r.namespace, dnsType, key)
+}
+
+func (r *EtcdRecordStore) put(dnsType uint16, key, val string) *putRequest {
+	return r.putKey(r.keyPath(dnsType, key)+val, val)
+}
+
+// Everything we put is attached to our lease, if we have one
+func (r *EtcdRecordStore) putKey(k, val string) *putRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &putRequest{Key: []byte(k), Value: []byte(val), Lease: r.lease}
+}
+
+func (r *EtcdRecordStore) PutVal(dnsType uint16, key, val string) error {
+	p := r.put(dnsType, key, val)
+	_, err := r.write("/v3/kv/put", p, requestOp{Put: p})
+	return err
+}
+
+func (r *EtcdRecordStore) GetAll(dnsType uint16, key string) (vals []string, err error) {
+	resp, err := r.get(r.keyPath(dnsType, key))
+	if err != nil {
+		return
+	}
+	vals = []string{}
+	for _, kv := range resp.Kvs {
+		vals = append(vals, string(kv.Value))
+	}
+	return
+}
+
+func (r *EtcdRecordStore) GetMeta(dnsType uint16, key string) (meta string, err error) {
+	var resp rangeResponse
+	if err = r.call("/v3/kv/range", map[string][]byte{"key": []byte(r.metaPath(dnsType, key))}, &resp); err != nil {
+		return
+	}
+	if len(resp.Kvs) > 0 {
+		meta = string(resp.Kvs[0].Value)
+	}
+	return
+}
+
+// The values and metadata go in one transaction
+func (r *EtcdRecordStore) DelKey(dnsType uint16, key string) error {
+	prefix := r.keyPath(dnsType, key)
+	ops := []requestOp{
+		{Delete: &deleteRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix)}},
+		{Delete: &deleteRequest{Key: []byte(r.metaPath(dnsType, key))}},
+	}
+	_, err := r.write("/v3/kv/txn", txnRequest{Success: ops}, ops...)
+	return err
+}
+
+func (r *EtcdRecordStore) DelVal(dnsType uint16, key, val string) error {
+	d := &deleteRequest{Key: []byte(r.keyPath(dnsType, key) + val)}
+	_, err := r.write("/v3/kv/deleterange", d, requestOp{Delete: d})
+	return err
+}
+
+// Apply ops in a single transaction. etcd won't touch a key twice in one transaction, so ops are
+// reduced to the last put or delete of each value. DelKey deletes the whole range under the key,
+// unless the same ops put values back under it, which etcd can't combine with a range delete. Then
+// the values are read first, and the transaction only goes ahead if none of them changed since. A
+// value another writer adds in between is kept, as if it was added just after. Conflicts are
+// retried, with a growing random pause, for up to REQUEST_TIMEOUT
+func (r *EtcdRecordStore) Apply(ops []record_store.StoreOp) (err error) {
+	deadline := time.Now().Add(REQUEST_TIMEOUT)
+	for i := 0; ; i++ {
+		var ok bool
+		if ok, err = r.apply(ops); err != nil || ok {
+			return
+		}
+		pause := time.Millisecond << uint(i)
+		if pause > maxApplyPause {
+			pause = maxApplyPause
+		}
+		pause = time.Duration(rand.Int63n(int64(pause)) + 1)
+		if time.Now().Add(pause).After(deadline) {
+			return fmt.Errorf("Changes kept conflicting with other writers")
+		}
+		time.Sleep(pause)
+	}
+}
+
+func (r *EtcdRecordStore) apply(ops []record_store.StoreOp) (ok bool, err error) {
+	// Records that get values put back after being deleted
+	deleted, reput := make(map[string]bool), make(map[string]bool)
+	for _, op := range ops {
+		prefix := r.keyPath(op.DnsType, op.Key)
+		if op.Type == record_store.StoreDelKey {
+			deleted[prefix] = true
+		} else if op.Type == record_store.StorePut && deleted[prefix] {
+			reput[prefix] = true
+		}
+	}
+	var order []string
+	final := make(map[string]*requestOp)
+	set := func(k string, op *requestOp) {
+		if _, seen := final[k]; !seen {
+			order = append(order, k)
+		}
+		final[k] = op
+	}
+	del := func(k string) *requestOp {
+		return &requestOp{Delete: &deleteRequest{Key: []byte(k)}}
+	}
+	var txn txnRequest
+	ranges := make(map[string]bool) // Records deleted as a whole, with a range delete
+	read := make(map[string]bool)
+	for _, op := range ops {
+		prefix := r.keyPath(op.DnsType, op.Key)
+		switch op.Type {
+		case record_store.StorePut:
+			set(prefix+op.Val, &requestOp{Put: r.put(op.DnsType, op.Key, op.Val)})
+		case record_store.StoreDelVal:
+			set(prefix+op.Val, del(prefix+op.Val))
+		case record_store.StoreDelKey:
+			if !reput[prefix] {
+				set(prefix, &requestOp{Delete: &deleteRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix)}})
+				ranges[prefix] = true
+			} else if !read[prefix] {
+				resp, err := r.get(prefix)
+				if err != nil {
+					return false, err
+				}
+				for _, kv := range resp.Kvs {
+					if _, seen := final[string(kv.Key)]; !seen {
+						set(string(kv.Key), del(string(kv.Key)))
+					}
+					txn.Compare = append(txn.Compare, compare{Target: "MOD", Result: "LESS", Key: kv.Key, ModRevision: int64(resp.Header.Revision) + 1})
+				}
+				read[prefix] = true
+			}
+			for k := range final {
+				if k != prefix && strings.HasPrefix(k, prefix) {
+					final[k] = del(k)
+				}
+			}
+			mk := r.metaPath(op.DnsType, op.Key)
+			set(mk, del(mk))
+		case record_store.StoreSetMeta:
+			mk := r.metaPath(op.DnsType, op.Key)
+			if op.Val == "" {
+				set(mk, del(mk))
+			} else {
+				set(mk, &requestOp{Put: r.putKey(mk, op.Val)})
+			}
+		default:
+			return false, fmt.Errorf("Unknown store operation %d", op.Type)
+		}
+	}
+	for _, k := range order {
+		if !inDeletedRange(ranges, k) {
+			txn.Success = append(txn.Success, *final[k])
+		}
+	}
+	resp, err := r.write("/v3/kv/txn", txn, txn.Success...)
+	if err != nil {
+		return
+	}
+	return resp.Succeeded, nil
+}
+
+// Whether k is a value of a record deleted with a range delete. Those are deletes as well, since
+// nothing is put back under such a record
+func inDeletedRange(ranges map[string]bool, k string) bool {
+	for prefix := range ranges {
+		if k != prefix && strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *EtcdRecordStore) All() (records []record_store.StoreRecord, err error) {
+	prefix := fmt.Sprintf("/%s/", r.namespace)
+	resp, err := r.get(prefix)
+	if err != nil {
+		return
+	}
+	index := make(map[record_store.StoreKey]int)
+	metas := make(map[record_store.StoreKey]string)
+	for _, kv := range resp.Kvs {
+		parts := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "meta" {
+			if dnsType, key, ok := record_store.SplitKeyPath(parts[1] + "/" + parts[2]); ok {
+				metas[record_store.StoreKey{DnsType: dnsType, Key: key}] = string(kv.Value)
+			}
+			continue
+		}
+		dnsType, key, ok := record_store.SplitKeyPath(parts[0] + "/" + parts[1])
+		if !ok {
+			continue
+		}
+		sk := record_store.StoreKey{DnsType: dnsType, Key: key}
+		i, seen := index[sk]
+		if !seen {
+			i = len(records)
+			index[sk] = i
+			records = append(records, record_store.StoreRecord{DnsType: dnsType, Key: key})
+		}
+		records[i].Vals = append(records[i].Vals, string(kv.Value))
+	}
+	for i, rec := range records {
+		records[i].Meta = metas[record_store.StoreKey{DnsType: rec.DnsType, Key: rec.Key}]
+	}
+	return
+}
+
+func (r *EtcdRecordStore) Clear() error {
+	prefix := fmt.Sprintf("/%s/", r.namespace)
+	d := &deleteRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix)}
+	_, err := r.write("/v3/kv/deleterange", d, requestOp{Delete: d})
+	return err
+}
+
+func (r *EtcdRecordStore) grantLease() error {
+	var resp struct {
+		ID int64s `json:"ID"`
+	}
+	if err := r.call("/v3/lease/grant", map[string]int64{"TTL": r.ttl}, &resp); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.lease = int64(resp.ID)
+	r.mu.Unlock()
+	return nil
+}
+
+// Renew our lease at a third of its TTL. If it expired anyway (ex. etcd was unreachable for too
+// long) the values put with it are gone: we get a new lease and put them again
+func (r *EtcdRecordStore) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.ttl) * time.Second / 3)
+	defer ticker.Stop()
+	republish := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if republish {
+			// Retried every tick until it works
+			republish = !r.republish()
+			continue
+		}
+		r.mu.Lock()
+		lease := r.lease
+		r.mu.Unlock()
+		var resp struct {
+			Result struct {
+				TTL int64s `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := r.call("/v3/lease/keepalive", map[string]int64{"ID": lease}, &resp); err != nil {
+			log.Printf("WARNING: unable to renew etcd lease: %s", err.Error())
+			continue
+		}
+		if resp.Result.TTL <= 0 {
+			log.Printf("WARNING: etcd lease expired. Publishing our records again")
+			republish = !r.republish()
+		}
+	}
+}
+
+// Get a new lease and put every value we own again with it. Other writes wait until we are done.
+// Returns false if it has to be tried again
+func (r *EtcdRecordStore) republish() bool {
+	r.writing.Lock()
+	defer r.writing.Unlock()
+	if err := r.grantLease(); err != nil {
+		log.Printf("ERROR: unable to get a new etcd lease: %s. Our records are missing from etcd", err.Error())
+		return false
+	}
+	r.mu.Lock()
+	var ops []requestOp
+	for k, v := range r.owned {
+		ops = append(ops, requestOp{Put: &putRequest{Key: []byte(k), Value: []byte(v), Lease: r.lease}})
+	}
+	r.mu.Unlock()
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if _, err := r.writeLocked("/v3/kv/txn", txnRequest{Success: ops[:n]}, ops[:n]...); err != nil {
+			log.Printf("ERROR: unable to publish our records again: %s. Some are missing from etcd", err.Error())
+			return false
+		}
+		ops = ops[n:]
+	}
+	log.Printf("Records published again")
+	return true
+}
+
+// Other instances see our changes by watching the records, so there is nothing to send
+func (r *EtcdRecordStore) Notify(n record_set.StoreNotice) error {
+	return nil
+}
+
+// Delays between attempts to watch for change notices
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+// Pass changes made by others, gloon instances or not, to fn until ctx is done. If the watch is
+// lost, it is started again, with a Reset notice since some changes may have been missed
+func (r *EtcdRecordStore) Watch(ctx context.Context, fn func(record_set.StoreNotice)) error {
+	delay := watchRetryMin
+	watching := false
+	for {
+		err := r.watch(ctx, func() {
+			if watching {
+				log.Printf("Watching etcd records again")
+				fn(record_set.StoreNotice{Reset: true})
+			}
+			watching = true
+			delay = watchRetryMin
+		}, fn)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Lost etcd watch: %s. Retrying in %v", err, delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > watchRetryMax {
+			delay = watchRetryMax
+		}
+	}
+}
+
+// A change to a key, as seen by a watch
+type watchEvent struct {
+	Type   string   `json:"type"` // "DELETE", or empty for a put
+	Kv     keyValue `json:"kv"`
+	PrevKv keyValue `json:"prev_kv"`
+}
+
+func (r *EtcdRecordStore) watch(ctx context.Context, created func(), fn func(record_set.StoreNotice)) error {
+	prefix := fmt.Sprintf("/%s/", r.namespace)
+	body, _ := json.Marshal(map[string]interface{}{"create_request": map[string]interface{}{
+		"key": []byte(prefix), "range_end": prefixEnd(prefix), "prev_kv": true,
+	}})
+	req, err := http.NewRequest("POST", r.endpoint+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// Our writes are recorded from before the watch starts, so none slip through
+	r.mu.Lock()
+	r.watching++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.watching--; r.watching == 0 {
+			r.ours = make(map[int64]bool)
+		}
+	}()
+	res, err := r.watcher.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("etcd watch failed: %s", res.Status)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Created  bool         `json:"created"`
+				Canceled bool         `json:"canceled"`
+				Events   []watchEvent `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%s", msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("watch canceled")
+		}
+		if msg.Result.Created {
+			created()
+		}
+		if n := r.notice(prefix, msg.Result.Events); len(n.Keys) > 0 {
+			fn(n)
+		}
+	}
+}
+
+// Keys and events for the changes others made, skipping our own
+func (r *EtcdRecordStore) notice(prefix string, events []watchEvent) (n record_set.StoreNotice) {
+	if len(events) == 0 {
+		return
+	}
+	// Wait for writes in flight to record their revisions
+	r.writing.Lock()
+	defer r.writing.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ev := range events {
+		rev := int64(ev.Kv.ModRevision)
+		if r.ours[rev] {
+			continue
+		}
+		// Someone else changed the key, so it's no longer ours to put again
+		delete(r.owned, string(ev.Kv.Key))
+		parts := strings.SplitN(strings.TrimPrefix(string(ev.Kv.Key), prefix), "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "meta" {
+			dnsType, key, ok := record_store.SplitKeyPath(parts[1] + "/" + parts[2])
+			if !ok {
+				continue
+			}
+			n.Keys = append(n.Keys, record_store.StoreKey{DnsType: dnsType, Key: key})
+			was, now := record_set.ParseMeta(string(ev.PrevKv.Value)).Ttl, record_set.ParseMeta(string(ev.Kv.Value)).Ttl
+			if ev.Type == "DELETE" {
+				now = nil
+			}
+			if !record_set.SameTtl(was, now) {
+				n.Events = append(n.Events, record_set.Event{Op: record_set.EventTtl, DnsType: dnsType, Host: strings.TrimSuffix(key, "."), Val: ttlVal(now)})
+			}
+			continue
+		}
+		dnsType, key, ok := record_store.SplitKeyPath(parts[0] + "/" + parts[1])
+		if !ok {
+			continue
+		}
+		n.Keys = append(n.Keys, record_store.StoreKey{DnsType: dnsType, Key: key})
+		op := record_set.EventPut
+		if ev.Type == "DELETE" {
+			op = record_set.EventDel
+		} else if len(ev.PrevKv.Key) > 0 {
+			continue // Put again, with the same value
+		}
+		n.Events = append(n.Events, record_set.Event{Op: op, DnsType: dnsType, Host: strings.TrimSuffix(key, "."), Val: parts[2]})
+	}
+	// Events come in revision order, so older revisions of ours won't be seen again. The last one
+	// may have more events to come
+	last := int64(events[len(events)-1].Kv.ModRevision)
+	for rev := range r.ours {
+		if rev < last {
+			delete(r.ours, rev)
+		}
+	}
+	return
+}
+
+// Event value for a TTL change, as record_set gives it
+func ttlVal(ttl *uint32) string {
+	if ttl == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*ttl), 10)
+}
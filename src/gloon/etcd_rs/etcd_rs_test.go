@@ -0,0 +1,424 @@
+package etcd_rs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gloon/record_set"
+	"gloon/record_store"
+	"gloon/rstest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Enough of etcd's JSON gateway to run the store against. This is not etcd: set GLOON_TEST_ETCD to
+// also run the tests against a real one
+type fakeEtcd struct {
+	sync.Mutex
+	rev      int64
+	kvs      map[string]keyValue
+	leases   map[int64]bool
+	watchers []chan watchEvent
+}
+
+func newFakeEtcd() *httptest.Server {
+	fe := &fakeEtcd{kvs: make(map[string]keyValue), leases: make(map[int64]bool)}
+	return httptest.NewServer(fe)
+}
+
+// Changes made by one request share a revision, as in etcd
+func (fe *fakeEtcd) put(p putRequest) {
+	kv := keyValue{Key: p.Key, Value: p.Value, ModRevision: int64s(fe.rev), Lease: int64s(p.Lease)}
+	prev := fe.kvs[string(p.Key)]
+	fe.kvs[string(p.Key)] = kv
+	fe.notify(watchEvent{Kv: kv, PrevKv: prev})
+}
+
+// Keys are deleted in order, as in etcd
+func (fe *fakeEtcd) del(d deleteRequest) (deleted int64) {
+	var keys []string
+	for k := range fe.kvs {
+		if inRange(k, d.Key, d.RangeEnd) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kv := fe.kvs[k]
+		delete(fe.kvs, k)
+		fe.notify(watchEvent{Type: "DELETE", Kv: keyValue{Key: kv.Key, ModRevision: int64s(fe.rev)}, PrevKv: kv})
+	}
+	return int64(len(keys))
+}
+
+func (fe *fakeEtcd) notify(ev watchEvent) {
+	for _, w := range fe.watchers {
+		w <- ev
+	}
+}
+
+// Drop a lease and the keys attached to it, as etcd does once it runs out
+func (fe *fakeEtcd) expire(lease int64) {
+	fe.rev++
+	delete(fe.leases, lease)
+	for k, kv := range fe.kvs {
+		if int64(kv.Lease) == lease {
+			fe.del(deleteRequest{Key: []byte(k)})
+		}
+	}
+}
+
+func (fe *fakeEtcd) header() map[string]string {
+	return map[string]string{"revision": itoa(fe.rev)}
+}
+
+func (fe *fakeEtcd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	dec := json.NewDecoder(req.Body)
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	if req.URL.Path == "/v3/watch" {
+		fe.watch(w, req)
+		return
+	}
+	fe.Lock()
+	defer fe.Unlock()
+	leaseMissing := func(p *putRequest) bool {
+		if p.Lease != 0 && !fe.leases[p.Lease] {
+			w.WriteHeader(400)
+			reply(map[string]string{"message": "etcdserver: requested lease not found"})
+			return true
+		}
+		return false
+	}
+	switch req.URL.Path {
+	case "/v3/kv/range":
+		var r deleteRequest
+		dec.Decode(&r)
+		var kvs []keyValue
+		for k, kv := range fe.kvs {
+			if inRange(k, r.Key, r.RangeEnd) {
+				kvs = append(kvs, kv)
+			}
+		}
+		sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+		reply(map[string]interface{}{"header": fe.header(), "kvs": kvs})
+	case "/v3/kv/put":
+		var p putRequest
+		dec.Decode(&p)
+		if leaseMissing(&p) {
+			return
+		}
+		fe.rev++
+		fe.put(p)
+		reply(map[string]interface{}{"header": fe.header()})
+	case "/v3/kv/deleterange":
+		var d deleteRequest
+		dec.Decode(&d)
+		fe.rev++
+		deleted := fe.del(d)
+		if deleted == 0 {
+			fe.rev--
+		}
+		reply(map[string]interface{}{"header": fe.header(), "deleted": itoa(deleted)})
+	case "/v3/kv/txn":
+		var txn txnRequest
+		dec.Decode(&txn)
+		for _, c := range txn.Compare {
+			for k, kv := range fe.kvs {
+				if inRange(k, c.Key, c.RangeEnd) && int64(kv.ModRevision) >= c.ModRevision {
+					reply(map[string]interface{}{"header": fe.header(), "succeeded": false})
+					return
+				}
+			}
+		}
+		seen := make(map[string]bool)
+		for _, op := range txn.Success {
+			k := ""
+			if op.Put != nil {
+				k = string(op.Put.Key)
+				if leaseMissing(op.Put) {
+					return
+				}
+			} else {
+				k = string(op.Delete.Key)
+			}
+			// Like etcd, a put can't fall in a range deleted by the same transaction either
+			for _, other := range txn.Success {
+				if op.Put != nil && other.Delete != nil && len(other.Delete.RangeEnd) > 0 && inRange(k, other.Delete.Key, other.Delete.RangeEnd) {
+					seen[k] = true
+				}
+			}
+			if seen[k] {
+				w.WriteHeader(400)
+				reply(map[string]string{"message": "etcdserver: duplicate key given in txn request"})
+				return
+			}
+			seen[k] = true
+		}
+		fe.rev++
+		changed := false
+		var responses []map[string]interface{}
+		for _, op := range txn.Success {
+			if op.Put != nil {
+				fe.put(*op.Put)
+				changed = true
+				responses = append(responses, map[string]interface{}{"response_put": map[string]interface{}{}})
+			} else {
+				deleted := fe.del(*op.Delete)
+				changed = changed || deleted > 0
+				responses = append(responses, map[string]interface{}{"response_delete_range": map[string]string{"deleted": itoa(deleted)}})
+			}
+		}
+		if !changed {
+			fe.rev--
+		}
+		reply(map[string]interface{}{"header": fe.header(), "succeeded": true, "responses": responses})
+	case "/v3/lease/grant":
+		fe.rev++
+		fe.leases[fe.rev] = true
+		reply(map[string]string{"ID": itoa(fe.rev), "TTL": "30"})
+	case "/v3/lease/revoke":
+		var r struct {
+			ID int64s
+		}
+		dec.Decode(&r)
+		fe.expire(int64(r.ID))
+		reply(map[string]interface{}{"header": fe.header()})
+	case "/v3/lease/keepalive":
+		var r struct {
+			ID int64
+		}
+		dec.Decode(&r)
+		ttl := "30"
+		if !fe.leases[r.ID] {
+			ttl = "0"
+		}
+		reply(map[string]interface{}{"result": map[string]string{"TTL": ttl}})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (fe *fakeEtcd) watch(w http.ResponseWriter, req *http.Request) {
+	var r struct {
+		Create deleteRequest `json:"create_request"`
+	}
+	json.NewDecoder(req.Body).Decode(&r)
+	c := make(chan watchEvent, 1000)
+	fe.Lock()
+	fe.watchers = append(fe.watchers, c)
+	fe.Unlock()
+	defer func() {
+		fe.Lock()
+		defer fe.Unlock()
+		for i, wc := range fe.watchers {
+			if wc == c {
+				fe.watchers = append(fe.watchers[:i], fe.watchers[i+1:]...)
+				break
+			}
+		}
+	}()
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{"result": map[string]bool{"created": true}})
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case ev := <-c:
+			if inRange(string(ev.Kv.Key), r.Create.Key, r.Create.RangeEnd) {
+				enc.Encode(map[string]interface{}{"result": map[string]interface{}{"events": []watchEvent{ev}}})
+				w.(http.Flusher).Flush()
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func itoa(n int64) string {
+	return strings.TrimSpace(string(mustJson(n)))
+}
+
+func mustJson(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func createStore(t *testing.T, url, opts string) *EtcdRecordStore {
+	r, err := Create(url + opts)
+	if err != nil {
+		t.Fatal("Create()", err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+// Endpoints to run the tests against. Set GLOON_TEST_ETCD to the URL of an etcd endpoint to test
+// against it as well. Namespaces starting with "gloon-test" are cleared
+func endpoints(t *testing.T) map[string]string {
+	srv := newFakeEtcd()
+	t.Cleanup(srv.Close)
+	urls := map[string]string{"fake": srv.URL}
+	if real := os.Getenv("GLOON_TEST_ETCD"); real != "" {
+		urls["GLOON_TEST_ETCD"] = real
+	}
+	return urls
+}
+
+func TestConformance(t *testing.T) {
+	for name, url := range endpoints(t) {
+		url := url
+		t.Run(name, func(t *testing.T) {
+			rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+				return createStore(t, url, ",gloon-test-"+namespace+",30")
+			})
+		})
+	}
+}
+
+// Put a key the way something other than gloon would
+func rawPut(t *testing.T, url, key, val string) {
+	res, err := http.Post(url+"/v3/kv/put", "application/json", bytes.NewReader(mustJson(putRequest{Key: []byte(key), Value: []byte(val)})))
+	if err != nil {
+		t.Fatal("put", err)
+	}
+	res.Body.Close()
+}
+
+// Read notices until they add up to the expected events, all for key. etcd may split the events
+// of one change over several notices
+func expectEvents(t *testing.T, notices chan record_set.StoreNotice, key string, events ...string) {
+	var got []string
+	for len(got) < len(events) {
+		var n record_set.StoreNotice
+		select {
+		case n = <-notices:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got events %q -- expected %q", got, events)
+		}
+		for _, k := range n.Keys {
+			if k.Key != key {
+				t.Errorf("Got notice for %v -- expected %s", n.Keys, key)
+			}
+		}
+		for _, ev := range n.Events {
+			got = append(got, fmt.Sprintf("%s %d %s %s", ev.Op, ev.DnsType, ev.Host, ev.Val))
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(events)
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("Got events %q -- expected %q", got, events)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for name, url := range endpoints(t) {
+		url := url
+		t.Run(name, func(t *testing.T) {
+			r1 := createStore(t, url, ",gloon-test-watch")
+			r2 := createStore(t, url, ",gloon-test-watch")
+			r1.Clear()
+			defer r1.Clear()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			notices := make(chan record_set.StoreNotice, 100)
+			own := make(chan record_set.StoreNotice, 100)
+			go r2.Watch(ctx, func(n record_set.StoreNotice) { notices <- n })
+			go r1.Watch(ctx, func(n record_set.StoreNotice) { own <- n })
+
+			// Keep changing things until both watches are up
+			for i := 0; ; i++ {
+				if i == 50 {
+					t.Fatal("No notice received")
+				}
+				rawPut(t, url, "/gloon-test-watch/1/up./"+itoa(int64(i)), "x")
+				time.Sleep(100 * time.Millisecond)
+				if len(notices) > 0 && len(own) > 0 {
+					break
+				}
+			}
+			drain := func(c chan record_set.StoreNotice) {
+				for len(c) > 0 {
+					<-c
+				}
+			}
+			drain(notices)
+			drain(own)
+
+			r1.PutVal(1, "foo.bar.", "127.0.0.1")
+			expectEvents(t, notices, "foo.bar.", "put 1 foo.bar 127.0.0.1")
+			r1.Apply([]record_store.StoreOp{
+				{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.2"},
+				{Type: record_store.StoreSetMeta, DnsType: 1, Key: "foo.bar.", Val: `{"ttl":60}`},
+			})
+			expectEvents(t, notices, "foo.bar.", "put 1 foo.bar 127.0.0.2", "ttl 1 foo.bar 60")
+			r1.DelKey(1, "foo.bar.")
+			expectEvents(t, notices, "foo.bar.", "del 1 foo.bar 127.0.0.1", "del 1 foo.bar 127.0.0.2", "ttl 1 foo.bar ")
+
+			// Changes made directly in etcd are seen too. Each instance sees the ones it didn't make
+			rawPut(t, url, "/gloon-test-watch/16/direct.bar./hello", "hello")
+			expectEvents(t, notices, "direct.bar.", "put 16 direct.bar hello")
+			expectEvents(t, own, "direct.bar.", "put 16 direct.bar hello")
+			select {
+			case n := <-own:
+				t.Errorf("Got notice %v after our own change", n)
+			default:
+			}
+		})
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	for name, url := range endpoints(t) {
+		url := url
+		t.Run(name, func(t *testing.T) {
+			testLeaseExpiry(t, url)
+		})
+	}
+}
+
+func testLeaseExpiry(t *testing.T, url string) {
+	r := createStore(t, url, ",gloon-test-lease,1")
+	r.Clear()
+	defer r.Clear()
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	r.PutVal(1, "foo.bar.", "127.0.0.2")
+	r.Apply([]record_store.StoreOp{{Type: record_store.StoreSetMeta, DnsType: 1, Key: "foo.bar.", Val: `{"ttl":60}`}})
+	r.DelVal(1, "foo.bar.", "127.0.0.2")
+
+	// Revoking the lease drops its keys, as if it ran out
+	r.mu.Lock()
+	lease := r.lease
+	r.mu.Unlock()
+	if err := r.call("/v3/lease/revoke", map[string]int64{"ID": lease}, nil); err != nil {
+		t.Fatal("revoke", err)
+	}
+	if vals, _ := r.GetAll(1, "foo.bar."); len(vals) != 0 {
+		t.Fatalf("Got %v after the lease expired -- expected nothing", vals)
+	}
+	// What we put is put again with a new lease
+	for i := 0; i < 50; i++ {
+		vals, _ := r.GetAll(1, "foo.bar.")
+		meta, _ := r.GetMeta(1, "foo.bar.")
+		if len(vals) > 0 && meta != "" {
+			if !reflect.DeepEqual(vals, []string{"127.0.0.1"}) || meta != `{"ttl":60}` {
+				t.Errorf("Got %v, %q after republishing -- expected [127.0.0.1], the TTL", vals, meta)
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.lease == lease {
+				t.Error("Lease wasn't replaced")
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("Records weren't published again")
+}
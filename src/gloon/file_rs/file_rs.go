@@ -0,0 +1,325 @@
+package file_rs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gloon/mem_rs"
+	"gloon/record_store"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Used when no file is given in the store options
+const DEFAULT_FILE = "/var/lib/gloon/records.db"
+
+// First line of every journal
+const journalHeader = "# gloon records v1"
+
+// The journal is compacted once it has this many more entries than it had after the last compaction,
+// and at least twice as many
+const COMPACT_MIN = 1000
+
+// A RecordStore kept in memory, and persisted to an append-only journal. Each change is one line of
+// JSON, written and synced before the change is made in memory, so a change is either on disk or
+// was never made. A line cut short by a crash is dropped on the next start. The journal is rewritten
+// with only the current records as it grows
+type FileRecordStore struct {
+	sync.Mutex // Serializes writes. Reads only need the memory store
+	mem        *mem_rs.MemRecordStore
+	fn         string
+	f          *os.File
+	entries    int // Lines in the journal
+	compacted  int // Lines after the last compaction
+}
+
+// A StoreOp as written to the journal
+type journalOp struct {
+	Op   string `json:"op"`
+	Type uint16 `json:"type"`
+	Key  string `json:"key"`
+	Val  string `json:"val,omitempty"`
+}
+
+var opNames = map[record_store.StoreOpType]string{
+	record_store.StorePut:     "put",
+	record_store.StoreDelVal:  "delval",
+	record_store.StoreDelKey:  "delkey",
+	record_store.StoreSetMeta: "meta",
+}
+
+// Open the journal named by opts, creating it if needed
+func Create(opts string) (r *FileRecordStore, err error) {
+	fn := strings.TrimSpace(opts)
+	if fn == "" {
+		fn = DEFAULT_FILE
+	}
+	r = &FileRecordStore{mem: mem_rs.Create(), fn: fn}
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+	if r.f, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d journal entries from %s", r.entries, fn)
+	return
+}
+
+// Replay the journal into memory
+func (r *FileRecordStore) load() (err error) {
+	f, err := os.OpenFile(r.fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var good int64 // Offset just past the last complete entry
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				log.Printf("WARNING: dropping incomplete last entry of %s", r.fn)
+				return r.truncate(f, good)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			if strings.TrimSpace(line) != journalHeader {
+				return fmt.Errorf("%s is not a gloon record journal, or is from a newer version", r.fn)
+			}
+			good += int64(len(line))
+			continue
+		}
+		var ops []record_store.StoreOp
+		if ops, err = decodeOps(line); err != nil {
+			// Only the last entry can be cut short by a crash
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				log.Printf("WARNING: dropping invalid last entry of %s: %s", r.fn, err.Error())
+				return r.truncate(f, good)
+			}
+			return fmt.Errorf("%s:%d: %s", r.fn, n, err.Error())
+		}
+		if err = r.mem.Apply(ops); err != nil {
+			return fmt.Errorf("%s:%d: %s", r.fn, n, err.Error())
+		}
+		good += int64(len(line))
+		r.entries++
+	}
+	if good == 0 {
+		return r.compact()
+	}
+	r.compacted = r.entries
+	return
+}
+
+func (r *FileRecordStore) truncate(f *os.File, size int64) (err error) {
+	if err = f.Truncate(size); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if size == 0 {
+		return r.compact()
+	}
+	r.compacted = r.entries
+	return
+}
+
+func decodeOps(line string) (ops []record_store.StoreOp, err error) {
+	var entry []journalOp
+	if err = json.Unmarshal([]byte(line), &entry); err != nil {
+		return
+	}
+	for _, jo := range entry {
+		op := record_store.StoreOp{DnsType: jo.Type, Key: jo.Key, Val: jo.Val}
+		found := false
+		for t, name := range opNames {
+			if name == jo.Op {
+				op.Type, found = t, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown operation %q", jo.Op)
+		}
+		ops = append(ops, op)
+	}
+	return
+}
+
+func encodeOps(ops []record_store.StoreOp) ([]byte, error) {
+	entry := make([]journalOp, len(ops))
+	for i, op := range ops {
+		name, ok := opNames[op.Type]
+		if !ok {
+			return nil, fmt.Errorf("Unknown store operation %d", op.Type)
+		}
+		entry[i] = journalOp{name, op.DnsType, op.Key, op.Val}
+	}
+	data, err := json.Marshal(entry)
+	return append(data, '\n'), err
+}
+
+// Write ops to the journal, then make them in memory
+func (r *FileRecordStore) apply(ops []record_store.StoreOp) (err error) {
+	data, err := encodeOps(ops)
+	if err != nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.f == nil {
+		return fmt.Errorf("%s is closed", r.fn)
+	}
+	fi, err := r.f.Stat()
+	if err != nil {
+		return
+	}
+	if _, err = r.f.Write(data); err == nil {
+		err = r.f.Sync()
+	}
+	if err != nil {
+		// Don't leave part of an entry behind for the next one to be appended to
+		r.f.Truncate(fi.Size())
+		return
+	}
+	r.entries++
+	if err = r.mem.Apply(ops); err != nil {
+		return
+	}
+	if r.entries >= 2*r.compacted && r.entries-r.compacted >= COMPACT_MIN {
+		if err := r.compact(); err != nil {
+			// The journal is still good, just longer than it needs to be
+			log.Printf("WARNING: unable to compact %s: %s", r.fn, err.Error())
+		}
+	}
+	return
+}
+
+// Rewrite the journal with one entry for the current records. Metadata of keys that have no values
+// left is dropped
+func (r *FileRecordStore) compact() (err error) {
+	records, err := r.mem.All()
+	if err != nil {
+		return
+	}
+	var ops []record_store.StoreOp
+	for _, rec := range records {
+		for _, v := range rec.Vals {
+			ops = append(ops, record_store.StoreOp{Type: record_store.StorePut, DnsType: rec.DnsType, Key: rec.Key, Val: v})
+		}
+	}
+	// All() only lists keys with values. Metadata can outlive them (ex. a TTL set before any value)
+	for k, meta := range r.mem.AllMeta() {
+		ops = append(ops, record_store.StoreOp{Type: record_store.StoreSetMeta, DnsType: k.DnsType, Key: k.Key, Val: meta})
+	}
+	return r.rewrite(ops)
+}
+
+// Replace the journal with one holding ops. The new journal is written and synced under a temporary
+// name, and then renamed over the old one
+func (r *FileRecordStore) rewrite(ops []record_store.StoreOp) (err error) {
+	tmp := r.fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, journalHeader)
+	entries := 0
+	if len(ops) > 0 {
+		data, err := encodeOps(ops)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		entries = 1
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmp, r.fn); err != nil {
+		return
+	}
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(r.fn)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if r.f != nil {
+		r.f.Close()
+		if r.f, err = os.OpenFile(r.fn, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return
+		}
+	}
+	r.entries, r.compacted = entries, entries
+	return
+}
+
+func (r *FileRecordStore) PutVal(dnsType uint16, key, val string) error {
+	return r.apply([]record_store.StoreOp{{Type: record_store.StorePut, DnsType: dnsType, Key: key, Val: val}})
+}
+
+func (r *FileRecordStore) DelKey(dnsType uint16, key string) error {
+	return r.apply([]record_store.StoreOp{{Type: record_store.StoreDelKey, DnsType: dnsType, Key: key}})
+}
+
+func (r *FileRecordStore) DelVal(dnsType uint16, key, val string) error {
+	return r.apply([]record_store.StoreOp{{Type: record_store.StoreDelVal, DnsType: dnsType, Key: key, Val: val}})
+}
+
+// All ops are written as a single journal entry, so a crash keeps all or none of them
+func (r *FileRecordStore) Apply(ops []record_store.StoreOp) error {
+	return r.apply(ops)
+}
+
+func (r *FileRecordStore) GetAll(dnsType uint16, key string) ([]string, error) {
+	return r.mem.GetAll(dnsType, key)
+}
+
+func (r *FileRecordStore) GetMeta(dnsType uint16, key string) (string, error) {
+	return r.mem.GetMeta(dnsType, key)
+}
+
+func (r *FileRecordStore) All() ([]record_store.StoreRecord, error) {
+	return r.mem.All()
+}
+
+// Remove every record, leaving an empty journal
+func (r *FileRecordStore) Clear() (err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.f == nil {
+		return fmt.Errorf("%s is closed", r.fn)
+	}
+	if err = r.rewrite(nil); err != nil {
+		return
+	}
+	return r.mem.Clear()
+}
+
+// Close the journal. Changes fail afterwards
+func (r *FileRecordStore) Close() (err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package file_rs
+
+import (
+	"gloon/record_set"
+	"gloon/record_store"
+	"gloon/rstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempJournal(t *testing.T) (fn string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gloon-file-rs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "records.db"), func() { os.RemoveAll(dir) }
+}
+
+func createStore(t *testing.T, fn string) *FileRecordStore {
+	r, err := Create(fn)
+	if err != nil {
+		t.Fatal("Create()", err)
+	}
+	return r
+}
+
+func expectVals(t *testing.T, r *FileRecordStore, key string, n int) {
+	vals, err := r.GetAll(1, key)
+	if err != nil || len(vals) != n {
+		t.Errorf("Got %v, %v for %s -- expected %d values", vals, err, key, n)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+		r := createStore(t, filepath.Join(t.TempDir(), namespace+".db"))
+		t.Cleanup(func() { r.Close() })
+		return r
+	})
+}
+
+func TestApply(t *testing.T) {
+	fn, cleanup := tempJournal(t)
+	defer cleanup()
+	r := createStore(t, fn)
+	r.PutVal(1, "foo.bar", "127.0.0.1")
+	err := r.Apply([]record_store.StoreOp{
+		{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar", Val: "127.0.0.2"},
+		{Type: record_store.StoreDelVal, DnsType: 1, Key: "foo.bar", Val: "127.0.0.1"},
+		{Type: record_store.StorePut, DnsType: 1, Key: "baz.bar", Val: "127.0.0.3"},
+	})
+	if err != nil {
+		t.Error("r.Apply()", err)
+	}
+	// Nothing is applied or written if any op is invalid
+	err = r.Apply([]record_store.StoreOp{
+		{Type: record_store.StoreDelKey, DnsType: 1, Key: "baz.bar"},
+		{Type: 42, DnsType: 1, Key: "foo.bar"},
+	})
+	if err == nil {
+		t.Error("r.Apply() with an invalid op did not fail")
+	}
+	r.Close()
+
+	r = createStore(t, fn)
+	defer r.Close()
+	if vals, _ := r.GetAll(1, "foo.bar"); len(vals) != 1 || vals[0] != "127.0.0.2" {
+		t.Errorf("Got values %v after reopening -- expected [127.0.0.2]", vals)
+	}
+	expectVals(t, r, "baz.bar", 1)
+}
+
+func TestCrashedWrite(t *testing.T) {
+	fn, cleanup := tempJournal(t)
+	defer cleanup()
+	r := createStore(t, fn)
+	r.PutVal(1, "foo.bar", "127.0.0.1")
+	r.Close()
+	// A crash part way through the next entry
+	f, _ := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`[{"op":"put","type":1,"key":"baz.bar","val":"127.0`)
+	f.Close()
+
+	r = createStore(t, fn)
+	expectVals(t, r, "foo.bar", 1)
+	expectVals(t, r, "baz.bar", 0)
+	r.PutVal(1, "baz.bar", "127.0.0.2")
+	r.Close()
+	r = createStore(t, fn)
+	defer r.Close()
+	expectVals(t, r, "baz.bar", 1)
+}
+
+func TestCorruptJournal(t *testing.T) {
+	fn, cleanup := tempJournal(t)
+	defer cleanup()
+	ioutil.WriteFile(fn, []byte("127.0.0.1 localhost\n"), 0600)
+	if _, err := Create(fn); err == nil {
+		t.Error("Create() accepted a file that isn't a journal")
+	}
+	ioutil.WriteFile(fn, []byte(journalHeader+"\nbogus\n[]\n"), 0600)
+	if _, err := Create(fn); err == nil {
+		t.Error("Create() accepted a journal with an invalid entry")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	fn, cleanup := tempJournal(t)
+	defer cleanup()
+	r := createStore(t, fn)
+	// Metadata of a key without values has to survive compaction too
+	r.Apply([]record_store.StoreOp{{Type: record_store.StoreSetMeta, DnsType: 1, Key: "ttl.bar", Val: `{"ttl":30}`}})
+	for i := 0; i < COMPACT_MIN; i++ {
+		r.PutVal(1, "foo.bar", "127.0.0.1")
+		r.DelKey(1, "foo.bar")
+	}
+	r.PutVal(1, "baz.bar", "127.0.0.2")
+	r.Close()
+	data, _ := ioutil.ReadFile(fn)
+	if lines := strings.Count(string(data), "\n"); lines > COMPACT_MIN {
+		t.Errorf("Journal has %d lines -- expected it to be compacted", lines)
+	}
+	r = createStore(t, fn)
+	defer r.Close()
+	expectVals(t, r, "foo.bar", 0)
+	expectVals(t, r, "baz.bar", 1)
+	if meta, err := r.GetMeta(1, "ttl.bar"); err != nil || meta != `{"ttl":30}` {
+		t.Errorf("Got metadata %q, %v for ttl.bar after compaction", meta, err)
+	}
+
+	r.Clear()
+	r.Close()
+	r = createStore(t, fn)
+	defer r.Close()
+	expectVals(t, r, "baz.bar", 0)
+}
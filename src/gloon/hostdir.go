@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+)
+
+// Extension of hostfiles loaded from a hostfile directory
+const HOSTDIR_EXT = ".hosts"
+
+// A directory of hostfiles (conf.d style). Every *.hosts file in it is loaded, and files
+// are tracked as they are added, changed, renamed or removed. Removing a file removes the records
+// only it listed
+type HostDir struct {
+	dir            string
+	refs           *HostRefs
+	reloadInterval int
+	files          map[string]*Hostfile // Loaded hostfiles, keyed by absolute path
+}
+
+func NewHostDir(dir string, refs *HostRefs, reloadInterval int) (hd *HostDir) {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	hd = &HostDir{dir, refs, reloadInterval, make(map[string]*Hostfile)}
+	return
+}
+
+// Load and watch the directory until ctx is cancelled
+func (hd *HostDir) Run(ctx context.Context) {
+	fw := &FileWatcher{
+		name:           "hostfile directory " + hd.dir,
+		paths:          hd.paths,
+		reloadInterval: hd.reloadInterval,
+		reload:         hd.scan,
+	}
+	fw.Run(ctx)
+}
+
+// The directory, plus loaded files, since they may be symlinks to files elsewhere
+func (hd *HostDir) paths() []string {
+	paths := []string{hd.dir}
+	for fn := range hd.files {
+		paths = append(paths, fn)
+	}
+	return paths
+}
+
+// Remove the records of every loaded file
+func (hd *HostDir) clear() {
+	for fn, hf := range hd.files {
+		hf.clear()
+		delete(hd.files, fn)
+	}
+}
+
+// Sync loaded files with the directory contents
+func (hd *HostDir) scan() {
+	fns, err := filepath.Glob(filepath.Join(hd.dir, "*"+HOSTDIR_EXT))
+	if err != nil {
+		log.Printf("Unable to list hostfile directory %s: %s", hd.dir, err.Error())
+		return
+	}
+	present := make(map[string]bool)
+	for _, fn := range fns {
+		present[fn] = true
+		hf, ok := hd.files[fn]
+		if !ok {
+			log.Printf("Loading hostfile: %s", fn)
+			hf = NewHostfile(fn, hd.refs, hd.reloadInterval)
+			hd.files[fn] = hf
+		}
+		if err := hf.loadHosts(); err != nil {
+			log.Printf("Unable to load hosts file: %s", err.Error())
+		}
+	}
+	for fn, hf := range hd.files {
+		if !present[fn] {
+			log.Printf("Removing records from deleted hostfile: %s", fn)
+			hf.clear()
+			delete(hd.files, fn)
+		}
+	}
+}
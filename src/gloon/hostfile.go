@@ -1,15 +1,14 @@
 package main
 
 import (
+	"context"
 	"github.com/miekg/dns"
-	"github.com/rjeczalik/notify"
 	. "gloon/record_set"
 	"io/ioutil"
 	"log"
-	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
+	"sync"
 )
 
 var ipv4_regexp = regexp.MustCompile("\\d+\\.\\d+\\.\\d+\\.\\d+")
@@ -18,52 +17,62 @@ type HostPair struct {
 	host, addr string
 }
 
+// How many hostfiles list each host and address. Files sharing one only publish it once, and it
+// stays until the last of them drops it
+type HostRefs struct {
+	sync.Mutex
+	recs  *RecordSet
+	count map[HostPair]int
+}
+
+func NewHostRefs(recs *RecordSet) *HostRefs {
+	return &HostRefs{recs: recs, count: make(map[HostPair]int)}
+}
+
+func (hr *HostRefs) add(hp HostPair) {
+	hr.Lock()
+	defer hr.Unlock()
+	hr.count[hp]++
+	if hr.count[hp] == 1 {
+		hr.recs.Put(dns.TypeA, hp.host, hp.addr)
+	}
+}
+
+func (hr *HostRefs) del(hp HostPair) {
+	hr.Lock()
+	defer hr.Unlock()
+	if hr.count[hp]--; hr.count[hp] <= 0 {
+		delete(hr.count, hp)
+		hr.recs.DelAddr(dns.TypeA, hp.host, hp.addr)
+	}
+}
+
 type Hostfile struct {
 	hosts          map[HostPair]bool
 	fn             string
-	recs           *RecordSet
+	refs           *HostRefs
 	reloadInterval int
 }
 
-func NewHostfile(fn string, recs *RecordSet, reloadInterval int) (hf *Hostfile) {
-	hf = &Hostfile{make(map[HostPair]bool), fn, recs, reloadInterval}
+func NewHostfile(fn string, refs *HostRefs, reloadInterval int) (hf *Hostfile) {
+	hf = &Hostfile{make(map[HostPair]bool), fn, refs, reloadInterval}
 	return
 }
 
-func (hf *Hostfile) Run() {
-	hfn_abs, err := filepath.Abs(hf.fn)
-	if err != nil {
-		log.Printf("Unable to get absolute path of %s", err.Error())
-		return
-	}
-	err = hf.loadHosts()
-	if err != nil {
-		log.Printf("Unable to load hosts file: %s", err.Error())
-		return
-	}
-	// Monitor and load
-	if hf.reloadInterval > 0 {
-		for {
-			time.Sleep(time.Duration(hf.reloadInterval) * time.Second)
-			hf.loadHosts() // Ignore errors
-		}
-	} else {
-		c := make(chan notify.EventInfo, 1)
-		if err = notify.Watch(filepath.Dir(hf.fn), c, notify.Write); err != nil {
-			log.Printf("WARNING: hostfile notifications could not be set up: %s", err.Error())
-			return
-		}
-		defer func() {
-			notify.Stop(c)
-			close(c)
-		}()
-		for evt := range c {
-			if evt.Path() == hfn_abs {
-				log.Printf("Reloading modified hostfile: %s", hf.fn)
-				hf.loadHosts() // Ignoring errors
+// Load and watch the file until ctx is cancelled
+func (hf *Hostfile) Run(ctx context.Context) {
+	fw := &FileWatcher{
+		name:           "hostfile " + hf.fn,
+		paths:          func() []string { return []string{hf.fn} },
+		reloadInterval: hf.reloadInterval,
+		reload: func() {
+			// Keep the records we have if the file is missing, ex. in the middle of an atomic save
+			if err := hf.loadHosts(); err != nil {
+				log.Printf("Unable to load hosts file: %s", err.Error())
 			}
-		}
+		},
 	}
+	fw.Run(ctx)
 }
 
 func (hf *Hostfile) loadHosts() (err error) {
@@ -78,8 +87,8 @@ func (hf *Hostfile) loadHosts() (err error) {
 		}
 		for _, hn := range hostnames {
 			hp := HostPair{hn, ip}
-			if !hf.hosts[hp] { // Dont incur the log cost
-				hf.recs.Put(dns.TypeA, hn, ip)
+			if !hf.hosts[hp] && !hosts[hp] { // Dont incur the log cost
+				hf.refs.add(hp)
 			}
 			hosts[hp] = true
 		}
@@ -87,13 +96,21 @@ func (hf *Hostfile) loadHosts() (err error) {
 	// Remove hosts not in new file
 	for hp, _ := range hf.hosts {
 		if !hosts[hp] {
-			hf.recs.DelAddr(dns.TypeA, hp.host, hp.addr)
+			hf.refs.del(hp)
 		}
 	}
 	hf.hosts = hosts
 	return
 }
 
+// Remove every record loaded from the file, ex. when it has been deleted
+func (hf *Hostfile) clear() {
+	for hp := range hf.hosts {
+		hf.refs.del(hp)
+	}
+	hf.hosts = make(map[HostPair]bool)
+}
+
 func parseHosts(fn string) (hm map[string][]string, err error) {
 	hm = map[string][]string{}
 	b, err := ioutil.ReadFile(fn)
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeHosts(t *testing.T, fn, content string) {
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal("WriteFile()", err)
+	}
+}
+
+func TestHostDirScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-hostdir")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	defer os.RemoveAll(dir)
+	recs := record_set.Create(mem_rs.Create())
+	hd := NewHostDir(dir, NewHostRefs(recs), 0)
+
+	writeHosts(t, filepath.Join(dir, "a.hosts"), "10.0.0.1 foo.test\n")
+	writeHosts(t, filepath.Join(dir, "b.hosts"), "10.0.0.2 bar.test\n10.0.0.3 foo.test\n")
+	writeHosts(t, filepath.Join(dir, "c.txt"), "10.0.0.4 baz.test\n")
+	hd.scan()
+	if vals := recs.GetAll(dns.TypeA, "foo.test."); len(vals) != 2 {
+		t.Errorf("Got %#v for foo.test -- expected 2 addresses", vals)
+	}
+	expectAddr(t, recs, "bar.test.", "10.0.0.2")
+	expectAddr(t, recs, "baz.test.", "")
+
+	// Removing a file only removes its own records
+	os.Remove(filepath.Join(dir, "b.hosts"))
+	hd.scan()
+	expectAddr(t, recs, "bar.test.", "")
+	expectAddr(t, recs, "foo.test.", "10.0.0.1")
+
+	writeHosts(t, filepath.Join(dir, "a.hosts"), "10.0.0.5 foo.test\n")
+	hd.scan()
+	expectAddr(t, recs, "foo.test.", "10.0.0.5")
+}
+
+// A host listed by several files stays until no file lists it
+func TestHostDirSharedHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-hostdir")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	defer os.RemoveAll(dir)
+	recs := record_set.Create(mem_rs.Create())
+	refs := NewHostRefs(recs)
+	hd := NewHostDir(dir, refs, 0)
+	writeHosts(t, filepath.Join(dir, "a.hosts"), "10.0.0.5 db.test\n10.0.0.5 db.test\n")
+	writeHosts(t, filepath.Join(dir, "b.hosts"), "10.0.0.5 db.test\n")
+	hd.scan()
+	expectAddr(t, recs, "db.test.", "10.0.0.5")
+
+	os.Remove(filepath.Join(dir, "b.hosts"))
+	hd.scan()
+	expectAddr(t, recs, "db.test.", "10.0.0.5")
+
+	// A separately listed hostfile shares the count
+	writeHosts(t, filepath.Join(dir, "hosts"), "10.0.0.5 db.test\n")
+	hf := NewHostfile(filepath.Join(dir, "hosts"), refs, 0)
+	hf.loadHosts()
+	writeHosts(t, filepath.Join(dir, "a.hosts"), "10.0.0.6 web.test\n")
+	hd.scan()
+	expectAddr(t, recs, "db.test.", "10.0.0.5")
+	hf.clear()
+	expectAddr(t, recs, "db.test.", "")
+	hd.clear()
+	expectAddr(t, recs, "web.test.", "")
+}
+
+// Wait for the watcher to pick up a change
+func waitForAddr(t *testing.T, recs *record_set.RecordSet, host, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if recs.Get(dns.TypeA, host) == expected {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	expectAddr(t, recs, host, expected)
+}
+
+func TestHostfileAtomicSaveAndSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-hostfile")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	defer os.RemoveAll(dir)
+	// ConfigMap style layout: hosts -> ..data/hosts, ..data -> v1
+	os.Mkdir(filepath.Join(dir, "v1"), 0755)
+	writeHosts(t, filepath.Join(dir, "v1", "hosts"), "10.0.0.1 foo.test\n")
+	os.Symlink("v1", filepath.Join(dir, "..data"))
+	os.Symlink(filepath.Join("..data", "hosts"), filepath.Join(dir, "hosts"))
+
+	recs := record_set.Create(mem_rs.Create())
+	hf := NewHostfile(filepath.Join(dir, "hosts"), NewHostRefs(recs), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hf.Run(ctx)
+	waitForAddr(t, recs, "foo.test.", "10.0.0.1")
+
+	// Editor style atomic save of the target
+	writeHosts(t, filepath.Join(dir, "v1", "hosts.tmp"), "10.0.0.2 foo.test\n")
+	os.Rename(filepath.Join(dir, "v1", "hosts.tmp"), filepath.Join(dir, "v1", "hosts"))
+	waitForAddr(t, recs, "foo.test.", "10.0.0.2")
+
+	// Symlink swap
+	os.Mkdir(filepath.Join(dir, "v2"), 0755)
+	writeHosts(t, filepath.Join(dir, "v2", "hosts"), "10.0.0.3 foo.test\n")
+	os.Symlink("v2", filepath.Join(dir, "..data_tmp"))
+	os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))
+	waitForAddr(t, recs, "foo.test.", "10.0.0.3")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Compose labels exposed to hostname templates
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+var dnsLabelRegexp = regexp.MustCompile(`^(\*|[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?)$`)
+
+// Data a hostname template is evaluated against, ex. {{.Label "team"}}-{{.Name}}.{{.Network}}.docker
+type HostnameData struct {
+	Name     string // Container name
+	Hostname string // Configured container hostname
+	Image    string
+	Project  string // Compose project, if any
+	Service  string // Compose service, if any
+	Network  string // Network the published address belongs to
+	Domain   string // Domain configured for the container's docker host
+	Labels   map[string]string
+}
+
+// Label value, or an empty string if the container does not have the label
+func (hd *HostnameData) Label(name string) string {
+	return hd.Labels[name]
+}
+
+func newHostnameData(c *Container, network, domain string) *HostnameData {
+	return &HostnameData{
+		Name:     c.Name,
+		Hostname: c.Hostname,
+		Image:    c.Image,
+		Project:  c.Labels[composeProjectLabel],
+		Service:  c.Labels[composeServiceLabel],
+		Network:  network,
+		Domain:   domain,
+		Labels:   c.Labels,
+	}
+}
+
+type HostnameTemplate struct {
+	tmpl *template.Template
+}
+
+func NewHostnameTemplate(text string) (ht *HostnameTemplate, err error) {
+	tmpl, err := template.New("hostname").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return
+	}
+	ht = &HostnameTemplate{tmpl}
+	return
+}
+
+// Evaluate the template and check the result is a usable dns name
+func (ht *HostnameTemplate) Hostname(data *HostnameData) (hostname string, err error) {
+	var buf bytes.Buffer
+	if err = ht.tmpl.Execute(&buf, data); err != nil {
+		return
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(buf.String()), "."))
+	err = validateHostname(hostname)
+	return
+}
+
+func validateHostname(hostname string) error {
+	if hostname == "" {
+		return fmt.Errorf("Empty hostname")
+	}
+	if len(hostname) > 253 {
+		return fmt.Errorf("Hostname %q is longer than 253 characters", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if !dnsLabelRegexp.MatchString(label) {
+			return fmt.Errorf("Hostname %q has invalid label %q", hostname, label)
+		}
+	}
+	return nil
+}
@@ -1,15 +1,40 @@
 package main
 
 import (
+	"fmt"
 	"github.com/urfave/cli"
 	"log"
 	"os"
+	"strings"
 )
 
 const VERSION = "1.0.3"
 
+// Exit codes
+const (
+	EXIT_OK       = 0
+	EXIT_FAILURE  = 1 // A listener failed while running
+	EXIT_CONFIG   = 2 // Invalid flags or configuration, or we could not start
+	EXIT_SHUTDOWN = 3 // Shutdown did not complete cleanly, or was cut short by a second signal
+)
+
 func main() {
 	log.Printf("I AM GL00N")
+	app := newCliApp(func(s *Settings, err error) error {
+		if err != nil {
+			return cli.NewExitError(err.Error(), EXIT_CONFIG)
+		}
+		return appMain(s)
+	})
+	// Errors with an exit code exit from within Run. Anything left is a command line error
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(EXIT_CONFIG)
+	}
+}
+
+// Build the command line app. action is called with settings from the flags and config file, or
+// with the error that kept us from loading them
+func newCliApp(action func(*Settings, error) error) *cli.App {
 	s := Settings{}
 	s.Hostnames = []string{}
 	app := cli.NewApp()
@@ -18,12 +43,38 @@ func main() {
 	app.UsageText = "gloon [options]"
 	app.Version = VERSION
 	app.Action = func(c *cli.Context) error {
-		if c.StringSlice("hostname") != nil {
+		isSet := flagIsSet(c)
+		if s.ConfigFile != "" {
+			cfg, err := LoadConfig(s.ConfigFile)
+			if err != nil {
+				return action(nil, fmt.Errorf("Unable to load config file: %s", err.Error()))
+			}
+			cfg.Apply(&s, isSet)
+		}
+		if isSet("hostname") {
 			s.Hostnames = c.StringSlice("hostname")
 		}
-		return appMain(&s)
+		if isSet("docker-host") {
+			s.DockerHosts = c.StringSlice("docker-host")
+		}
+		if isSet("hostfile") {
+			s.Hostfiles = c.StringSlice("hostfile")
+		}
+		if isSet("zonefile") {
+			s.Zonefiles = c.StringSlice("zonefile")
+		}
+		if isSet("docker-txt-label") {
+			s.DockerTxtLabels = c.StringSlice("docker-txt-label")
+		}
+		return action(&s, nil)
 	}
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:        "config, c",
+			Value:       "",
+			Usage:       "Load settings from TOML `FILE`. Command line flags override file values",
+			Destination: &s.ConfigFile,
+		},
 		cli.BoolFlag{
 			Name:        "disable-forward",
 			Usage:       "Disable request forwarding",
@@ -62,6 +113,26 @@ func main() {
 			Usage:       "Api http server listens on `ADDR`. Default is no api server",
 			Destination: &s.ApiAddr,
 		},
+		cli.StringFlag{
+			Name:        "api-tokens",
+			Usage:       "Require bearer tokens listed in `FILE` for the api. Each line is NAME TOKEN SCOPE..., with scopes read, write, write:PATTERN or admin",
+			Destination: &s.ApiTokensFile,
+		},
+		cli.StringFlag{
+			Name:        "api-tls-cert",
+			Usage:       "Serve the api over https with the certificate in `FILE`",
+			Destination: &s.ApiTlsCert,
+		},
+		cli.StringFlag{
+			Name:        "api-tls-key",
+			Usage:       "Key for --api-tls-cert in `FILE`",
+			Destination: &s.ApiTlsKey,
+		},
+		cli.StringFlag{
+			Name:        "api-client-ca",
+			Usage:       "Require api clients to present a certificate signed by the CA in `FILE`",
+			Destination: &s.ApiClientCa,
+		},
 		cli.StringFlag{
 			Name:        "hostname-filter, f",
 			Value:       "",
@@ -75,15 +146,23 @@ func main() {
 			Destination: &s.AppendDomain,
 		},
 		cli.StringFlag{
-			Name:        "hostfile",
+			Name:        "hostname-template",
 			Value:       "",
-			Usage:       "Load up `FILE` at startup and add any records found. Wilcards are supported",
-			Destination: &s.Hostfile,
+			Usage:       "Build docker container hostnames from Go `TEMPLATE`, ex. '{{.Label \"team\"}}-{{.Name}}.{{.Network}}.docker'. Replaces the container hostname and --append-domain",
+			Destination: &s.HostnameTemplate,
+		},
+		cli.StringSliceFlag{
+			Name:  "hostfile",
+			Usage: "Load up `FILE` at startup and add any records found. Wilcards are supported. If FILE is a directory, all *.hosts files in it are loaded. May be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "zonefile",
+			Usage: "Load records from RFC 1035 zone `FILE` and watch it for changes. Supports A, CNAME, MX, SRV, NS, TXT and PTR records. May be repeated",
 		},
 		cli.IntFlag{
 			Name:        "reload-interval, i",
 			Value:       0,
-			Usage:       "Reload hostfile (where applicable) every `SEC` seconds. If unset, default is to try inotify or similiar where available",
+			Usage:       "Reload hostfiles and zone files (where applicable) every `SEC` seconds. If unset, default is to try inotify or similiar where available",
 			Destination: &s.HostfileReloadInterval,
 		},
 		cli.StringSliceFlag{
@@ -93,15 +172,25 @@ func main() {
 		cli.StringFlag{
 			Name:        "store",
 			Value:       "memory",
-			Usage:       "Set local dns record storage to `TYPE`. Valid values are 'redis' and 'memory'",
+			Usage:       "Set local dns record storage to `TYPE`. Valid values are 'memory', 'file', 'redis', 'etcd', 'sql' and 'peer'",
 			Destination: &s.Store,
 		},
 		cli.StringFlag{
 			Name:        "store-opts",
 			Value:       "",
-			Usage:       "Set record store options to `STRING`. Specific values depend on store type. Ex. for redis to set server addr and db: '10.14.2.3:6379,1'",
+			Usage:       "Set record store options to `STRING`. Specific values depend on store type. Ex. for redis: 'redis://:password@10.14.2.3:6379/1?namespace=gloon', for file the path: '/var/lib/gloon/records.db', or for sql the driver and dsn: 'postgres:postgres://gloon@db/gloon', or for peer this instance's address then its peers: '10.0.0.1:7946,10.0.0.2:7946,secret=s'",
 			Destination: &s.StoreOpts,
 		},
+		cli.IntFlag{
+			Name:        "store-cache",
+			Usage:       "Cache records read from the store for `SEC` seconds, and keep serving them if the store can't be reached. Useful with redis",
+			Destination: &s.StoreCache,
+		},
+		cli.BoolFlag{
+			Name:        "cleanup-on-exit",
+			Usage:       "On shutdown, remove the records this instance published. Useful with a shared store such as redis",
+			Destination: &s.CleanupOnExit,
+		},
 		cli.IntFlag{
 			Name:        "ttl",
 			Value:       3600,
@@ -120,42 +209,67 @@ func main() {
 			Usage:       "Restrict A records to ips found on docker network `NETWORK`",
 			Destination: &s.DockerNetwork,
 		},
+		cli.BoolFlag{
+			Name:        "docker-withdraw-paused",
+			Usage:       "Remove A records for paused docker containers until they are unpaused",
+			Destination: &s.DockerWithdrawPaused,
+		},
+		cli.BoolFlag{
+			Name:        "docker-require-healthy",
+			Usage:       "Only publish A records for docker containers whose healthcheck reports healthy. Override per container with the gloon.require-healthy label",
+			Destination: &s.DockerRequireHealthy,
+		},
+		cli.BoolFlag{
+			Name:        "docker-swarm",
+			Usage:       "Publish A records for swarm services (service VIP) and their tasks (tasks.SERVICE). Docker host must be a swarm manager",
+			Destination: &s.DockerSwarm,
+		},
+		cli.BoolFlag{
+			Name:        "docker-txt",
+			Usage:       "Publish TXT records with the container id, image and compose service alongside docker A records",
+			Destination: &s.DockerTxt,
+		},
+		cli.StringSliceFlag{
+			Name:  "docker-txt-label",
+			Usage: "Include container label `LABEL` in docker TXT records. May be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "docker-host",
+			Usage: "Monitor docker daemon at `HOST[,domain=DOMAIN][,tlscacert=FILE][,tlscert=FILE][,tlskey=FILE][,tlsverify][,tlsskipverify]`. May be repeated. Default is the daemon from the DOCKER_HOST environment",
+		},
 	}
-
-	app.Run(os.Args)
+	return app
 }
 
-func appMain(settings *Settings) (err error) {
-	log.Printf("gloon %s starting...", VERSION)
-	s, err := NewServer(settings.ResolverAddr, settings)
-	if err != nil {
-		log.Fatalf("Unable to create server: %s", err.Error())
-	}
-	if !settings.DisableDocker {
-		dm, err := NewDockerMonitor(s.RecordSet, settings)
-		if err != nil {
-			log.Printf("WARNING: unable to start docker monitor: %s. Docker hostname support will be disabled", err.Error())
-		}
-		go func() {
-			dm.Run()
-		}()
-	}
-	if settings.Hostfile != "" {
-		hf := NewHostfile(settings.Hostfile, s.RecordSet, settings.HostfileReloadInterval)
-		go func() {
-			hf.Run()
-		}()
+// Parse settings from the command line and config file again, ex. on reload
+func loadSettings(args []string) (settings *Settings, err error) {
+	app := newCliApp(func(s *Settings, e error) error {
+		settings, err = s, e
+		return nil
+	})
+	app.Run(args)
+	if err == nil && settings == nil {
+		err = fmt.Errorf("No settings parsed from command line")
 	}
+	return
+}
 
-	if settings.ApiAddr != "" {
-		go func() {
-			RunApiServer(settings, s.RecordSet)
-		}()
+// Whether a flag was given on the command line, under its long or short name
+func flagIsSet(c *cli.Context) func(string) bool {
+	names := make(map[string][]string)
+	for _, f := range c.App.Flags {
+		var aliases []string
+		for _, name := range strings.Split(f.GetName(), ",") {
+			aliases = append(aliases, strings.TrimSpace(name))
+		}
+		names[aliases[0]] = aliases
 	}
-	err = s.ListenAndServe()
-	defer s.Shutdown()
-	if err != nil {
-		log.Fatalf("Unable to start server: %s", err.Error())
+	return func(flag string) bool {
+		for _, name := range names[flag] {
+			if c.IsSet(name) {
+				return true
+			}
+		}
+		return false
 	}
-	return
 }
@@ -2,6 +2,7 @@ package mem_rs
 
 import (
 	"fmt"
+	"gloon/record_store"
 	"math/rand"
 	"sync"
 	"time"
@@ -12,10 +13,11 @@ type RecData map[string]map[string]bool
 type MemRecordStore struct {
 	sync.RWMutex
 	data RecData
+	meta map[string]string // Keyed like data
 }
 
 func Create() (rs *MemRecordStore) {
-	rs = &MemRecordStore{data: make(RecData)}
+	rs = &MemRecordStore{data: make(RecData), meta: make(map[string]string)}
 	rand.Seed(time.Now().UnixNano())
 	return
 }
@@ -23,13 +25,17 @@ func Create() (rs *MemRecordStore) {
 func (rs *MemRecordStore) PutVal(dnsType uint16, key, val string) (err error) {
 	rs.Lock()
 	defer rs.Unlock()
+	rs.putVal(dnsType, key, val)
+	return
+}
+
+func (rs *MemRecordStore) putVal(dnsType uint16, key, val string) {
 	vals := rs.data[keyPath(dnsType, key)]
 	if vals == nil {
 		vals = make(map[string]bool)
 	}
 	vals[val] = true
 	rs.data[keyPath(dnsType, key)] = vals
-	return
 }
 
 func (rs *MemRecordStore) GetAll(dnsType uint16, key string) (vals []string, err error) {
@@ -46,13 +52,37 @@ func (rs *MemRecordStore) GetAll(dnsType uint16, key string) (vals []string, err
 func (rs *MemRecordStore) DelKey(dnsType uint16, key string) (err error) {
 	rs.Lock()
 	defer rs.Unlock()
-	delete(rs.data, keyPath(dnsType, key))
+	rs.delKey(dnsType, key)
 	return
 }
 
+func (rs *MemRecordStore) delKey(dnsType uint16, key string) {
+	delete(rs.data, keyPath(dnsType, key))
+	delete(rs.meta, keyPath(dnsType, key))
+}
+
+func (rs *MemRecordStore) GetMeta(dnsType uint16, key string) (meta string, err error) {
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.meta[keyPath(dnsType, key)], nil
+}
+
+func (rs *MemRecordStore) setMeta(dnsType uint16, key, meta string) {
+	if meta == "" {
+		delete(rs.meta, keyPath(dnsType, key))
+		return
+	}
+	rs.meta[keyPath(dnsType, key)] = meta
+}
+
 func (rs *MemRecordStore) DelVal(dnsType uint16, key, val string) (err error) {
 	rs.Lock()
 	defer rs.Unlock()
+	rs.delVal(dnsType, key, val)
+	return
+}
+
+func (rs *MemRecordStore) delVal(dnsType uint16, key, val string) {
 	kp := keyPath(dnsType, key)
 	vals := rs.data[kp]
 	if vals == nil {
@@ -61,7 +91,56 @@ func (rs *MemRecordStore) DelVal(dnsType uint16, key, val string) (err error) {
 	delete(vals, val)
 	rs.data[kp] = vals
 	if len(vals) == 0 {
-		delete(rs.data, key)
+		delete(rs.data, kp)
+	}
+}
+
+// Apply ops while holding the lock, so readers see all of them or none
+func (rs *MemRecordStore) Apply(ops []record_store.StoreOp) (err error) {
+	for _, op := range ops {
+		if op.Type != record_store.StorePut && op.Type != record_store.StoreDelVal && op.Type != record_store.StoreDelKey && op.Type != record_store.StoreSetMeta {
+			return fmt.Errorf("Unknown store operation %d", op.Type)
+		}
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	for _, op := range ops {
+		switch op.Type {
+		case record_store.StorePut:
+			rs.putVal(op.DnsType, op.Key, op.Val)
+		case record_store.StoreDelVal:
+			rs.delVal(op.DnsType, op.Key, op.Val)
+		case record_store.StoreDelKey:
+			rs.delKey(op.DnsType, op.Key)
+		case record_store.StoreSetMeta:
+			rs.setMeta(op.DnsType, op.Key, op.Val)
+		}
+	}
+	return
+}
+
+func (rs *MemRecordStore) All() (records []record_store.StoreRecord, err error) {
+	rs.RLock()
+	defer rs.RUnlock()
+	for kp, valmap := range rs.data {
+		dnsType, key, ok := record_store.SplitKeyPath(kp)
+		if !ok {
+			continue
+		}
+		records = append(records, record_store.StoreRecord{DnsType: dnsType, Key: key, Vals: getKeysFromMap(valmap), Meta: rs.meta[kp]})
+	}
+	return
+}
+
+// Metadata of every key, including keys that have no values
+func (rs *MemRecordStore) AllMeta() (metas map[record_store.StoreKey]string) {
+	rs.RLock()
+	defer rs.RUnlock()
+	metas = make(map[record_store.StoreKey]string, len(rs.meta))
+	for kp, meta := range rs.meta {
+		if dnsType, key, ok := record_store.SplitKeyPath(kp); ok {
+			metas[record_store.StoreKey{DnsType: dnsType, Key: key}] = meta
+		}
 	}
 	return
 }
@@ -70,6 +149,7 @@ func (rs *MemRecordStore) Clear() (err error) {
 	rs.Lock()
 	defer rs.Unlock()
 	rs.data = make(RecData)
+	rs.meta = make(map[string]string)
 	return
 }
 
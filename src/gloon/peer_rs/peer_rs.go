@@ -0,0 +1,624 @@
+package peer_rs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gloon/record_set"
+	"gloon/record_store"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_INTERVAL   = 10 * time.Second // Between syncs with each peer
+	DEFAULT_TOMBSTONES = 24 * time.Hour   // How long deletes are remembered
+	REQUEST_TIMEOUT    = 5 * time.Second
+)
+
+// When a change was made, and by which instance. The later change wins, and Node breaks ties
+type Stamp struct {
+	T    uint64 // Nanoseconds, but never behind a stamp the instance has seen
+	Node string
+}
+
+func (s Stamp) Less(o Stamp) bool {
+	return s.T < o.T || (s.T == o.T && s.Node < o.Node)
+}
+
+// The last change to a value: a put, or a delete
+type Entry struct {
+	DnsType uint16
+	Key     string
+	Val     string
+	Deleted bool `json:",omitempty"`
+	Stamp   Stamp
+}
+
+// The last change to a key's metadata. Empty Meta removed it
+type MetaEntry struct {
+	DnsType uint16
+	Key     string
+	Meta    string `json:",omitempty"`
+	Stamp   Stamp
+}
+
+// A key deleted with DelKey. It covers the key's values and metadata with older stamps
+type KeyDel struct {
+	DnsType uint16
+	Key     string
+	Stamp   Stamp
+}
+
+// What peers send each other: changes, the digest of the sender's copy, or a notice
+type Message struct {
+	From    string
+	Digest  string                  `json:",omitempty"`
+	Vals    []Entry                 `json:",omitempty"`
+	Metas   []MetaEntry             `json:",omitempty"`
+	KeyDels []KeyDel                `json:",omitempty"`
+	Cleared *Stamp                  `json:",omitempty"` // Covers every value with an older stamp
+	Full    bool                    `json:",omitempty"` // The changes are the sender's whole copy
+	Notice  *record_set.StoreNotice `json:",omitempty"`
+}
+
+// How peers reach each other. Send passes msg to the peer's Handle, and returns what it answers
+type Transport interface {
+	Send(peer string, msg *Message) (*Message, error)
+}
+
+// A RecordStore replicated between gloon instances, without a server. Every instance takes writes
+// and serves reads from its own copy. Changes are pushed to the peers as they are made, and each
+// instance regularly compares its copy with each peer's, and swaps them if they differ, which
+// catches up peers that missed changes. The latest change to a value wins, so copies end up the
+// same whatever order changes arrive in. Deletes are remembered for a while, so peers that missed
+// them don't bring the values back. Copies are only in memory
+type PeerRecordStore struct {
+	mu         sync.RWMutex
+	id         string
+	peers      []string
+	transport  Transport
+	interval   time.Duration
+	tombstones time.Duration // How long deletes are kept
+	now        func() time.Time
+	clock      uint64 // The latest stamp given out or seen
+	vals       map[record_store.StoreKey]map[string]Entry
+	metas      map[record_store.StoreKey]MetaEntry
+	keyDels    map[record_store.StoreKey]Stamp
+	cleared    Stamp
+
+	watchMu  sync.Mutex
+	watchers map[*func(record_set.StoreNotice)]bool
+
+	downMu sync.Mutex
+	down   map[string]bool // Peers we failed to reach, so failures are logged once
+
+	pushing sync.WaitGroup
+	cancel  context.CancelFunc
+	done    chan struct{}
+	server  *http.Server
+}
+
+// Parsed store options
+type peerOpts struct {
+	listen     string
+	peers      []string
+	secret     string
+	insecure   bool
+	interval   time.Duration
+	tombstones time.Duration
+}
+
+// opts is "LISTEN,PEER,PEER...", ex. "10.0.0.1:7946,10.0.0.2:7946,10.0.0.3:7946,secret=s". Peers
+// are reached over http on their LISTEN address. A PEER equal to LISTEN is skipped, so every
+// instance can be given the same list. Options follow: "secret=SECRET", which peers must share and
+// which is required unless "insecure=true" is given, "interval=DURATION" between syncs, and
+// "tombstones=DURATION" for how long deletes are remembered
+func Create(opts string) (r *PeerRecordStore, err error) {
+	o, err := parseOpts(opts)
+	if err != nil {
+		return
+	}
+	t := newHttpTransport(o.secret)
+	ln, err := net.Listen("tcp", o.listen)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for peers: %s", err.Error())
+	}
+	r = newStore(o.peers, t, o.interval)
+	r.mu.Lock()
+	r.tombstones = o.tombstones
+	r.mu.Unlock()
+	r.server = &http.Server{Handler: t.handler(r.Handle)}
+	go r.server.Serve(ln)
+	if o.secret == "" {
+		log.Printf("WARNING: peers are not authenticated. Anyone who can reach %s can change records", ln.Addr())
+	}
+	log.Printf("Replicating records with %s, listening on %s", strings.Join(o.peers, ", "), ln.Addr())
+	return
+}
+
+func parseOpts(opts string) (o peerOpts, err error) {
+	o.interval, o.tombstones = DEFAULT_INTERVAL, DEFAULT_TOMBSTONES
+	duration := func(opt, name string) (d time.Duration, err error) {
+		if d, err = time.ParseDuration(strings.TrimPrefix(opt, name+"=")); err != nil || d <= 0 {
+			return 0, fmt.Errorf("Invalid peer %s", opt)
+		}
+		return
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt == "":
+		case strings.HasPrefix(opt, "secret="):
+			o.secret = strings.TrimPrefix(opt, "secret=")
+		case strings.HasPrefix(opt, "insecure="):
+			if o.insecure, err = strconv.ParseBool(strings.TrimPrefix(opt, "insecure=")); err != nil {
+				return peerOpts{}, fmt.Errorf("Invalid peer %s", opt)
+			}
+		case strings.HasPrefix(opt, "interval="):
+			if o.interval, err = duration(opt, "interval"); err != nil {
+				return peerOpts{}, err
+			}
+		case strings.HasPrefix(opt, "tombstones="):
+			if o.tombstones, err = duration(opt, "tombstones"); err != nil {
+				return peerOpts{}, err
+			}
+		case strings.Contains(opt, "="):
+			return peerOpts{}, fmt.Errorf("Unknown peer store option %s", opt)
+		case o.listen == "":
+			o.listen = opt
+		case opt != o.listen:
+			o.peers = append(o.peers, opt)
+		}
+	}
+	if o.listen == "" {
+		return peerOpts{}, fmt.Errorf("Expected LISTEN,PEER,PEER... in store options")
+	}
+	if o.secret == "" && !o.insecure {
+		return peerOpts{}, fmt.Errorf("Peers need a shared secret=SECRET. Set insecure=true to run without one")
+	}
+	return
+}
+
+// A store replicating with peers through t. It syncs with them at once, then every interval
+func newStore(peers []string, t Transport, interval time.Duration) *PeerRecordStore {
+	id := make([]byte, 8)
+	rand.Read(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &PeerRecordStore{
+		id:         hex.EncodeToString(id),
+		peers:      peers,
+		transport:  t,
+		interval:   interval,
+		tombstones: DEFAULT_TOMBSTONES,
+		now:        time.Now,
+		vals:       make(map[record_store.StoreKey]map[string]Entry),
+		metas:      make(map[record_store.StoreKey]MetaEntry),
+		keyDels:    make(map[record_store.StoreKey]Stamp),
+		watchers:   make(map[*func(record_set.StoreNotice)]bool),
+		down:       make(map[string]bool),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go r.run(ctx)
+	return r
+}
+
+// Stop syncing, and wait for changes being pushed
+func (r *PeerRecordStore) Close() {
+	r.cancel()
+	<-r.done
+	r.pushing.Wait()
+	if r.server != nil {
+		r.server.Close()
+	}
+}
+
+func (r *PeerRecordStore) run(ctx context.Context) {
+	defer close(r.done)
+	for {
+		r.mu.Lock()
+		r.gc()
+		r.mu.Unlock()
+		r.syncAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *PeerRecordStore) syncAll() {
+	for _, peer := range r.peers {
+		r.reached(peer, r.sync(peer))
+	}
+}
+
+// Compare digests with peer, and swap copies if they differ
+func (r *PeerRecordStore) sync(peer string) error {
+	digest := r.digest()
+	reply, err := r.transport.Send(peer, &Message{From: r.id, Digest: digest})
+	if err != nil || reply.Digest == digest {
+		return err
+	}
+	if reply, err = r.transport.Send(peer, r.copy()); err != nil {
+		return err
+	}
+	r.merge(reply)
+	return nil
+}
+
+// Log when a peer can't be reached, and when it can again
+func (r *PeerRecordStore) reached(peer string, err error) {
+	r.downMu.Lock()
+	defer r.downMu.Unlock()
+	if err != nil && !r.down[peer] {
+		log.Printf("Unable to reach peer %s: %s", peer, err.Error())
+		r.down[peer] = true
+	} else if err == nil && r.down[peer] {
+		log.Printf("Reached peer %s again", peer)
+		delete(r.down, peer)
+	}
+}
+
+// Send msg to every peer, in the background. Peers that miss it catch up at the next sync
+func (r *PeerRecordStore) push(msg *Message) {
+	for _, peer := range r.peers {
+		r.pushing.Add(1)
+		go func(peer string) {
+			defer r.pushing.Done()
+			_, err := r.transport.Send(peer, msg)
+			r.reached(peer, err)
+		}(peer)
+	}
+}
+
+// Answer a message from a peer
+func (r *PeerRecordStore) Handle(msg *Message) *Message {
+	if msg.Full || len(msg.Vals) > 0 || len(msg.Metas) > 0 || len(msg.KeyDels) > 0 || msg.Cleared != nil {
+		r.merge(msg)
+	}
+	if msg.Notice != nil {
+		r.deliver(*msg.Notice)
+	}
+	// A peer that sent its whole copy gets ours back, now that it has been merged
+	if msg.Full {
+		return r.copy()
+	}
+	reply := &Message{From: r.id}
+	if msg.Digest != "" {
+		reply.Digest = r.digest()
+	}
+	return reply
+}
+
+// A stamp for a change made here. Called with the lock held
+func (r *PeerRecordStore) tick() Stamp {
+	t := uint64(r.now().UnixNano())
+	if t <= r.clock {
+		t = r.clock + 1
+	}
+	r.clock = t
+	return Stamp{T: t, Node: r.id}
+}
+
+// Keep our clock ahead of the changes we've seen. Called with the lock held
+func (r *PeerRecordStore) observe(s Stamp) {
+	if s.T > r.clock {
+		r.clock = s.T
+	}
+}
+
+// Whether a delete covers a change to k made at s. Called with the lock held
+func (r *PeerRecordStore) covered(k record_store.StoreKey, s Stamp) bool {
+	return !r.cleared.Less(s) || !r.keyDels[k].Less(s)
+}
+
+// Drop k's values and metadata that a delete covers. Called with the lock held
+func (r *PeerRecordStore) pruneKey(k record_store.StoreKey) {
+	for val, e := range r.vals[k] {
+		if r.covered(k, e.Stamp) {
+			delete(r.vals[k], val)
+		}
+	}
+	if len(r.vals[k]) == 0 {
+		delete(r.vals, k)
+	}
+	if e, ok := r.metas[k]; ok && r.covered(k, e.Stamp) {
+		delete(r.metas, k)
+	}
+}
+
+// Drop everything the last Clear covers. Called with the lock held
+func (r *PeerRecordStore) prune() {
+	for k, s := range r.keyDels {
+		if !r.cleared.Less(s) {
+			delete(r.keyDels, k)
+		}
+	}
+	for k := range r.vals {
+		r.pruneKey(k)
+	}
+	for k := range r.metas {
+		r.pruneKey(k)
+	}
+}
+
+// Forget deletes older than r.tombstones. Every peer does the same, so copies still match. A peer
+// cut off for longer may bring back what they deleted. Called with the lock held
+func (r *PeerRecordStore) gc() {
+	t := r.now().Add(-r.tombstones).UnixNano()
+	if t <= 0 {
+		return
+	}
+	cutoff := uint64(t)
+	for k, vals := range r.vals {
+		for val, e := range vals {
+			if e.Deleted && e.Stamp.T < cutoff {
+				delete(vals, val)
+			}
+		}
+		if len(vals) == 0 {
+			delete(r.vals, k)
+		}
+	}
+	for k, e := range r.metas {
+		if e.Meta == "" && e.Stamp.T < cutoff {
+			delete(r.metas, k)
+		}
+	}
+	for k, s := range r.keyDels {
+		if s.T < cutoff {
+			delete(r.keyDels, k)
+		}
+	}
+}
+
+func (r *PeerRecordStore) setVal(e Entry) {
+	k := record_store.StoreKey{DnsType: e.DnsType, Key: e.Key}
+	if r.vals[k] == nil {
+		r.vals[k] = make(map[string]Entry)
+	}
+	r.vals[k][e.Val] = e
+}
+
+// Merge changes from a peer, and tell watchers about the keys that changed
+func (r *PeerRecordStore) merge(msg *Message) {
+	r.mu.Lock()
+	changed := make(map[record_store.StoreKey]bool)
+	reset := false
+	if msg.Cleared != nil && r.cleared.Less(*msg.Cleared) {
+		r.observe(*msg.Cleared)
+		r.cleared = *msg.Cleared
+		r.prune()
+		reset = true
+	}
+	for _, kd := range msg.KeyDels {
+		r.observe(kd.Stamp)
+		k := record_store.StoreKey{DnsType: kd.DnsType, Key: kd.Key}
+		if r.keyDels[k].Less(kd.Stamp) && r.cleared.Less(kd.Stamp) {
+			r.keyDels[k] = kd.Stamp
+			r.pruneKey(k)
+			changed[k] = true
+		}
+	}
+	for _, e := range msg.Vals {
+		r.observe(e.Stamp)
+		k := record_store.StoreKey{DnsType: e.DnsType, Key: e.Key}
+		if cur, ok := r.vals[k][e.Val]; r.covered(k, e.Stamp) || (ok && !cur.Stamp.Less(e.Stamp)) {
+			continue
+		}
+		r.setVal(e)
+		changed[k] = true
+	}
+	for _, e := range msg.Metas {
+		r.observe(e.Stamp)
+		k := record_store.StoreKey{DnsType: e.DnsType, Key: e.Key}
+		if cur, ok := r.metas[k]; r.covered(k, e.Stamp) || (ok && !cur.Stamp.Less(e.Stamp)) {
+			continue
+		}
+		r.metas[k] = e
+		changed[k] = true
+	}
+	// Deletes we have already forgotten aren't kept again. They still apply to older values
+	r.gc()
+	r.mu.Unlock()
+	if !reset && len(changed) == 0 {
+		return
+	}
+	notice := record_set.StoreNotice{Reset: reset}
+	for k := range changed {
+		notice.Keys = append(notice.Keys, k)
+	}
+	r.deliver(notice)
+}
+
+// Our whole copy, in order, with its digest
+func (r *PeerRecordStore) copy() *Message {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	msg := &Message{From: r.id, Full: true}
+	for _, vals := range r.vals {
+		for _, e := range vals {
+			msg.Vals = append(msg.Vals, e)
+		}
+	}
+	sort.Slice(msg.Vals, func(i, j int) bool {
+		a, b := msg.Vals[i], msg.Vals[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.DnsType != b.DnsType {
+			return a.DnsType < b.DnsType
+		}
+		return a.Val < b.Val
+	})
+	for _, e := range r.metas {
+		msg.Metas = append(msg.Metas, e)
+	}
+	sort.Slice(msg.Metas, func(i, j int) bool {
+		a, b := msg.Metas[i], msg.Metas[j]
+		return a.Key < b.Key || (a.Key == b.Key && a.DnsType < b.DnsType)
+	})
+	for k, s := range r.keyDels {
+		msg.KeyDels = append(msg.KeyDels, KeyDel{DnsType: k.DnsType, Key: k.Key, Stamp: s})
+	}
+	sort.Slice(msg.KeyDels, func(i, j int) bool {
+		a, b := msg.KeyDels[i], msg.KeyDels[j]
+		return a.Key < b.Key || (a.Key == b.Key && a.DnsType < b.DnsType)
+	})
+	if r.cleared != (Stamp{}) {
+		cleared := r.cleared
+		msg.Cleared = &cleared
+	}
+	msg.Digest = digest(msg)
+	return msg
+}
+
+func digest(msg *Message) string {
+	h := sha256.New()
+	for _, e := range msg.Vals {
+		fmt.Fprintf(h, "v\x00%d\x00%s\x00%s\x00%t\x00%d\x00%s\n", e.DnsType, e.Key, e.Val, e.Deleted, e.Stamp.T, e.Stamp.Node)
+	}
+	for _, e := range msg.Metas {
+		fmt.Fprintf(h, "m\x00%d\x00%s\x00%s\x00%d\x00%s\n", e.DnsType, e.Key, e.Meta, e.Stamp.T, e.Stamp.Node)
+	}
+	for _, kd := range msg.KeyDels {
+		fmt.Fprintf(h, "k\x00%d\x00%s\x00%d\x00%s\n", kd.DnsType, kd.Key, kd.Stamp.T, kd.Stamp.Node)
+	}
+	if msg.Cleared != nil {
+		fmt.Fprintf(h, "c\x00%d\x00%s\n", msg.Cleared.T, msg.Cleared.Node)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *PeerRecordStore) digest() string {
+	return r.copy().Digest
+}
+
+// Apply ops to our copy, and push them to the peers
+func (r *PeerRecordStore) Apply(ops []record_store.StoreOp) error {
+	for _, op := range ops {
+		if op.Type != record_store.StorePut && op.Type != record_store.StoreDelVal && op.Type != record_store.StoreDelKey && op.Type != record_store.StoreSetMeta {
+			return fmt.Errorf("Unknown store operation %d", op.Type)
+		}
+	}
+	r.mu.Lock()
+	msg := &Message{From: r.id}
+	for _, op := range ops {
+		stamp := r.tick()
+		k := record_store.StoreKey{DnsType: op.DnsType, Key: op.Key}
+		switch op.Type {
+		case record_store.StorePut, record_store.StoreDelVal:
+			e := Entry{DnsType: op.DnsType, Key: op.Key, Val: op.Val, Deleted: op.Type == record_store.StoreDelVal, Stamp: stamp}
+			r.setVal(e)
+			msg.Vals = append(msg.Vals, e)
+		case record_store.StoreDelKey:
+			r.keyDels[k] = stamp
+			r.pruneKey(k)
+			msg.KeyDels = append(msg.KeyDels, KeyDel{DnsType: op.DnsType, Key: op.Key, Stamp: stamp})
+		case record_store.StoreSetMeta:
+			e := MetaEntry{DnsType: op.DnsType, Key: op.Key, Meta: op.Val, Stamp: stamp}
+			r.metas[k] = e
+			msg.Metas = append(msg.Metas, e)
+		}
+	}
+	r.mu.Unlock()
+	if len(ops) > 0 {
+		r.push(msg)
+	}
+	return nil
+}
+
+func (r *PeerRecordStore) PutVal(dnsType uint16, key, val string) error {
+	return r.Apply([]record_store.StoreOp{{Type: record_store.StorePut, DnsType: dnsType, Key: key, Val: val}})
+}
+
+func (r *PeerRecordStore) DelVal(dnsType uint16, key, val string) error {
+	return r.Apply([]record_store.StoreOp{{Type: record_store.StoreDelVal, DnsType: dnsType, Key: key, Val: val}})
+}
+
+func (r *PeerRecordStore) DelKey(dnsType uint16, key string) error {
+	return r.Apply([]record_store.StoreOp{{Type: record_store.StoreDelKey, DnsType: dnsType, Key: key}})
+}
+
+func (r *PeerRecordStore) GetAll(dnsType uint16, key string) (vals []string, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	vals = []string{}
+	for val, e := range r.vals[record_store.StoreKey{DnsType: dnsType, Key: key}] {
+		if !e.Deleted {
+			vals = append(vals, val)
+		}
+	}
+	return
+}
+
+func (r *PeerRecordStore) GetMeta(dnsType uint16, key string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.metas[record_store.StoreKey{DnsType: dnsType, Key: key}].Meta, nil
+}
+
+func (r *PeerRecordStore) All() (records []record_store.StoreRecord, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for k, entries := range r.vals {
+		var vals []string
+		for val, e := range entries {
+			if !e.Deleted {
+				vals = append(vals, val)
+			}
+		}
+		if len(vals) > 0 {
+			records = append(records, record_store.StoreRecord{DnsType: k.DnsType, Key: k.Key, Vals: vals, Meta: r.metas[k].Meta})
+		}
+	}
+	return
+}
+
+// Clear every copy, not just ours
+func (r *PeerRecordStore) Clear() error {
+	r.mu.Lock()
+	stamp := r.tick()
+	r.cleared = stamp
+	r.prune()
+	r.mu.Unlock()
+	r.push(&Message{From: r.id, Cleared: &stamp})
+	return nil
+}
+
+// Pass a notice to the peers. Changes reach them anyway; this carries their events
+func (r *PeerRecordStore) Notify(n record_set.StoreNotice) error {
+	r.push(&Message{From: r.id, Notice: &n})
+	return nil
+}
+
+// Pass notices of changes made by peers to fn until ctx is done
+func (r *PeerRecordStore) Watch(ctx context.Context, fn func(record_set.StoreNotice)) error {
+	r.watchMu.Lock()
+	r.watchers[&fn] = true
+	r.watchMu.Unlock()
+	<-ctx.Done()
+	r.watchMu.Lock()
+	delete(r.watchers, &fn)
+	r.watchMu.Unlock()
+	return nil
+}
+
+func (r *PeerRecordStore) deliver(n record_set.StoreNotice) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	for fn := range r.watchers {
+		(*fn)(n)
+	}
+}
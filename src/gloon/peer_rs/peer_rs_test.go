@@ -0,0 +1,363 @@
+package peer_rs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gloon/record_set"
+	"gloon/record_store"
+	"gloon/rstest"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Peers in one process. Messages go through JSON, as over the network, and peers can be cut off
+type memNet struct {
+	sync.Mutex
+	nodes map[string]*PeerRecordStore
+	cut   map[string]bool
+}
+
+type memLink struct {
+	net  *memNet
+	from string
+}
+
+func (l memLink) Send(peer string, msg *Message) (*Message, error) {
+	l.net.Lock()
+	node, cut := l.net.nodes[peer], l.net.cut[peer] || l.net.cut[l.from]
+	l.net.Unlock()
+	if node == nil || cut {
+		return nil, errors.New("unreachable")
+	}
+	reply := &Message{}
+	if err := roundTrip(msg, reply); err != nil {
+		return nil, err
+	}
+	return reply, roundTrip(node.Handle(reply), reply)
+}
+
+func roundTrip(from, to *Message) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	*to = Message{}
+	return json.Unmarshal(data, to)
+}
+
+func (n *memNet) setCut(addr string, cut bool) {
+	n.Lock()
+	n.cut[addr] = cut
+	n.Unlock()
+}
+
+// size peers, which only sync when told to
+func newCluster(t *testing.T, size int) ([]*PeerRecordStore, *memNet) {
+	net := &memNet{nodes: make(map[string]*PeerRecordStore), cut: make(map[string]bool)}
+	var addrs []string
+	for i := 0; i < size; i++ {
+		addrs = append(addrs, fmt.Sprintf("node%d", i))
+	}
+	var nodes []*PeerRecordStore
+	for _, addr := range addrs {
+		var peers []string
+		for _, peer := range addrs {
+			if peer != addr {
+				peers = append(peers, peer)
+			}
+		}
+		r := newStore(peers, memLink{net, addr}, time.Hour)
+		t.Cleanup(r.Close)
+		net.Lock()
+		net.nodes[addr] = r
+		net.Unlock()
+		nodes = append(nodes, r)
+	}
+	return nodes, net
+}
+
+// Wait for pushes, then check every node has recs
+func expectEverywhere(t *testing.T, nodes []*PeerRecordStore, recs ...record_store.StoreRecord) {
+	t.Helper()
+	for _, r := range nodes {
+		r.pushing.Wait()
+	}
+	for _, r := range nodes {
+		rstest.ExpectAll(t, r, recs...)
+	}
+}
+
+func setClock(r *PeerRecordStore, ns int64) {
+	r.mu.Lock()
+	r.now = func() time.Time { return time.Unix(0, ns) }
+	r.mu.Unlock()
+}
+
+func TestConformance(t *testing.T) {
+	rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+		nodes, _ := newCluster(t, 2)
+		return nodes[0]
+	})
+}
+
+func TestParseOpts(t *testing.T) {
+	o, err := parseOpts("10.0.0.1:7946, 10.0.0.2:7946,10.0.0.1:7946,10.0.0.3:7946,secret=s,interval=1m,tombstones=1h")
+	expected := peerOpts{listen: "10.0.0.1:7946", peers: []string{"10.0.0.2:7946", "10.0.0.3:7946"}, secret: "s", interval: time.Minute, tombstones: time.Hour}
+	if err != nil || !reflect.DeepEqual(o, expected) {
+		t.Errorf("parseOpts() returned %+v %v", o, err)
+	}
+	o, err = parseOpts(":7946,insecure=true")
+	if err != nil || !o.insecure || o.interval != DEFAULT_INTERVAL || o.tombstones != DEFAULT_TOMBSTONES {
+		t.Errorf("parseOpts() returned %+v %v -- expected the defaults", o, err)
+	}
+	for _, opts := range []string{"", "secret=s", ":7946", ":7946,insecure=false", ":7946,insecure=maybe", ":7946,secret=s,interval=10",
+		":7946,secret=s,interval=-1s", ":7946,secret=s,tombstones=0s", ":7946,secret=s,bogus=1"} {
+		if _, err := parseOpts(opts); err == nil {
+			t.Errorf("parseOpts(%q) succeeded", opts)
+		}
+	}
+}
+
+// A write on any node can be read on every node
+func TestReplication(t *testing.T) {
+	nodes, _ := newCluster(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	a.PutVal(1, "foo.bar.", "127.0.0.1")
+	b.PutVal(1, "foo.bar.", "127.0.0.2")
+	c.PutVal(16, "foo.bar.", "txt")
+	expectEverywhere(t, nodes,
+		record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1", "127.0.0.2"}},
+		record_store.StoreRecord{DnsType: 16, Key: "foo.bar.", Vals: []string{"txt"}})
+
+	c.DelVal(1, "foo.bar.", "127.0.0.1")
+	a.DelKey(16, "foo.bar.")
+	b.Apply([]record_store.StoreOp{
+		{Type: record_store.StoreDelKey, DnsType: 1, Key: "foo.bar."},
+		{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.3"},
+	})
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.3"}})
+
+	c.Clear()
+	expectEverywhere(t, nodes)
+}
+
+// A node that missed changes catches up at the next sync, and so do the others
+func TestAntiEntropy(t *testing.T) {
+	nodes, net := newCluster(t, 3)
+	a, c := nodes[0], nodes[2]
+	a.PutVal(1, "old.bar.", "127.0.0.1")
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "old.bar.", Vals: []string{"127.0.0.1"}})
+
+	net.setCut("node2", true)
+	a.PutVal(1, "foo.bar.", "127.0.0.1")
+	a.DelKey(1, "old.bar.")
+	c.PutVal(1, "baz.bar.", "127.0.0.2")
+	a.pushing.Wait()
+	c.pushing.Wait()
+	rstest.ExpectAll(t, c,
+		record_store.StoreRecord{DnsType: 1, Key: "old.bar.", Vals: []string{"127.0.0.1"}},
+		record_store.StoreRecord{DnsType: 1, Key: "baz.bar.", Vals: []string{"127.0.0.2"}})
+
+	net.setCut("node2", false)
+	c.syncAll()
+	expectEverywhere(t, nodes,
+		record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1"}},
+		record_store.StoreRecord{DnsType: 1, Key: "baz.bar.", Vals: []string{"127.0.0.2"}})
+	if a.digest() != c.digest() || nodes[1].digest() != c.digest() {
+		t.Error("Copies differ after a sync")
+	}
+}
+
+// Conflicting changes made apart resolve the same way everywhere: the latest wins
+func TestConflicts(t *testing.T) {
+	nodes, net := newCluster(t, 2)
+	a, b := nodes[0], nodes[1]
+	setClock(a, 1)
+	a.PutVal(1, "foo.bar.", "127.0.0.1")
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1"}})
+
+	net.setCut("node1", true)
+	setClock(b, 5)
+	b.DelKey(1, "foo.bar.")
+	setClock(a, 3)
+	a.PutVal(1, "foo.bar.", "127.0.0.2") // Older than the DelKey
+	setClock(a, 7)
+	a.PutVal(1, "foo.bar.", "127.0.0.3") // Newer
+	setClock(b, 9)
+	b.DelVal(1, "baz.bar.", "127.0.0.1") // Older than the put
+	setClock(a, 10)
+	a.PutVal(1, "baz.bar.", "127.0.0.1")
+	setClock(a, 11)
+	a.PutVal(1, "qux.bar.", "127.0.0.1")
+	setClock(b, 12)
+	b.DelVal(1, "qux.bar.", "127.0.0.1") // Newer than the put
+
+	net.setCut("node1", false)
+	a.syncAll()
+	expectEverywhere(t, nodes,
+		record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.3"}},
+		record_store.StoreRecord{DnsType: 1, Key: "baz.bar.", Vals: []string{"127.0.0.1"}})
+
+	// A node whose clock is behind still orders its changes after those it has seen
+	setClock(b, 2)
+	b.DelKey(1, "foo.bar.")
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "baz.bar.", Vals: []string{"127.0.0.1"}})
+}
+
+// Deletes are forgotten everywhere once they are older than the tombstone period
+func TestTombstones(t *testing.T) {
+	nodes, _ := newCluster(t, 2)
+	a, b := nodes[0], nodes[1]
+	hour := int64(time.Hour)
+	for _, r := range nodes {
+		setClock(r, 100*hour)
+	}
+	a.Apply([]record_store.StoreOp{
+		{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.1"},
+		{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.2"},
+		{Type: record_store.StoreSetMeta, DnsType: 1, Key: "foo.bar.", Val: `{"ttl":60}`},
+		{Type: record_store.StorePut, DnsType: 1, Key: "old.bar.", Val: "127.0.0.3"},
+	})
+	a.Apply([]record_store.StoreOp{
+		{Type: record_store.StoreDelVal, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.2"},
+		{Type: record_store.StoreSetMeta, DnsType: 1, Key: "foo.bar.", Val: ""},
+		{Type: record_store.StoreDelKey, DnsType: 1, Key: "old.bar."},
+	})
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1"}})
+	tombstones := func(r *PeerRecordStore) (n int) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		n = len(r.keyDels)
+		for _, vals := range r.vals {
+			for _, e := range vals {
+				if e.Deleted {
+					n++
+				}
+			}
+		}
+		for _, e := range r.metas {
+			if e.Meta == "" {
+				n++
+			}
+		}
+		return
+	}
+	for i, r := range nodes {
+		if n := tombstones(r); n != 3 {
+			t.Errorf("node%d has %d tombstones -- expected 3", i, n)
+		}
+	}
+
+	// Still remembered within the period. Once past it, a has forgotten them, and b sending
+	// them again doesn't bring them back
+	for _, r := range nodes {
+		setClock(r, 123*hour)
+	}
+	a.mu.Lock()
+	a.gc()
+	a.mu.Unlock()
+	if n := tombstones(a); n != 3 {
+		t.Errorf("Got %d tombstones within the period -- expected 3", n)
+	}
+	setClock(a, 125*hour)
+	a.mu.Lock()
+	a.gc()
+	a.mu.Unlock()
+	b.sync("node0")
+	if n := tombstones(a); n != 0 {
+		t.Errorf("Got %d tombstones after the period -- expected none", n)
+	}
+	setClock(b, 125*hour)
+	b.syncAll()
+	for i, r := range nodes {
+		if n := tombstones(r); n != 0 {
+			t.Errorf("node%d has %d tombstones after the period -- expected none", i, n)
+		}
+	}
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1"}})
+	if a.digest() != b.digest() {
+		t.Error("Copies differ after forgetting deletes")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	nodes, _ := newCluster(t, 2)
+	a, b := nodes[0], nodes[1]
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notices := make(chan record_set.StoreNotice, 10)
+	go b.Watch(ctx, func(n record_set.StoreNotice) { notices <- n })
+	go a.Watch(ctx, func(n record_set.StoreNotice) { t.Error("Got our own notice", n) })
+	time.Sleep(10 * time.Millisecond) // For the watchers to start
+
+	key := record_store.StoreKey{DnsType: 1, Key: "foo.bar."}
+	a.PutVal(1, "foo.bar.", "127.0.0.1")
+	a.Notify(record_set.StoreNotice{Keys: []record_store.StoreKey{key}})
+	a.pushing.Wait()
+	a.Clear()
+	a.pushing.Wait()
+	var got []record_set.StoreNotice
+	for len(got) < 3 {
+		select {
+		case n := <-notices:
+			got = append(got, n)
+		case <-time.After(time.Second):
+			t.Fatalf("Got notices %v -- expected 3", got)
+		}
+	}
+	for i, n := range got[:2] {
+		if len(n.Keys) != 1 || n.Keys[0] != key {
+			t.Errorf("Got notice %d %v -- expected %v", i, n, key)
+		}
+	}
+	if !got[2].Reset {
+		t.Errorf("Got notice %v after Clear() -- expected a reset", got[2])
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	t1, t2 := newHttpTransport("secret"), newHttpTransport("secret")
+	nodes := make([]*PeerRecordStore, 2)
+	srv1 := httptest.NewServer(t1.handler(func(m *Message) *Message { return nodes[0].Handle(m) }))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(t2.handler(func(m *Message) *Message { return nodes[1].Handle(m) }))
+	defer srv2.Close()
+	addr1, addr2 := strings.TrimPrefix(srv1.URL, "http://"), strings.TrimPrefix(srv2.URL, "http://")
+	nodes[0] = newStore([]string{addr2}, t1, time.Hour)
+	defer nodes[0].Close()
+	nodes[1] = newStore([]string{addr1}, t2, time.Hour)
+	defer nodes[1].Close()
+	nodes[0].PutVal(1, "foo.bar.", "127.0.0.1")
+	expectEverywhere(t, nodes, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1"}})
+	if err := nodes[0].sync(addr2); err != nil {
+		t.Error("sync()", err)
+	}
+
+	for _, secret := range []string{"", "wrong"} {
+		if _, err := newHttpTransport(secret).Send(addr2, &Message{Digest: "x"}); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("Send() with secret %q returned %v -- expected 403", secret, err)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	if _, err := Create("127.0.0.1:bogus"); err == nil {
+		t.Error("Create() with a bad listen address succeeded")
+	}
+	if _, err := Create("127.0.0.1:0,127.0.0.1:1"); err == nil {
+		t.Error("Create() without a secret succeeded")
+	}
+	r, err := Create("127.0.0.1:0,127.0.0.1:1,interval=1h,secret=s")
+	if err != nil {
+		t.Fatal("Create()", err)
+	}
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	rstest.ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1")
+	r.Close()
+}
@@ -0,0 +1,76 @@
+package peer_rs
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	REPLICATE_PATH = "/replicate"
+	MAX_MESSAGE    = 64 << 20 // Bytes. A whole copy of the records has to fit
+)
+
+// Messages are POSTed as JSON to REPLICATE_PATH, and answered the same way
+type httpTransport struct {
+	client *http.Client
+	secret string
+}
+
+func newHttpTransport(secret string) *httpTransport {
+	return &httpTransport{client: &http.Client{Timeout: REQUEST_TIMEOUT}, secret: secret}
+}
+
+func (t *httpTransport) Send(peer string, msg *Message) (*Message, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", "http://"+peer+REPLICATE_PATH, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+t.secret)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	reply := &Message{}
+	if err = json.NewDecoder(http.MaxBytesReader(nil, resp.Body, MAX_MESSAGE)).Decode(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Serve messages from peers to handle
+func (t *httpTransport) handler(handle func(*Message) *Message) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != REPLICATE_PATH || req.Method != "POST" {
+			http.NotFound(w, req)
+			return
+		}
+		if t.secret != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+t.secret)) != 1 {
+			http.Error(w, "invalid peer secret", http.StatusForbidden)
+			return
+		}
+		msg := &Message{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MAX_MESSAGE)).Decode(msg); err != nil {
+			http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(handle(msg))
+	})
+}
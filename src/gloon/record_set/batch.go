@@ -0,0 +1,152 @@
+package record_set
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	. "gloon/record_store"
+	"log"
+)
+
+// Kind of change made to a record by RecordSet.Apply
+type ChangeType int
+
+const (
+	ChangePut    ChangeType = iota // Add Val to the record
+	ChangeDelVal                   // Remove Val from the record
+	ChangeSource                   // Make Val the source of the record. Empty removes the source
+	ChangeTtl                      // Make Ttl the TTL of the record. nil goes back to the server TTL
+)
+
+type Change struct {
+	Type    ChangeType
+	DnsType uint16
+	Host    string
+	Val     string
+	Ttl     *uint32 // For ChangeTtl
+	Source  string  // Tagged on the change event, instead of the record set's source
+}
+
+// Apply changes atomically. PTR records are kept up to date as with Put and DelAddr. Unlike
+// DelAddr, removing the last value leaves the source and TTL alone, so include a ChangeSource and
+// ChangeTtl as needed
+func (r *RecordSet) Apply(changes []Change) (err error) {
+	r.writes.Lock()
+	defer r.writes.Unlock()
+	return r.apply(changes)
+}
+
+// Work out changes with plan, from what it reads of the record set, and apply them. No other
+// change made through this record set (or one from WithSource) can come in between. Instances
+// sharing a store don't coordinate, so one may still change a record plan has read. plan returns
+// no changes to leave the record set as it is
+func (r *RecordSet) Update(plan func() ([]Change, error)) (err error) {
+	r.writes.Lock()
+	defer r.writes.Unlock()
+	changes, err := plan()
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	return r.apply(changes)
+}
+
+func (r *RecordSet) apply(changes []Change) (err error) {
+	var ops []StoreOp
+	// Metadata changes are gathered per record, and stored after the values
+	metas := make(map[StoreKey]*RecordMeta)
+	var metaKeys []StoreKey
+	meta := func(dnsType uint16, key string) (*RecordMeta, error) {
+		k := StoreKey{DnsType: dnsType, Key: key}
+		if m, ok := metas[k]; ok {
+			return m, nil
+		}
+		s, err := r.store.GetMeta(dnsType, key)
+		if err != nil {
+			return nil, err
+		}
+		m := ParseMeta(s)
+		metas[k] = &m
+		metaKeys = append(metaKeys, k)
+		return &m, nil
+	}
+	var ttlChanged []bool
+	for _, c := range changes {
+		key := c.Host + "."
+		switch c.Type {
+		case ChangePut:
+			ops = append(ops, StoreOp{Type: StorePut, DnsType: c.DnsType, Key: key, Val: c.Val})
+			if raddr := ptrAddr(c.DnsType, c.Val); raddr != "" {
+				ops = append(ops, StoreOp{Type: StorePut, DnsType: dns.TypePTR, Key: raddr, Val: c.Host})
+			}
+		case ChangeDelVal:
+			ops = append(ops, StoreOp{Type: StoreDelVal, DnsType: c.DnsType, Key: key, Val: c.Val})
+			if raddr := ptrAddr(c.DnsType, c.Val); raddr != "" {
+				ops = append(ops, StoreOp{Type: StoreDelVal, DnsType: dns.TypePTR, Key: raddr, Val: c.Host})
+			}
+		case ChangeSource:
+			m, err := meta(c.DnsType, key)
+			if err != nil {
+				return err
+			}
+			m.Source = c.Val
+		case ChangeTtl:
+			m, err := meta(c.DnsType, key)
+			if err != nil {
+				return err
+			}
+			ttlChanged = append(ttlChanged, !SameTtl(m.Ttl, c.Ttl))
+			m.Ttl = c.Ttl
+		default:
+			return fmt.Errorf("Unknown change type %d", c.Type)
+		}
+	}
+	for _, k := range metaKeys {
+		ops = append(ops, StoreOp{Type: StoreSetMeta, DnsType: k.DnsType, Key: k.Key, Val: metas[k].encode()})
+	}
+	log.Printf("Applying %d changes (%d store operations)", len(changes), len(ops))
+	if err = r.store.Apply(ops); err != nil {
+		log.Printf("Unable to apply changes: %s", err.Error())
+		return
+	}
+	var events []Event
+	for _, c := range changes {
+		r.rr_indexes.Del(c.DnsType, c.Host)
+		ev := Event{Source: r.source, DnsType: c.DnsType, Host: c.Host, Val: c.Val}
+		if c.Source != "" {
+			ev.Source = c.Source
+		}
+		switch c.Type {
+		case ChangePut:
+			ev.Op = EventPut
+		case ChangeDelVal:
+			ev.Op = EventDel
+		case ChangeTtl:
+			changed := ttlChanged[0]
+			ttlChanged = ttlChanged[1:]
+			if !changed {
+				continue
+			}
+			ev.Op, ev.Val = EventTtl, ttlVal(c.Ttl)
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	keys := make([]StoreKey, len(ops))
+	for i, op := range ops {
+		keys[i] = StoreKey{DnsType: op.DnsType, Key: op.Key}
+	}
+	r.changed(events, keys...)
+	return
+}
+
+// Reverse lookup key for address records, empty for anything else
+func ptrAddr(dnsType uint16, val string) string {
+	if !hasPtr(dnsType) {
+		return ""
+	}
+	raddr, _ := ReverseAddr(val)
+	if raddr == "" {
+		return ""
+	}
+	return raddr + "."
+}
@@ -0,0 +1,157 @@
+package record_set
+
+import (
+	. "gloon/record_store"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of record change
+const (
+	EventPut = "put" // Val was added to the record
+	EventDel = "del" // Val was removed from the record
+	EventTtl = "ttl" // The record's TTL changed to Val. Empty if it went back to the server TTL
+	// Changes made by other instances sharing the store may have been missed. Only Seq is set.
+	// Subscribers should read the records again rather than rely on the changes they have seen
+	EventReset = "reset"
+)
+
+// A change to a single record value. Seq numbers are given in order, starting at 1, and are only
+// meaningful within this process
+type Event struct {
+	Seq     uint64
+	Op      string
+	Source  string // Publisher of the change (ex. "docker", "api"). May be empty
+	DnsType uint16
+	Host    string
+	Val     string
+}
+
+// Recent events kept for subscribers that resume from a sequence number
+const EVENT_HISTORY = 1024
+
+// Events a subscriber can fall behind by before it is dropped
+const eventBuffer = 256
+
+type eventHub struct {
+	sync.Mutex
+	seq     uint64
+	history []Event // Oldest first
+	subs    map[*Subscription]bool
+}
+
+// Receives events as records change. C is closed on Unsubscribe, or if the subscriber falls too
+// far behind
+type Subscription struct {
+	C   <-chan Event
+	Seq uint64 // Last event sent before the subscription started
+	c   chan Event
+	hub *eventHub
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*Subscription]bool)}
+}
+
+func (h *eventHub) emit(events []Event) {
+	h.Lock()
+	defer h.Unlock()
+	for _, ev := range events {
+		h.seq++
+		ev.Seq = h.seq
+		h.history = append(h.history, ev)
+		if len(h.history) > EVENT_HISTORY {
+			h.history = h.history[len(h.history)-EVENT_HISTORY:]
+		}
+		for sub := range h.subs {
+			select {
+			case sub.c <- ev:
+			default:
+				delete(h.subs, sub)
+				close(sub.c)
+			}
+		}
+	}
+}
+
+// Start receiving events
+func (r *RecordSet) Subscribe() (sub *Subscription) {
+	h := r.events
+	h.Lock()
+	defer h.Unlock()
+	c := make(chan Event, eventBuffer)
+	sub = &Subscription{C: c, Seq: h.seq, c: c, hub: h}
+	h.subs[sub] = true
+	return
+}
+
+// Stop receiving events. C is closed
+func (sub *Subscription) Unsubscribe() {
+	h := sub.hub
+	h.Lock()
+	defer h.Unlock()
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Events after seq up to the start of the subscription, to catch up a client that was disconnected.
+// ok is false if some of them are no longer kept, or seq is from the future (ex. before a restart)
+func (sub *Subscription) Since(seq uint64) (events []Event, ok bool) {
+	h := sub.hub
+	h.Lock()
+	defer h.Unlock()
+	if seq > sub.Seq {
+		return nil, false
+	}
+	if seq == sub.Seq {
+		return nil, true
+	}
+	if len(h.history) == 0 || h.history[0].Seq > seq+1 {
+		return nil, false
+	}
+	for _, ev := range h.history {
+		if ev.Seq > seq && ev.Seq <= sub.Seq {
+			events = append(events, ev)
+		}
+	}
+	return events, true
+}
+
+// A copy of the record set that tags the events for its changes with source
+func (r *RecordSet) WithSource(source string) *RecordSet {
+	return &RecordSet{store: r.store, rr_indexes: r.rr_indexes, source: source, events: r.events, writes: r.writes}
+}
+
+func (r *RecordSet) emit(op string, dnsType uint16, host string, vals ...string) {
+	events := make([]Event, len(vals))
+	for i, v := range vals {
+		events[i] = Event{Op: op, Source: r.source, DnsType: dnsType, Host: host, Val: v}
+	}
+	r.changed(events)
+}
+
+// Every record in the store, sorted by name and type, with hosts as given to Put
+func (r *RecordSet) All() (records []StoreRecord, err error) {
+	all, err := r.store.All()
+	if err != nil {
+		return
+	}
+	for _, rec := range all {
+		if len(rec.Vals) == 0 {
+			continue
+		}
+		rec.Key = strings.TrimSuffix(rec.Key, ".")
+		sort.Strings(rec.Vals)
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Key != records[j].Key {
+			return records[i].Key < records[j].Key
+		}
+		return records[i].DnsType < records[j].DnsType
+	})
+	return
+}
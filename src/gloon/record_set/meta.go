@@ -0,0 +1,115 @@
+package record_set
+
+import (
+	"encoding/json"
+	. "gloon/record_store"
+	"log"
+	"strconv"
+)
+
+// What we keep about a record besides its values. Stores keep it as an opaque string next to the
+// record's values, see StoreSetMeta
+type RecordMeta struct {
+	Ttl    *uint32 `json:"ttl,omitempty"`    // Overrides the server TTL
+	Source string  `json:"source,omitempty"` // Whoever published the record (ex. "api")
+}
+
+// The string stored for meta. Empty if nothing is set, so the store can drop it
+func (meta RecordMeta) encode() string {
+	if meta == (RecordMeta{}) {
+		return ""
+	}
+	data, _ := json.Marshal(meta)
+	return string(data)
+}
+
+// Metadata as stored. Anything we can't read is ignored, so the record is still served
+func ParseMeta(s string) (meta RecordMeta) {
+	if s == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(s), &meta); err != nil {
+		log.Printf("Ignoring invalid record metadata %q: %s", s, err.Error())
+	}
+	return
+}
+
+// Whether two TTLs are the same, nil being the server TTL
+func SameTtl(a, b *uint32) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// Metadata of exactly host. Like Values, wildcards are not considered
+func (r *RecordSet) Meta(dnsType uint16, host string) (meta RecordMeta, err error) {
+	s, err := r.store.GetMeta(dnsType, host+".")
+	return ParseMeta(s), err
+}
+
+// Set the TTL of a record, which overrides the server TTL for all its values. nil goes back to the
+// server TTL. The TTL goes with the record's last value
+func (r *RecordSet) SetTtl(dnsType uint16, host string, ttl *uint32) (err error) {
+	return r.Apply([]Change{{Type: ChangeTtl, DnsType: dnsType, Host: host, Ttl: ttl}})
+}
+
+// Make source the source of a record, replacing any previous one. Empty removes it. The source
+// goes with the record's last value
+func (r *RecordSet) SetSource(dnsType uint16, host, source string) (err error) {
+	return r.Apply([]Change{{Type: ChangeSource, DnsType: dnsType, Host: host, Val: source}})
+}
+
+// Source of a record. Empty if none was set
+func (r *RecordSet) Source(dnsType uint16, host string) (source string, err error) {
+	meta, err := r.Meta(dnsType, host)
+	return meta.Source, err
+}
+
+// TTL of the record Get and GetAll answer for host with. ok is false if it has none, and the
+// server TTL applies
+func (r *RecordSet) Ttl(dnsType uint16, host string) (ttl uint32, ok bool) {
+	key, _, err := r.lookup(dnsType, host)
+	if err != nil || key == "" {
+		return
+	}
+	s, err := r.store.GetMeta(dnsType, key)
+	if err != nil {
+		log.Printf("Unable to fetch record metadata: %s", err.Error())
+		return
+	}
+	if meta := ParseMeta(s); meta.Ttl != nil {
+		return *meta.Ttl, true
+	}
+	return
+}
+
+// Drop the metadata of a record that has no values left. The caller tells other instances about
+// the key, along with the values it removed
+func (r *RecordSet) delMeta(dnsType uint16, host string) (err error) {
+	if vals, err := r.store.GetAll(dnsType, host+"."); err != nil || len(vals) > 0 {
+		return err
+	}
+	if s, err := r.store.GetMeta(dnsType, host+"."); err != nil || s == "" {
+		return err
+	}
+	return r.store.Apply([]StoreOp{{Type: StoreSetMeta, DnsType: dnsType, Key: host + "."}})
+}
+
+// Event value for a TTL change
+func ttlVal(ttl *uint32) string {
+	if ttl == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*ttl), 10)
+}
+
+// The TTL an EventTtl event sets. nil if it goes back to the server TTL
+func (ev Event) NewTtl() *uint32 {
+	if ev.Op != EventTtl || ev.Val == "" {
+		return nil
+	}
+	n, err := strconv.ParseUint(ev.Val, 10, 32)
+	if err != nil {
+		return nil
+	}
+	ttl := uint32(n)
+	return &ttl
+}
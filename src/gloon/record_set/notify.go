@@ -0,0 +1,61 @@
+package record_set
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	. "gloon/record_store"
+	"log"
+	"strings"
+)
+
+// Sent to other processes sharing a store after a RecordSet changes it
+type StoreNotice struct {
+	Keys   []StoreKey // Keys that changed, values or metadata, including PTR keys
+	Events []Event    // Change events for the records. Receivers give them their own Seq
+	Reset  bool       // Notices may have been missed (ex. after a reconnect), so anything derived from the store is suspect
+}
+
+// Implemented by stores that several processes can share
+type StoreNotifier interface {
+	Notify(n StoreNotice) error                            // Tell the other processes about a change
+	Watch(ctx context.Context, fn func(StoreNotice)) error // Call fn with notices from other processes until ctx is done
+}
+
+// Emit events for a change, and tell other processes sharing the store. Keys touched by events
+// are worked out from them, keys is for anything else
+func (r *RecordSet) changed(events []Event, keys ...StoreKey) {
+	r.events.emit(events)
+	n, ok := r.store.(StoreNotifier)
+	if !ok {
+		return
+	}
+	for _, ev := range events {
+		keys = append(keys, StoreKey{DnsType: ev.DnsType, Key: ev.Host + "."})
+		if raddr := ptrAddr(ev.DnsType, ev.Val); raddr != "" {
+			keys = append(keys, StoreKey{DnsType: dns.TypePTR, Key: raddr})
+		}
+	}
+	if err := n.Notify(StoreNotice{Keys: keys, Events: events}); err != nil {
+		log.Printf("Unable to notify other instances of changes: %s", err.Error())
+	}
+}
+
+// Pass on changes made by other processes sharing the store to our subscribers, until ctx is done.
+// Returns at once for stores that aren't shared
+func (r *RecordSet) Watch(ctx context.Context) error {
+	n, ok := r.store.(StoreNotifier)
+	if !ok {
+		return nil
+	}
+	return n.Watch(ctx, func(notice StoreNotice) {
+		if notice.Reset {
+			r.rr_indexes.Clear()
+			r.events.emit([]Event{{Op: EventReset}})
+		}
+		for _, k := range notice.Keys {
+			r.rr_indexes.Del(k.DnsType, k.Key)
+			r.rr_indexes.Del(k.DnsType, strings.TrimSuffix(k.Key, "."))
+		}
+		r.events.emit(notice.Events)
+	})
+}
@@ -3,6 +3,7 @@ package record_set
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	. "gloon/record_store"
 	"log"
 	"net"
 	"sort"
@@ -18,6 +19,9 @@ type RecordStore interface {
 	DelKey(dnsType uint16, key string) error             // Deletes key and all values for a
 	DelVal(dnsType uint16, key, value string) error      // Deletes a single value from a key. Deletes key ifthere are no more values
 	Clear() error                                        // Clear all keys from set
+	Apply(ops []StoreOp) error                           // Apply all ops, or none of them
+	All() ([]StoreRecord, error)                         // List every key and its values
+	GetMeta(dnsType uint16, key string) (string, error)  // Metadata of a key, empty if none. See StoreSetMeta
 }
 
 type RrIndexes struct {
@@ -54,45 +58,67 @@ func (rri *RrIndexes) Del(dnsType uint16, key string) {
 	delete(rri.indexes, kp)
 }
 
+// Forget every index, so round robin starts over
+func (rri *RrIndexes) Clear() {
+	rri.Lock()
+	defer rri.Unlock()
+	rri.indexes = make(map[string]int)
+}
+
 type RecordSet struct {
 	store      RecordStore
 	rr_indexes *RrIndexes
+	source     string // Tagged on events. See WithSource
+	events     *eventHub
+	writes     *sync.Mutex // Held while changing the store, so Update sees no changes but its own
 }
 
 func Create(store RecordStore) (rs *RecordSet) {
-	rs = &RecordSet{store, &RrIndexes{indexes: make(map[string]int)}}
+	rs = &RecordSet{store: store, rr_indexes: &RrIndexes{indexes: make(map[string]int)}, events: newEventHub(), writes: &sync.Mutex{}}
 	return
 }
 
-func (r *RecordSet) Put(dnsType uint16, host, addr string) {
+func (r *RecordSet) Put(dnsType uint16, host, addr string) (err error) {
+	r.writes.Lock()
+	defer r.writes.Unlock()
 	log.Printf("Adding/updating  %X %s A %s", dnsType, host, addr)
-	err := r.store.PutVal(dnsType, host+".", addr)
+	had, herr := r.hasVal(dnsType, host, addr)
+	err = r.store.PutVal(dnsType, host+".", addr)
 	if err != nil {
 		log.Printf("Unable to put primary record: %s", err.Error())
 		return
 	}
+	if !had || herr != nil {
+		r.emit(EventPut, dnsType, host, addr)
+	}
 	// For A or AAAA records, put in reverse DNS
-	if dnsType == dns.TypeA || dnsType == dns.TypeAAAA {
+	if hasPtr(dnsType) {
 		raddr, _ := ReverseAddr(addr)
 		if raddr != "" {
 			log.Printf("Adding %s PTR %s", raddr, host)
-			err = r.store.PutVal(dns.TypePTR, raddr+".", host)
-			if err != nil {
-				log.Printf("Error %s addting PTR record %s => %s", raddr, host)
+			if err := r.store.PutVal(dns.TypePTR, raddr+".", host); err != nil {
+				log.Printf("Error %s addting PTR record %s => %s", err.Error(), raddr, host)
 			}
 		}
 	}
+	return
 }
 
-func (r *RecordSet) Del(dnsType uint16, host string) {
+func (r *RecordSet) Del(dnsType uint16, host string) (err error) {
+	r.writes.Lock()
+	defer r.writes.Unlock()
 	log.Printf("Removing %X  %s", dnsType, host)
 	addrs, err := r.store.GetAll(dnsType, host+".")
 	if err != nil {
 		log.Printf("Unable to fetch address for host %s -- %s", host, err.Error())
 	}
 	for _, addr := range addrs {
+		if !hasPtr(dnsType) {
+			break
+		}
+		// Only our own reverse record. Other names may share the address
 		raddr, _ := ReverseAddr(addr)
-		err = r.store.DelKey(dns.TypePTR, raddr+".")
+		err = r.store.DelVal(dns.TypePTR, raddr+".", host)
 		if err != nil {
 			log.Printf("Unable to remove PTR record %s -- %s", raddr, err.Error())
 		}
@@ -100,54 +126,103 @@ func (r *RecordSet) Del(dnsType uint16, host string) {
 	err = r.store.DelKey(dnsType, host+".")
 	if err != nil {
 		log.Printf("Unable to remove host key %s (%s)", host, err.Error())
+		return
+	}
+	if err := r.delMeta(dnsType, host); err != nil {
+		log.Printf("Unable to remove metadata of %s -- %s", host, err.Error())
 	}
+	r.emit(EventDel, dnsType, host, addrs...)
 	r.rr_indexes.Del(dnsType, host)
+	return
 }
 
-func (r *RecordSet) DelAddr(dnsType uint16, host, addr string) {
+func (r *RecordSet) DelAddr(dnsType uint16, host, addr string) (err error) {
+	r.writes.Lock()
+	defer r.writes.Unlock()
 	log.Printf("Removing %X  %s %s", dnsType, host, addr)
-	err := r.store.DelVal(dnsType, host+".", addr)
+	had, herr := r.hasVal(dnsType, host, addr)
+	err = r.store.DelVal(dnsType, host+".", addr)
 	if err != nil {
 		log.Printf("Unable to delete  address %s for host %s -- %s", addr, host, err.Error())
 		return
 	}
-	raddr, _ := ReverseAddr(addr)
-	err = r.store.DelKey(dns.TypePTR, raddr+".")
-	if err != nil {
-		log.Printf("Unable to remove PTR record %s -- %s", raddr, err.Error())
+	// Metadata (TTL and source) goes with the last value
+	if err := r.delMeta(dnsType, host); err != nil {
+		log.Printf("Unable to remove metadata of %s -- %s", host, err.Error())
+	}
+	if had || herr != nil {
+		r.emit(EventDel, dnsType, host, addr)
+	}
+	if hasPtr(dnsType) {
+		raddr, _ := ReverseAddr(addr)
+		if err := r.store.DelVal(dns.TypePTR, raddr+".", host); err != nil {
+			log.Printf("Unable to remove PTR record %s -- %s", raddr, err.Error())
+		}
 	}
 	r.rr_indexes.Del(dnsType, host)
+	return
+}
+
+// Whether addr is stored for host, so writes that change nothing aren't reported. When the store
+// can't tell, callers report the change anyway
+func (r *RecordSet) hasVal(dnsType uint16, host, addr string) (bool, error) {
+	vals, err := r.store.GetAll(dnsType, host+".")
+	for _, v := range vals {
+		if v == addr {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// Values stored for exactly host, sorted. Unlike GetAll, wildcards are not considered
+func (r *RecordSet) Values(dnsType uint16, host string) (vals []string, err error) {
+	vals, err = r.store.GetAll(dnsType, host+".")
+	sort.Strings(vals)
+	return
+}
+
+// Get all values for a host, sorted. Wildcards are considered as with Get
+func (r *RecordSet) GetAll(dnsType uint16, host string) (vals []string) {
+	_, vals, err := r.lookup(dnsType, host)
+	if err != nil {
+		log.Printf("Unable to fetch values: %s", err.Error())
+		return
+	}
+	sort.Strings(vals)
+	return
 }
 
 func (r *RecordSet) Get(dnsType uint16, host string) (addr string) {
-	addrs, err := r.store.GetAll(dnsType, host)
+	_, addrs, err := r.lookup(dnsType, host)
 	if err != nil {
 		log.Printf("Unable to fetch value: %s", err.Error())
 		return
 	}
-	if len(addrs) == 0 { // Try a wildcard
-		parts := strings.SplitN(host, ".", 2)
-		if len(parts) == 2 {
-			wc := "*." + parts[1]
-			addrs, err = r.store.GetAll(dnsType, wc)
-			if err != nil {
-				log.Printf("Unable to fetch value: %s", err.Error())
-				return
-			}
-		}
-	}
-	if len(addrs) == 0 { // Try adouble wildcard
-		parts := strings.SplitN(host, ".", 3)
-		if len(parts) == 3 {
-			wc := "*.*." + parts[2]
-			addrs, err = r.store.GetAll(dnsType, wc)
-			if err != nil {
-				log.Printf("Unable to fetch value: %s", err.Error())
-				return
-			}
+	return r.rr_indexes.NextVal(dnsType, host, addrs)
+}
+
+// Fetch values for host, falling back to wildcard and double wildcard records. key is the one the
+// values were found under, empty if there are none
+func (r *RecordSet) lookup(dnsType uint16, host string) (key string, addrs []string, err error) {
+	keys := []string{host}
+	if parts := strings.SplitN(host, ".", 2); len(parts) == 2 { // Try a wildcard
+		keys = append(keys, "*."+parts[1])
+	}
+	if parts := strings.SplitN(host, ".", 3); len(parts) == 3 { // Try adouble wildcard
+		keys = append(keys, "*.*."+parts[2])
+	}
+	for _, key = range keys {
+		if addrs, err = r.store.GetAll(dnsType, key); err != nil || len(addrs) > 0 {
+			return
 		}
 	}
-	return r.rr_indexes.NextVal(dnsType, host, addrs)
+	return "", addrs, nil
+}
+
+// Only address records get reverse dns entries
+func hasPtr(dnsType uint16) bool {
+	return dnsType == dns.TypeA || dnsType == dns.TypeAAAA
 }
 
 // Taken somewhat from stdlib dnsclient.go
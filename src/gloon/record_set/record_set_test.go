@@ -1,9 +1,16 @@
 package record_set
 
 import (
+	"context"
+	"fmt"
 	"github.com/miekg/dns"
 	"gloon/mem_rs"
+	. "gloon/record_store"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAll(t *testing.T) {
@@ -69,3 +76,274 @@ func TestAll(t *testing.T) {
 	}
 	rs.Del(dns.TypeA, "test.example.com")
 }
+
+func TestTxt(t *testing.T) {
+	r := mem_rs.Create()
+	r.Clear()
+	rs := Create(r)
+	rs.Put(dns.TypeTXT, "test.example.com", "image=nginx")
+	rs.Put(dns.TypeTXT, "test.example.com", "id=0123456789")
+	vals := rs.GetAll(dns.TypeTXT, "test.example.com.")
+	if len(vals) != 2 || vals[0] != "id=0123456789" || vals[1] != "image=nginx" {
+		t.Errorf("rs.GetAll() unexpected values: %#v", vals)
+	}
+	rs.DelAddr(dns.TypeTXT, "test.example.com", "image=nginx")
+	if vals = rs.GetAll(dns.TypeTXT, "test.example.com."); len(vals) != 1 {
+		t.Errorf("rs.GetAll() unexpected values: %#v", vals)
+	}
+	rs.Del(dns.TypeTXT, "test.example.com")
+	if vals = rs.GetAll(dns.TypeTXT, "test.example.com."); len(vals) != 0 {
+		t.Errorf("rs.GetAll() unexpected values: %#v", vals)
+	}
+}
+
+func TestTtl(t *testing.T) {
+	r := mem_rs.Create()
+	r.Clear()
+	rs := Create(r)
+	rs.Put(dns.TypeA, "ttl.example.com", "10.0.0.1")
+	if _, ok := rs.Ttl(dns.TypeA, "ttl.example.com."); ok {
+		t.Error("rs.Ttl() found a TTL that was never set")
+	}
+	sub := rs.Subscribe()
+	defer sub.Unsubscribe()
+	ttl := uint32(300)
+	rs.SetTtl(dns.TypeA, "ttl.example.com", &ttl)
+	if ev := <-sub.C; ev.Op != EventTtl || ev.NewTtl() == nil || *ev.NewTtl() != 300 {
+		t.Errorf("Got event %+v -- expected a TTL of 300", ev)
+	}
+	// The TTL is kept apart from the values, so the same address with a new TTL is still one value
+	ttl = 60
+	rs.SetTtl(dns.TypeA, "ttl.example.com", &ttl)
+	rs.Put(dns.TypeA, "ttl.example.com", "10.0.0.1")
+	if vals := rs.GetAll(dns.TypeA, "ttl.example.com."); len(vals) != 1 || vals[0] != "10.0.0.1" {
+		t.Errorf("rs.GetAll() unexpected values: %v", vals)
+	}
+	if got, ok := rs.Ttl(dns.TypeA, "ttl.example.com."); !ok || got != 60 {
+		t.Errorf("rs.Ttl() unexpected values: %d %v", got, ok)
+	}
+	if host := rs.Get(dns.TypePTR, "1.0.0.10.in-addr.arpa."); host != "ttl.example.com" {
+		t.Errorf("rs.Get() unexepected value: %s -- expected ttl.example.com", host)
+	}
+	// Wildcard answers use the wildcard's TTL
+	rs.Put(dns.TypeA, "*.wild.example.com", "10.0.0.2")
+	rs.SetTtl(dns.TypeA, "*.wild.example.com", &ttl)
+	if got, ok := rs.Ttl(dns.TypeA, "foo.wild.example.com."); !ok || got != 60 {
+		t.Errorf("rs.Ttl() of a wildcard unexpected values: %d %v", got, ok)
+	}
+	// The TTL goes with the last value
+	rs.DelAddr(dns.TypeA, "ttl.example.com", "10.0.0.1")
+	if meta, _ := rs.Meta(dns.TypeA, "ttl.example.com"); meta.Ttl != nil {
+		t.Errorf("TTL %d outlived the record", *meta.Ttl)
+	}
+}
+
+func TestSource(t *testing.T) {
+	rs := Create(mem_rs.Create())
+	rs.Put(dns.TypeA, "web.test", "10.0.0.1")
+	ttl := uint32(60)
+	rs.SetTtl(dns.TypeA, "web.test", &ttl)
+	rs.SetSource(dns.TypeA, "web.test", "api")
+	if source, err := rs.Source(dns.TypeA, "web.test"); err != nil || source != "api" {
+		t.Errorf("rs.Source() returned %q, %v -- expected api", source, err)
+	}
+	// Sources are record metadata, kept with the TTL rather than as records of their own
+	recs, _ := rs.All()
+	if len(recs) != 2 || ParseMeta(recs[1].Meta).Source != "api" || ParseMeta(recs[1].Meta).Ttl == nil {
+		t.Errorf("All() returned %+v", recs)
+	}
+	if source, _ := rs.Source(dns.TypeTXT, "web.test"); source != "" {
+		t.Errorf("Got source %q for a record of another type", source)
+	}
+	rs.DelAddr(dns.TypeA, "web.test", "10.0.0.1")
+	if source, _ := rs.Source(dns.TypeA, "web.test"); source != "" {
+		t.Errorf("Source %q outlived the record", source)
+	}
+}
+
+// Updates see the changes made before them, and nothing comes between an update's reads and its changes
+func TestUpdate(t *testing.T) {
+	rs := Create(mem_rs.Create())
+	rs.Put(dns.TypeTXT, "counter.test", "0")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs.WithSource("api").Update(func() ([]Change, error) {
+				vals, err := rs.Values(dns.TypeTXT, "counter.test")
+				if err != nil || len(vals) != 1 {
+					return nil, fmt.Errorf("Got %v, %v", vals, err)
+				}
+				n, _ := strconv.Atoi(vals[0])
+				return []Change{
+					{Type: ChangeDelVal, DnsType: dns.TypeTXT, Host: "counter.test", Val: vals[0]},
+					{Type: ChangePut, DnsType: dns.TypeTXT, Host: "counter.test", Val: strconv.Itoa(n + 1)},
+				}, nil
+			})
+			// Plain writes wait for updates too
+			rs.Put(dns.TypeTXT, "other.test", "x")
+		}()
+	}
+	wg.Wait()
+	if vals, _ := rs.Values(dns.TypeTXT, "counter.test"); len(vals) != 1 || vals[0] != "20" {
+		t.Errorf("Got %v after 20 updates -- expected [20]", vals)
+	}
+	if err := rs.Update(func() ([]Change, error) { return nil, fmt.Errorf("planning failed") }); err == nil {
+		t.Error("Update() hid the plan's error")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	rs := Create(mem_rs.Create())
+	rs.Put(dns.TypeA, "old.test", "10.0.0.9")
+	sub := rs.WithSource("docker").Subscribe()
+	defer sub.Unsubscribe()
+	rs.WithSource("docker").Put(dns.TypeA, "web.test", "10.0.0.1")
+	rs.Put(dns.TypeA, "web.test", "10.0.0.2")
+	rs.Put(dns.TypeA, "web.test", "10.0.0.2") // No change, no event
+	rs.DelAddr(dns.TypeA, "web.test", "10.0.0.1")
+	rs.DelAddr(dns.TypeA, "web.test", "10.0.0.1")
+	rs.Apply([]Change{{Type: ChangePut, DnsType: dns.TypeTXT, Host: "web.test", Val: "a", Source: "api"}})
+	rs.Del(dns.TypeA, "web.test")
+	expected := []Event{
+		{Seq: 2, Op: EventPut, Source: "docker", DnsType: dns.TypeA, Host: "web.test", Val: "10.0.0.1"},
+		{Seq: 3, Op: EventPut, DnsType: dns.TypeA, Host: "web.test", Val: "10.0.0.2"},
+		{Seq: 4, Op: EventDel, DnsType: dns.TypeA, Host: "web.test", Val: "10.0.0.1"},
+		{Seq: 5, Op: EventPut, Source: "api", DnsType: dns.TypeTXT, Host: "web.test", Val: "a"},
+		{Seq: 6, Op: EventDel, DnsType: dns.TypeA, Host: "web.test", Val: "10.0.0.2"},
+	}
+	for _, e := range expected {
+		if ev := <-sub.C; ev != e {
+			t.Errorf("Got event %+v -- expected %+v", ev, e)
+		}
+	}
+
+	// Resuming
+	late := rs.Subscribe()
+	defer late.Unsubscribe()
+	if evs, ok := late.Since(4); !ok || len(evs) != 2 || evs[0].Seq != 5 {
+		t.Errorf("Since(4) returned %v, %v -- expected events 5 and 6", evs, ok)
+	}
+	if _, ok := late.Since(7); ok {
+		t.Error("Since() resumed from a sequence number that wasn't given out")
+	}
+	for i := 0; i < EVENT_HISTORY; i++ {
+		rs.Put(dns.TypeTXT, "busy.test", fmt.Sprint(i))
+	}
+	if _, ok := rs.Subscribe().Since(4); ok {
+		t.Error("Since() resumed from an event no longer kept")
+	}
+	// late isn't reading, and was dropped
+	n := 0
+	for range late.C {
+		n++
+	}
+	if n == 0 || n >= EVENT_HISTORY {
+		t.Errorf("Got %d events before a slow subscriber was dropped", n)
+	}
+
+	recs, err := rs.All()
+	var keys []string
+	for _, rec := range recs {
+		keys = append(keys, fmt.Sprintf("%s %s", dns.TypeToString[rec.DnsType], rec.Key))
+	}
+	if err != nil || strings.Join(keys, ",") != "PTR 9.0.0.10.in-addr.arpa,TXT busy.test,A old.test,TXT web.test" {
+		t.Errorf("All() returned %v, %v", keys, err)
+	}
+}
+
+// A memory store shared by several record sets, passing notices between them like redis_rs
+type sharedStore struct {
+	*mem_rs.MemRecordStore
+	peers   *[]*sharedStore
+	notices chan StoreNotice
+}
+
+func newSharedStores(n int) (stores []*sharedStore) {
+	mem := mem_rs.Create()
+	for i := 0; i < n; i++ {
+		stores = append(stores, &sharedStore{mem, &stores, make(chan StoreNotice, 10)})
+	}
+	return
+}
+
+func (s *sharedStore) Notify(n StoreNotice) error {
+	for _, peer := range *s.peers {
+		if peer != s {
+			peer.notices <- n
+		}
+	}
+	return nil
+}
+
+func (s *sharedStore) Watch(ctx context.Context, fn func(StoreNotice)) error {
+	for {
+		select {
+		case n := <-s.notices:
+			fn(n)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	stores := newSharedStores(3) // The third is not watched, so its notices can be checked
+	a, b := Create(stores[0]), Create(stores[1])
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Watch(ctx)
+	sub := b.Subscribe()
+	defer sub.Unsubscribe()
+	mine := a.Subscribe()
+	defer mine.Unsubscribe()
+
+	a.WithSource("api").Put(dns.TypeA, "web.test", "10.0.0.1")
+	expected := Event{Seq: 1, Op: EventPut, Source: "api", DnsType: dns.TypeA, Host: "web.test", Val: "10.0.0.1"}
+	select {
+	case ev := <-sub.C:
+		if ev != expected {
+			t.Errorf("Got event %+v from the other instance -- expected %+v", ev, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No event from the other instance")
+	}
+	if ev := <-mine.C; ev != expected {
+		t.Errorf("Got event %+v -- expected %+v", ev, expected)
+	}
+	select {
+	case ev := <-mine.C:
+		t.Errorf("Got our own change back: %+v", ev)
+	default:
+	}
+
+	n := <-stores[2].notices
+	ptr := StoreKey{DnsType: dns.TypePTR, Key: "1.0.0.10.in-addr.arpa."}
+	if len(n.Keys) != 2 || n.Keys[0] != (StoreKey{DnsType: dns.TypeA, Key: "web.test."}) || n.Keys[1] != ptr {
+		t.Errorf("Got notice keys %v -- expected web.test and its PTR", n.Keys)
+	}
+	a.Apply([]Change{{Type: ChangeSource, DnsType: dns.TypeA, Host: "web.test", Val: "api"}})
+	if n = <-stores[2].notices; len(n.Keys) != 1 || n.Keys[0] != (StoreKey{DnsType: dns.TypeA, Key: "web.test."}) {
+		t.Errorf("Got notice keys %v -- expected web.test, for its source", n.Keys)
+	}
+
+	// After missed notices, round robin starts over and subscribers are told to start over too
+	stores[0].PutVal(dns.TypeA, "rr.test.", "10.0.1.1")
+	stores[0].PutVal(dns.TypeA, "rr.test.", "10.0.1.2")
+	if v := b.Get(dns.TypeA, "rr.test."); v != "10.0.1.1" {
+		t.Errorf("Got %s -- expected 10.0.1.1 first", v)
+	}
+	stores[1].notices <- StoreNotice{Reset: true}
+	select {
+	case ev := <-sub.C:
+		if ev != (Event{Seq: 2, Op: EventReset}) {
+			t.Errorf("Got event %+v -- expected a reset", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No reset event")
+	}
+	if v := b.Get(dns.TypeA, "rr.test."); v != "10.0.1.1" {
+		t.Errorf("Got %s after a reset -- expected 10.0.1.1 again", v)
+	}
+}
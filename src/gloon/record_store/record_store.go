@@ -0,0 +1,53 @@
+// Types shared by the record set and the stores that keep its records. Stores implement
+// record_set.RecordStore with these, so the record set's own tests can use the stores
+package record_store
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Kind of change made by a StoreOp
+type StoreOpType int
+
+const (
+	StorePut     StoreOpType = iota // Add Val to Key
+	StoreDelVal                     // Remove Val from Key. Key goes with its last value
+	StoreDelKey                     // Remove Key and all its values, and its metadata
+	StoreSetMeta                    // Make Val the metadata of Key. Empty removes it. It stays when the last value goes
+)
+
+// A single store change. record_set.RecordStore.Apply takes a list of them, and applies all or none
+type StoreOp struct {
+	Type    StoreOpType
+	DnsType uint16
+	Key     string
+	Val     string
+}
+
+// A key in the store
+type StoreKey struct {
+	DnsType uint16
+	Key     string
+}
+
+// A key and its values, as listed by record_set.RecordStore.All
+type StoreRecord struct {
+	DnsType uint16
+	Key     string
+	Vals    []string
+	Meta    string // See record_set.RecordStore.GetMeta
+}
+
+// Split a "<type>/<key>" store path, as used by the stores
+func SplitKeyPath(kp string) (dnsType uint16, key string, ok bool) {
+	parts := strings.SplitN(kp, "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+	n, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return
+	}
+	return uint16(n), parts[1], true
+}
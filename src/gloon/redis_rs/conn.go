@@ -0,0 +1,334 @@
+package redis_rs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_PORT          = "6379"
+	DEFAULT_SENTINEL_PORT = "26379"
+	CLUSTER_SLOTS         = 16384
+)
+
+type RedisRecordStoreOpts struct {
+	Addrs            []string // The server, or the sentinels or cluster nodes to ask for it
+	Username         string   // Needs redis 6 ACLs
+	Password         string
+	Database         int
+	Namespace        string
+	TLS              bool
+	TLSSkipVerify    bool
+	ConnectTimeout   time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	Sentinel         string // Name of the master the sentinels monitor
+	SentinelPassword string
+	Cluster          bool
+	PoolSize         int // Most connections open at once. 0 is no limit
+	PoolIdle         int // Most idle connections kept open
+}
+
+func defaultOpts() RedisRecordStoreOpts {
+	return RedisRecordStoreOpts{
+		Addrs:          []string{"127.0.0.1:" + DEFAULT_PORT},
+		Namespace:      "gloon",
+		ConnectTimeout: 5 * time.Second,
+		ReadTimeout:    3 * time.Second,
+		WriteTimeout:   3 * time.Second,
+		PoolIdle:       3,
+	}
+}
+
+// opts is a URL, redis://[[user]:password@]host[:port][,host[:port]...][/db][?option=value&...], or
+// the older "addr,db,namespace"
+func ParseOpts(opts string) (o RedisRecordStoreOpts, err error) {
+	o = defaultOpts()
+	if !strings.HasPrefix(opts, "redis://") && !strings.HasPrefix(opts, "rediss://") {
+		options := strings.Split(opts, ",")
+		if options[0] != "" {
+			o.Addrs = []string{options[0]}
+		}
+		if len(options) >= 2 {
+			o.Database, _ = strconv.Atoi(options[1])
+		}
+		if len(options) >= 3 {
+			o.Namespace = options[2]
+		}
+		return
+	}
+	u, err := url.Parse(opts)
+	if err != nil {
+		return
+	}
+	o.TLS = u.Scheme == "rediss"
+	if u.User != nil {
+		o.Username = u.User.Username()
+		o.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if o.Database, err = strconv.Atoi(db); err != nil {
+			return o, fmt.Errorf("Invalid redis database %s", db)
+		}
+	}
+	for name, vals := range u.Query() {
+		val := vals[0]
+		switch name {
+		case "namespace":
+			o.Namespace = val
+		case "tls":
+			o.TLS, err = strconv.ParseBool(val)
+		case "tls_skip_verify":
+			o.TLSSkipVerify, err = strconv.ParseBool(val)
+		case "connect_timeout":
+			o.ConnectTimeout, err = time.ParseDuration(val)
+		case "read_timeout":
+			o.ReadTimeout, err = time.ParseDuration(val)
+		case "write_timeout":
+			o.WriteTimeout, err = time.ParseDuration(val)
+		case "sentinel":
+			o.Sentinel = val
+		case "sentinel_password":
+			o.SentinelPassword = val
+		case "cluster":
+			o.Cluster, err = strconv.ParseBool(val)
+		case "pool_size":
+			o.PoolSize, err = strconv.Atoi(val)
+		case "pool_idle":
+			o.PoolIdle, err = strconv.Atoi(val)
+		default:
+			return o, fmt.Errorf("Unknown redis option %s", name)
+		}
+		if err != nil {
+			return o, fmt.Errorf("Invalid value for redis option %s: %s", name, val)
+		}
+	}
+	if o.Sentinel != "" && o.Cluster {
+		return o, fmt.Errorf("Redis sentinel and cluster options can't be used together")
+	}
+	if o.Cluster && o.Database != 0 {
+		return o, fmt.Errorf("Redis cluster only has database 0")
+	}
+	if u.Host != "" {
+		port := DEFAULT_PORT
+		if o.Sentinel != "" {
+			port = DEFAULT_SENTINEL_PORT
+		}
+		o.Addrs = nil
+		for _, addr := range strings.Split(u.Host, ",") {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+			}
+			o.Addrs = append(o.Addrs, addr)
+		}
+	}
+	return
+}
+
+func (o *RedisRecordStoreOpts) netDial(network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: o.ConnectTimeout}
+	if !o.TLS {
+		return d.Dial(network, addr)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return tls.DialWithDialer(d, network, addr, &tls.Config{ServerName: host, InsecureSkipVerify: o.TLSSkipVerify})
+}
+
+// Connect to addr, and log in if there's a password. A readTimeout of 0 waits forever
+func (o *RedisRecordStoreOpts) connect(addr, username, password string, db int, readTimeout time.Duration) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr,
+		redis.DialNetDial(o.netDial),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		args := []interface{}{password}
+		if username != "" {
+			args = []interface{}{username, password}
+		}
+		if _, err = conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err = conn.Do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Connect to the server holding our records, finding it through the sentinels or cluster if need be
+func (o *RedisRecordStoreOpts) dial(readTimeout time.Duration) (redis.Conn, error) {
+	switch {
+	case o.Sentinel != "":
+		return o.dialMaster(readTimeout)
+	case o.Cluster:
+		return o.dialSlotOwner(keySlot(o.keyPrefix()), readTimeout)
+	}
+	return o.connect(o.Addrs[0], o.Username, o.Password, o.Database, readTimeout)
+}
+
+// Every key starts with this. In cluster mode the namespace is a hash tag, which keeps our keys
+// in one slot, so transactions and SCAN work
+func (o *RedisRecordStoreOpts) keyPrefix() string {
+	if o.Cluster {
+		return "/{" + o.Namespace + "}/"
+	}
+	return "/" + o.Namespace + "/"
+}
+
+// Ask each sentinel in turn where the master is. A redis demotes its clients when it stops being
+// master, so the pool redials through here after a failover
+func (o *RedisRecordStoreOpts) dialMaster(readTimeout time.Duration) (redis.Conn, error) {
+	var errs []string
+	for _, sentinel := range o.Addrs {
+		conn, err := o.dialMasterVia(sentinel, readTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", sentinel, err.Error()))
+	}
+	return nil, fmt.Errorf("No master found for %s (%s)", o.Sentinel, strings.Join(errs, "; "))
+}
+
+func (o *RedisRecordStoreOpts) dialMasterVia(sentinel string, readTimeout time.Duration) (redis.Conn, error) {
+	sc, err := o.connect(sentinel, "", o.SentinelPassword, 0, o.ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := redis.Strings(sc.Do("SENTINEL", "get-master-addr-by-name", o.Sentinel))
+	sc.Close()
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("unknown master")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(addr) != 2 {
+		return nil, fmt.Errorf("unexpected reply %v", addr)
+	}
+	conn, err := o.connect(net.JoinHostPort(addr[0], addr[1]), o.Username, o.Password, o.Database, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// During a failover the sentinel may still name the old master
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err == nil && len(role) > 0 {
+		if r, _ := redis.String(role[0], nil); r != "master" {
+			err = fmt.Errorf("%s:%s is a %s", addr[0], addr[1], r)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Ask each cluster node in turn which node serves slot
+func (o *RedisRecordStoreOpts) dialSlotOwner(slot int, readTimeout time.Duration) (redis.Conn, error) {
+	var errs []string
+	for _, node := range o.Addrs {
+		addr, err := o.slotOwner(node, slot)
+		if err == nil {
+			var conn redis.Conn
+			if conn, err = o.connect(addr, o.Username, o.Password, 0, readTimeout); err == nil {
+				return clusterConn{conn}, nil
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", node, err.Error()))
+	}
+	return nil, fmt.Errorf("No cluster node found for slot %d (%s)", slot, strings.Join(errs, "; "))
+}
+
+func (o *RedisRecordStoreOpts) slotOwner(node string, slot int) (addr string, err error) {
+	conn, err := o.connect(node, o.Username, o.Password, 0, o.ReadTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return
+	}
+	// Each range is start, end, then the master's host and port, then its replicas
+	for _, r := range ranges {
+		vals, _ := redis.Values(r, nil)
+		if len(vals) < 3 {
+			continue
+		}
+		start, _ := redis.Int(vals[0], nil)
+		end, _ := redis.Int(vals[1], nil)
+		master, _ := redis.Values(vals[2], nil)
+		if slot < start || slot > end || len(master) < 2 {
+			continue
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		// A node may leave out its own host
+		if host == "" {
+			host, _, _ = net.SplitHostPort(node)
+		}
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	return "", fmt.Errorf("slot %d is not served", slot)
+}
+
+// A connection to a cluster node. Once the node says our slot has moved, the connection is closed,
+// so the pool drops it and the next command dials the new owner. The command itself fails
+type clusterConn struct {
+	redis.Conn
+}
+
+func (c clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	if e, ok := err.(redis.Error); ok {
+		msg := string(e)
+		// A queued command that was moved fails the whole transaction with EXECABORT
+		if strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ") || strings.HasPrefix(msg, "EXECABORT ") {
+			c.Conn.Close()
+		}
+	}
+	return reply, err
+}
+
+// The cluster slot of key, honoring {hash tags}
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % CLUSTER_SLOTS)
+}
+
+// CRC-16/XMODEM, as redis cluster uses
+func crc16(s string) (crc uint16) {
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return
+}
+
+// Escape glob characters, for SCAN MATCH
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,433 @@
+package redis_rs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Enough of a redis server, over the real protocol, to run the store against. It can also play a
+// sentinel, or a cluster node
+type fakeRedis struct {
+	sync.Mutex
+	ln       net.Listener
+	dbs      map[int]map[string]map[string]bool // Sets
+	strs     map[int]map[string]string          // Strings
+	subs     map[string]map[*fakeClient]bool
+	conns    map[net.Conn]bool
+	username string            // With password, required to AUTH
+	password string            // Required to AUTH, if set
+	role     string            // Reported by ROLE
+	masters  map[string]string // Sentinel master names and their addresses
+	owner    string            // Address of the cluster node serving every slot, if a cluster
+	cursors  []string          // The last key each SCAN cursor returned
+}
+
+type fakeClient struct {
+	sync.Mutex // Guards w, which publishers write to as well
+	w          *bufio.Writer
+	db         int
+	authed     bool
+	queue      [][]string // Commands sent since MULTI
+	multi      bool
+	aborted    bool // A queued command failed
+}
+
+// A simple string reply, as opposed to a bulk string
+type status string
+
+func newFakeRedis() *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return startFakeRedis(ln)
+}
+
+func newFakeTLSRedis(config *tls.Config) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return startFakeRedis(tls.NewListener(ln, config))
+}
+
+func startFakeRedis(ln net.Listener) *fakeRedis {
+	fr := &fakeRedis{
+		ln:      ln,
+		dbs:     make(map[int]map[string]map[string]bool),
+		strs:    make(map[int]map[string]string),
+		subs:    make(map[string]map[*fakeClient]bool),
+		conns:   make(map[net.Conn]bool),
+		role:    "master",
+		masters: make(map[string]string),
+	}
+	go fr.serve()
+	return fr
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.ln.Addr().String()
+}
+
+func (fr *fakeRedis) Close() {
+	fr.ln.Close()
+	fr.dropClients()
+}
+
+// Disconnect every client, as redis does when it is demoted
+func (fr *fakeRedis) dropClients() {
+	fr.Lock()
+	defer fr.Unlock()
+	for conn := range fr.conns {
+		conn.Close()
+	}
+}
+
+// The members of a set in database db
+func (fr *fakeRedis) members(db int, key string) (vals []string) {
+	fr.Lock()
+	defer fr.Unlock()
+	for v := range fr.dbs[db][key] {
+		vals = append(vals, v)
+	}
+	return
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		fr.Lock()
+		fr.conns[conn] = true
+		fr.Unlock()
+		go fr.handle(conn)
+	}
+}
+
+func (fr *fakeRedis) handle(conn net.Conn) {
+	c := &fakeClient{w: bufio.NewWriter(conn)}
+	defer func() {
+		fr.Lock()
+		for _, clients := range fr.subs {
+			delete(clients, c)
+		}
+		delete(fr.conns, conn)
+		fr.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := fr.do(c, args)
+		c.Lock()
+		writeReply(c.w, reply)
+		err = c.w.Flush()
+		c.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Commands are arrays of bulk strings
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected an array")
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	for i := 0; i < n; i++ {
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprint(w, "*-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+func (fr *fakeRedis) do(c *fakeClient, args []string) interface{} {
+	if len(args) == 0 {
+		return errors.New("ERR empty command")
+	}
+	fr.Lock()
+	defer fr.Unlock()
+	cmd := strings.ToUpper(args[0])
+	if cmd == "AUTH" {
+		user, pass := "", args[len(args)-1]
+		if len(args) == 3 {
+			user = args[1]
+		}
+		if fr.password == "" || pass != fr.password || user != fr.username {
+			return errors.New("WRONGPASS invalid username-password pair")
+		}
+		c.authed = true
+		return status("OK")
+	}
+	if fr.password != "" && !c.authed {
+		return errors.New("NOAUTH Authentication required.")
+	}
+	switch {
+	case cmd == "MULTI":
+		c.multi, c.aborted, c.queue = true, false, nil
+		return status("OK")
+	case cmd == "DISCARD":
+		c.multi, c.queue = false, nil
+		return status("OK")
+	case cmd == "EXEC":
+		defer func() { c.multi, c.queue = false, nil }()
+		if c.aborted {
+			return errors.New("EXECABORT Transaction discarded because of previous errors.")
+		}
+		replies := []interface{}{}
+		for _, queued := range c.queue {
+			replies = append(replies, fr.exec(c, queued))
+		}
+		return replies
+	case c.multi:
+		if err := fr.moved(); err != nil {
+			c.aborted = true
+			return err
+		}
+		c.queue = append(c.queue, args)
+		return status("QUEUED")
+	case cmd == "SUBSCRIBE":
+		for _, ch := range args[1:] {
+			if fr.subs[ch] == nil {
+				fr.subs[ch] = make(map[*fakeClient]bool)
+			}
+			fr.subs[ch][c] = true
+		}
+		return []interface{}{"subscribe", args[1], len(args) - 1}
+	case cmd == "PUBLISH":
+		for sub := range fr.subs[args[1]] {
+			sub.Lock()
+			writeReply(sub.w, []string{"message", args[1], args[2]})
+			sub.w.Flush()
+			sub.Unlock()
+		}
+		return len(fr.subs[args[1]])
+	case cmd == "ROLE":
+		return []interface{}{fr.role, 0, []interface{}{}}
+	case cmd == "SENTINEL":
+		addr, ok := fr.masters[args[2]]
+		if !ok {
+			return nil
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		return []string{host, port}
+	case cmd == "CLUSTER":
+		if fr.owner == "" {
+			return errors.New("ERR This instance has cluster support disabled")
+		}
+		host, port, _ := net.SplitHostPort(fr.owner)
+		p, _ := strconv.Atoi(port)
+		return []interface{}{[]interface{}{0, CLUSTER_SLOTS - 1, []interface{}{host, p, "id"}}}
+	case cmd == "PING" || cmd == "SELECT":
+	default:
+		if err := fr.moved(); err != nil {
+			return err
+		}
+	}
+	return fr.exec(c, args)
+}
+
+// As a cluster node that has given its slots to another
+func (fr *fakeRedis) moved() error {
+	if fr.owner != "" && fr.owner != fr.Addr() {
+		return fmt.Errorf("MOVED 0 %s", fr.owner)
+	}
+	return nil
+}
+
+// Run a data command. Called with the lock held
+func (fr *fakeRedis) exec(c *fakeClient, args []string) interface{} {
+	if fr.dbs[c.db] == nil {
+		fr.dbs[c.db] = make(map[string]map[string]bool)
+		fr.strs[c.db] = make(map[string]string)
+	}
+	data, strs := fr.dbs[c.db], fr.strs[c.db]
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return status("PONG")
+	case "SELECT":
+		c.db, _ = strconv.Atoi(args[1])
+		return status("OK")
+	case "SADD":
+		if data[args[1]] == nil {
+			data[args[1]] = make(map[string]bool)
+		}
+		n := 0
+		for _, v := range args[2:] {
+			if !data[args[1]][v] {
+				data[args[1]][v] = true
+				n++
+			}
+		}
+		return n
+	case "SREM":
+		n := 0
+		for _, v := range args[2:] {
+			if data[args[1]][v] {
+				delete(data[args[1]], v)
+				n++
+			}
+		}
+		// Like redis, a set goes with its last member
+		if len(data[args[1]]) == 0 {
+			delete(data, args[1])
+		}
+		return n
+	case "SMEMBERS":
+		vals := []string{}
+		for v := range data[args[1]] {
+			vals = append(vals, v)
+		}
+		return vals
+	case "GET":
+		if v, ok := strs[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		delete(data, args[1])
+		strs[args[1]] = args[2]
+		return status("OK")
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := strs[k]; data[k] != nil || ok {
+				delete(data, k)
+				delete(strs, k)
+				n++
+			}
+		}
+		return n
+	case "SCAN":
+		var keys []string
+		for k := range data {
+			keys = append(keys, k)
+		}
+		for k := range strs {
+			keys = append(keys, k)
+		}
+		return fr.scan(keys, args[1:])
+	}
+	return fmt.Errorf("ERR unknown command '%s'", args[0])
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]. Keys are scanned in order, and a cursor is where the
+// last key it returned is kept, so keys deleted along the way don't cause others to be skipped
+func (fr *fakeRedis) scan(all []string, args []string) interface{} {
+	after := ""
+	if cursor, _ := strconv.Atoi(args[0]); cursor > 0 && cursor <= len(fr.cursors) {
+		after = fr.cursors[cursor-1]
+	}
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	var keys []string
+	for _, k := range all {
+		if k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) <= count {
+		return []interface{}{"0", matching(pattern, keys)}
+	}
+	keys = keys[:count]
+	fr.cursors = append(fr.cursors, keys[count-1])
+	return []interface{}{strconv.Itoa(len(fr.cursors)), matching(pattern, keys)}
+}
+
+func matching(pattern string, keys []string) []string {
+	matched := []string{}
+	for _, k := range keys {
+		if globMatch(pattern, k) {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
+
+// Redis glob patterns, without character classes
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
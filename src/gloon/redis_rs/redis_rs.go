@@ -1,9 +1,15 @@
 package redis_rs
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"strconv"
+	"gloon/record_set"
+	"gloon/record_store"
+	"log"
 	"strings"
 	"time"
 )
@@ -11,35 +17,36 @@ import (
 type RedisRecordStore struct {
 	pool      *redis.Pool
 	namespace string
+	prefix    string                     // Of every key, see keyPrefix
+	dial      func() (redis.Conn, error) // For subscribing, so without a read timeout
+	origin    string                     // Identifies our change notices, so we can skip them
 }
 
-type RedisRecordStoreOpts struct {
-	Database  int
-	Namespace string
-}
+// Keys fetched per SCAN
+const SCAN_COUNT = 1000
 
+// opts are parsed by ParseOpts. Nothing is dialed until the store is used
 func Create(opts string) (r *RedisRecordStore, err error) {
-	options := strings.Split(opts, ",")
-	addr := "127.0.0.1:6379"
-	db := 0
-	ns := "gloon"
-	if len(options) >= 1 && options[0] != "" {
-		addr = options[0]
-	}
-	if len(options) >= 2 {
-		db, _ = strconv.Atoi(options[1])
-	}
-	if len(options) >= 3 {
-		ns = options[2]
+	o, err := ParseOpts(opts)
+	if err != nil {
+		return
 	}
 	pool := &redis.Pool{
-		MaxIdle:     3,
+		MaxIdle:     o.PoolIdle,
+		MaxActive:   o.PoolSize,
+		Wait:        o.PoolSize > 0,
 		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", addr, redis.DialDatabase(db))
-		},
+		Dial:        func() (redis.Conn, error) { return o.dial(o.ReadTimeout) },
+	}
+	origin := make([]byte, 8)
+	rand.Read(origin)
+	r = &RedisRecordStore{
+		pool:      pool,
+		namespace: o.Namespace,
+		prefix:    o.keyPrefix(),
+		dial:      func() (redis.Conn, error) { return o.dial(0) },
+		origin:    hex.EncodeToString(origin),
 	}
-	r = &RedisRecordStore{pool: pool, namespace: ns}
 	return
 }
 
@@ -50,19 +57,83 @@ func (r *RedisRecordStore) PutVal(dnsType uint16, key, val string) (err error) {
 	return
 }
 
+// Pass the keys in our namespace to fn, a batch at a time. Unlike KEYS, SCAN doesn't hold up the
+// server, but it may return a key more than once
+func (r *RedisRecordStore) scan(conn redis.Conn, fn func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", globEscape(r.prefix)+"*", "COUNT", SCAN_COUNT))
+		if err != nil {
+			return err
+		}
+		if len(reply) != 2 {
+			return fmt.Errorf("Unexpected SCAN reply %v", reply)
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
 func (r *RedisRecordStore) Clear() (err error) {
 	conn := r.pool.Get()
 	defer conn.Close()
-	resp, err := conn.Do("KEYS", fmt.Sprintf("/%s/*", r.namespace))
-	keys, err := redis.Strings(resp, err)
+	return r.scan(conn, func(keys []string) error {
+		args := make([]interface{}, len(keys))
+		for i, k := range keys {
+			args[i] = k
+		}
+		_, err := conn.Do("DEL", args...)
+		return err
+	})
+}
+
+func (r *RedisRecordStore) All() (records []record_store.StoreRecord, err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	var keys []string
+	seen := make(map[string]bool)
+	err = r.scan(conn, func(batch []string) error {
+		for _, k := range batch {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return
 	}
 	for _, k := range keys {
-		_, err := conn.Do("DEL", k)
+		dnsType, key, ok := record_store.SplitKeyPath(strings.TrimPrefix(k, r.prefix))
+		if !ok {
+			continue
+		}
+		vals, err := redis.Strings(conn.Do("SMEMBERS", k))
 		if err != nil {
-			return err
+			return nil, err
 		}
+		if len(vals) == 0 {
+			continue
+		}
+		meta, err := r.getMeta(conn, dnsType, key)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record_store.StoreRecord{DnsType: dnsType, Key: key, Vals: vals, Meta: meta})
 	}
 	return
 }
@@ -77,10 +148,24 @@ func (r *RedisRecordStore) GetAll(dnsType uint16, key string) (vals []string, er
 	return
 }
 
+func (r *RedisRecordStore) GetMeta(dnsType uint16, key string) (string, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	return r.getMeta(conn, dnsType, key)
+}
+
+func (r *RedisRecordStore) getMeta(conn redis.Conn, dnsType uint16, key string) (meta string, err error) {
+	meta, err = redis.String(conn.Do("GET", r.metaPath(dnsType, key)))
+	if err == redis.ErrNil {
+		err = nil
+	}
+	return
+}
+
 func (r *RedisRecordStore) DelKey(dnsType uint16, key string) (err error) {
 	conn := r.pool.Get()
 	defer conn.Close()
-	_, err = conn.Do("DEL", r.keyPath(dnsType, key))
+	_, err = conn.Do("DEL", r.keyPath(dnsType, key), r.metaPath(dnsType, key))
 	if err == redis.ErrNil {
 		err = nil
 	}
@@ -97,6 +182,150 @@ func (r *RedisRecordStore) DelVal(dnsType uint16, key, value string) (err error)
 	return
 }
 
+// Apply ops in a MULTI/EXEC transaction
+func (r *RedisRecordStore) Apply(ops []record_store.StoreOp) (err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case record_store.StorePut:
+			err = conn.Send("SADD", r.keyPath(op.DnsType, op.Key), op.Val)
+		case record_store.StoreDelVal:
+			err = conn.Send("SREM", r.keyPath(op.DnsType, op.Key), op.Val)
+		case record_store.StoreDelKey:
+			err = conn.Send("DEL", r.keyPath(op.DnsType, op.Key), r.metaPath(op.DnsType, op.Key))
+		case record_store.StoreSetMeta:
+			if op.Val == "" {
+				err = conn.Send("DEL", r.metaPath(op.DnsType, op.Key))
+			} else {
+				err = conn.Send("SET", r.metaPath(op.DnsType, op.Key), op.Val)
+			}
+		default:
+			err = fmt.Errorf("Unknown store operation %d", op.Type)
+		}
+		if err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			return e
+		}
+	}
+	return
+}
+
 func (r *RedisRecordStore) keyPath(dnsType uint16, key string) string {
-	return fmt.Sprintf("/%s/%d/%s", r.namespace, dnsType, key)
+	return fmt.Sprintf("%s%d/%s", r.prefix, dnsType, key)
+}
+
+// Metadata of a key is a string beside its set. All skips it, since it doesn't start with a type
+func (r *RedisRecordStore) metaPath(dnsType uint16, key string) string {
+	return fmt.Sprintf("%smeta/%d/%s", r.prefix, dnsType, key)
+}
+
+// Change notices are published on this channel, as JSON
+func (r *RedisRecordStore) channel() string {
+	return r.prefix + "changes"
+}
+
+type redisNotice struct {
+	Origin string
+	record_set.StoreNotice
+}
+
+// Publish a change notice for other instances using the same namespace
+func (r *RedisRecordStore) Notify(n record_set.StoreNotice) (err error) {
+	data, err := json.Marshal(redisNotice{r.origin, n})
+	if err != nil {
+		return
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", r.channel(), data)
+	return
+}
+
+// Delays between attempts to resubscribe to change notices
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+// Pass change notices from other instances to fn until ctx is done. We resubscribe if the
+// connection is lost, and send a Reset notice since some may have been missed
+func (r *RedisRecordStore) Watch(ctx context.Context, fn func(record_set.StoreNotice)) error {
+	delay := watchRetryMin
+	subscribed := false
+	for {
+		err := r.watch(ctx, func() {
+			if subscribed {
+				log.Printf("Resubscribed to redis change notices")
+				fn(record_set.StoreNotice{Reset: true})
+			}
+			subscribed = true
+			delay = watchRetryMin
+		}, fn)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Lost redis change notices: %s. Retrying in %v", err, delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > watchRetryMax {
+			delay = watchRetryMax
+		}
+	}
+}
+
+func (r *RedisRecordStore) watch(ctx context.Context, subscribed func(), fn func(record_set.StoreNotice)) error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+	// Receive blocks, so closing the connection is the way to stop it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			psc.Close()
+		case <-done:
+		}
+	}()
+	if err = psc.Subscribe(r.channel()); err != nil {
+		return err
+	}
+	for {
+		switch m := psc.Receive().(type) {
+		case redis.Subscription:
+			if m.Kind == "subscribe" {
+				subscribed()
+			}
+		case redis.Message:
+			var n redisNotice
+			if err := json.Unmarshal(m.Data, &n); err != nil {
+				log.Printf("Ignoring invalid change notice: %s", err.Error())
+				continue
+			}
+			if n.Origin != r.origin {
+				fn(n.StoreNotice)
+			}
+		case error:
+			return m
+		}
+	}
 }
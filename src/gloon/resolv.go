@@ -119,7 +119,6 @@ func (r *Resolver) Lookup(req *dns.Msg) (msg *dns.Msg, err error) {
 	default:
 		return nil, fmt.Errorf("Query failed for nameservers")
 	}
-	return
 }
 
 func (r *Resolver) lookup(req *dns.Msg, nameserver string, wg *sync.WaitGroup, c chan *dns.Msg) {
@@ -0,0 +1,384 @@
+// Package rstest checks that a RecordStore behaves the way RecordSet expects. Each store's tests run
+// it with rstest.Run
+package rstest
+
+import (
+	"fmt"
+	"gloon/record_set"
+	"gloon/record_store"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Opens a store for a test. Stores opened with different namespaces must not share records; a store
+// without namespaces can t.Skip the second one. Anything to close should be registered with t.Cleanup
+type OpenFunc func(t *testing.T, namespace string) record_set.RecordStore
+
+// Goroutines and operations each used by the concurrency tests
+const (
+	WORKERS = 8
+	OPS     = 50
+)
+
+// Run all the checks against stores from open, each as a subtest
+func Run(t *testing.T, open OpenFunc) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, OpenFunc)
+	}{
+		{"PutGetDel", testPutGetDel},
+		{"MultiVals", testMultiVals},
+		{"EmptyKeys", testEmptyKeys},
+		{"Apply", testApply},
+		{"Meta", testMeta},
+		{"All", testAll},
+		{"Concurrent", testConcurrent},
+		{"ConcurrentApply", testConcurrentApply},
+		{"ClearNamespace", testClearNamespace},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) { test.fn(t, open) })
+	}
+}
+
+func openStore(t *testing.T, open OpenFunc, namespace string) record_set.RecordStore {
+	r := open(t, namespace)
+	if err := r.Clear(); err != nil {
+		t.Fatal("Clear()", err)
+	}
+	return r
+}
+
+// Fail unless key holds exactly vals, in any order
+func ExpectVals(t *testing.T, r record_set.RecordStore, dnsType uint16, key string, vals ...string) {
+	t.Helper()
+	got, err := r.GetAll(dnsType, key)
+	if err != nil {
+		t.Errorf("GetAll(%d, %s) failed: %s", dnsType, key, err)
+		return
+	}
+	if !sameVals(got, vals) {
+		t.Errorf("Got %v for %d %s -- expected %v", got, dnsType, key, vals)
+	}
+}
+
+func sameVals(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Fail unless All() returns exactly expected, ignoring the order of records and values
+func ExpectAll(t *testing.T, r record_set.RecordStore, expected ...record_store.StoreRecord) {
+	t.Helper()
+	recs, err := r.All()
+	if err != nil {
+		t.Errorf("All() failed: %s", err)
+		return
+	}
+	if !sameRecords(recs, expected) {
+		t.Errorf("All() returned %v -- expected %v", recs, expected)
+	}
+}
+
+func sameRecords(a, b []record_store.StoreRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	index := make(map[record_store.StoreKey]record_store.StoreRecord)
+	for _, rec := range a {
+		index[record_store.StoreKey{DnsType: rec.DnsType, Key: rec.Key}] = rec
+	}
+	for _, rec := range b {
+		got, ok := index[record_store.StoreKey{DnsType: rec.DnsType, Key: rec.Key}]
+		if !ok || !sameVals(got.Vals, rec.Vals) || got.Meta != rec.Meta {
+			return false
+		}
+	}
+	return true
+}
+
+func testPutGetDel(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	ExpectVals(t, r, 1, "foo.bar.")
+	if err := r.PutVal(1, "foo.bar.", "127.0.0.1"); err != nil {
+		t.Error("PutVal()", err)
+	}
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1")
+	// Putting a value twice stores it once
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1")
+	// Types, and names sharing a prefix, are separate records
+	r.PutVal(16, "foo.bar.", "a/b c")
+	r.PutVal(1, "foo.barbaz.", "127.0.0.2")
+	r.PutVal(1, "*.bar.", "127.0.0.3")
+	if err := r.DelKey(1, "foo.bar."); err != nil {
+		t.Error("DelKey()", err)
+	}
+	ExpectVals(t, r, 1, "foo.bar.")
+	ExpectVals(t, r, 16, "foo.bar.", "a/b c")
+	ExpectVals(t, r, 1, "foo.barbaz.", "127.0.0.2")
+	ExpectVals(t, r, 1, "*.bar.", "127.0.0.3")
+	// Deleting what isn't there is not an error
+	if err := r.DelKey(1, "nothing.bar."); err != nil {
+		t.Error("DelKey() of a missing key", err)
+	}
+	if err := r.DelVal(1, "nothing.bar.", "127.0.0.1"); err != nil {
+		t.Error("DelVal() of a missing key", err)
+	}
+	if err := r.DelVal(16, "foo.bar.", "nothing"); err != nil {
+		t.Error("DelVal() of a missing value", err)
+	}
+	ExpectVals(t, r, 16, "foo.bar.", "a/b c")
+}
+
+func testMultiVals(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	r.PutVal(1, "foo.bar.", "127.0.0.2")
+	r.PutVal(1, "foo.bar.", "127.0.0.3")
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1", "127.0.0.2", "127.0.0.3")
+	if err := r.DelVal(1, "foo.bar.", "127.0.0.2"); err != nil {
+		t.Error("DelVal()", err)
+	}
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1", "127.0.0.3")
+	r.DelVal(1, "foo.bar.", "127.0.0.1")
+	r.DelVal(1, "foo.bar.", "127.0.0.3")
+	ExpectVals(t, r, 1, "foo.bar.")
+}
+
+// A key goes with its last value, however that is removed
+func testEmptyKeys(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	r.PutVal(1, "baz.bar.", "127.0.0.2")
+	r.PutVal(1, "qux.bar.", "127.0.0.3")
+	r.DelVal(1, "foo.bar.", "127.0.0.1")
+	r.Apply([]record_store.StoreOp{{Type: record_store.StoreDelVal, DnsType: 1, Key: "baz.bar.", Val: "127.0.0.2"}})
+	ExpectAll(t, r, record_store.StoreRecord{DnsType: 1, Key: "qux.bar.", Vals: []string{"127.0.0.3"}})
+	// and comes back with the next
+	r.PutVal(1, "foo.bar.", "127.0.0.4")
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.4")
+}
+
+func testApply(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	r.PutVal(12, "1.0.0.127.in-addr.arpa.", "foo.bar")
+	// An address moving from one host to another, as the api does it
+	err := r.Apply([]record_store.StoreOp{
+		{Type: record_store.StoreDelVal, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.1"},
+		{Type: record_store.StoreDelKey, DnsType: 12, Key: "1.0.0.127.in-addr.arpa."},
+		{Type: record_store.StorePut, DnsType: 1, Key: "baz.bar.", Val: "127.0.0.1"},
+		{Type: record_store.StorePut, DnsType: 12, Key: "1.0.0.127.in-addr.arpa.", Val: "baz.bar"},
+		{Type: record_store.StoreDelKey, DnsType: 1, Key: "nothing.bar."},
+	})
+	if err != nil {
+		t.Error("Apply()", err)
+	}
+	ExpectVals(t, r, 1, "foo.bar.")
+	ExpectVals(t, r, 1, "baz.bar.", "127.0.0.1")
+	ExpectVals(t, r, 12, "1.0.0.127.in-addr.arpa.", "baz.bar")
+	if err = r.Apply(nil); err != nil {
+		t.Error("Apply() with no ops", err)
+	}
+	// Nothing is applied if any op is invalid
+	err = r.Apply([]record_store.StoreOp{
+		{Type: record_store.StoreDelKey, DnsType: 1, Key: "baz.bar."},
+		{Type: record_store.StorePut, DnsType: 1, Key: "qux.bar.", Val: "127.0.0.2"},
+		{Type: 42, DnsType: 1, Key: "baz.bar."},
+	})
+	if err == nil {
+		t.Error("Apply() with an invalid op did not fail")
+	}
+	ExpectVals(t, r, 1, "baz.bar.", "127.0.0.1")
+	ExpectVals(t, r, 1, "qux.bar.")
+}
+
+// Fail unless key has exactly meta
+func ExpectMeta(t *testing.T, r record_set.RecordStore, dnsType uint16, key, meta string) {
+	t.Helper()
+	got, err := r.GetMeta(dnsType, key)
+	if err != nil {
+		t.Errorf("GetMeta(%d, %s) failed: %s", dnsType, key, err)
+		return
+	}
+	if got != meta {
+		t.Errorf("Got meta %q for %d %s -- expected %q", got, dnsType, key, meta)
+	}
+}
+
+func setMeta(dnsType uint16, key, meta string) record_store.StoreOp {
+	return record_store.StoreOp{Type: record_store.StoreSetMeta, DnsType: dnsType, Key: key, Val: meta}
+}
+
+// Metadata is kept beside a key's values, and isn't one of them
+func testMeta(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	ExpectMeta(t, r, 1, "foo.bar.", "")
+	err := r.Apply([]record_store.StoreOp{
+		{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.1"},
+		setMeta(1, "foo.bar.", `{"ttl":60}`),
+	})
+	if err != nil {
+		t.Error("Apply()", err)
+	}
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1")
+	ExpectMeta(t, r, 1, "foo.bar.", `{"ttl":60}`)
+	ExpectMeta(t, r, 16, "foo.bar.", "")
+	ExpectAll(t, r, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1"}, Meta: `{"ttl":60}`})
+	// Replacing it, and failed batches leave it alone
+	r.Apply([]record_store.StoreOp{setMeta(1, "foo.bar.", `{"ttl":30}`)})
+	r.Apply([]record_store.StoreOp{setMeta(1, "foo.bar.", `{"ttl":10}`), {Type: 42, DnsType: 1, Key: "foo.bar."}})
+	ExpectMeta(t, r, 1, "foo.bar.", `{"ttl":30}`)
+	// It stays with the last value, and goes with the key
+	r.DelVal(1, "foo.bar.", "127.0.0.1")
+	ExpectMeta(t, r, 1, "foo.bar.", `{"ttl":30}`)
+	r.PutVal(1, "foo.bar.", "127.0.0.2")
+	if err := r.DelKey(1, "foo.bar."); err != nil {
+		t.Error("DelKey()", err)
+	}
+	ExpectMeta(t, r, 1, "foo.bar.", "")
+	r.Apply([]record_store.StoreOp{
+		{Type: record_store.StorePut, DnsType: 1, Key: "foo.bar.", Val: "127.0.0.3"},
+		setMeta(1, "foo.bar.", `{"ttl":20}`),
+		{Type: record_store.StoreDelKey, DnsType: 1, Key: "foo.bar."},
+	})
+	ExpectMeta(t, r, 1, "foo.bar.", "")
+	// Empty removes it
+	r.PutVal(1, "foo.bar.", "127.0.0.4")
+	r.Apply([]record_store.StoreOp{setMeta(1, "foo.bar.", `{"ttl":5}`)})
+	r.Apply([]record_store.StoreOp{setMeta(1, "foo.bar.", "")})
+	ExpectMeta(t, r, 1, "foo.bar.", "")
+	ExpectAll(t, r, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.4"}})
+	r.Apply([]record_store.StoreOp{setMeta(1, "foo.bar.", `{"ttl":5}`)})
+	if err := r.Clear(); err != nil {
+		t.Error("Clear()", err)
+	}
+	ExpectMeta(t, r, 1, "foo.bar.", "")
+}
+
+func testAll(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	ExpectAll(t, r)
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	r.PutVal(1, "foo.bar.", "127.0.0.2")
+	r.PutVal(16, "foo.bar.", "a/b c")
+	r.PutVal(1, "*.bar.", "127.0.0.3")
+	ExpectAll(t, r,
+		record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.1", "127.0.0.2"}},
+		record_store.StoreRecord{DnsType: 16, Key: "foo.bar.", Vals: []string{"a/b c"}},
+		record_store.StoreRecord{DnsType: 1, Key: "*.bar.", Vals: []string{"127.0.0.3"}},
+	)
+	if err := r.Clear(); err != nil {
+		t.Error("Clear()", err)
+	}
+	ExpectAll(t, r)
+	ExpectVals(t, r, 1, "foo.bar.")
+}
+
+// Workers put and remove values on a shared key and their own, while reading both
+func testConcurrent(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	var wg sync.WaitGroup
+	for w := 0; w < WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := fmt.Sprintf("w%d.bar.", w)
+			for i := 0; i < OPS; i++ {
+				val := fmt.Sprintf("10.0.%d.%d", w, i)
+				if err := r.PutVal(1, "shared.bar.", val); err != nil {
+					t.Error("PutVal()", err)
+				}
+				if err := r.PutVal(1, own, val); err != nil {
+					t.Error("PutVal()", err)
+				}
+				if _, err := r.GetAll(1, "shared.bar."); err != nil {
+					t.Error("GetAll()", err)
+				}
+				// Leave every other value
+				if i%2 == 1 {
+					if err := r.DelVal(1, "shared.bar.", val); err != nil {
+						t.Error("DelVal()", err)
+					}
+					if err := r.DelVal(1, own, val); err != nil {
+						t.Error("DelVal()", err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	var shared []string
+	for w := 0; w < WORKERS; w++ {
+		var own []string
+		for i := 0; i < OPS; i += 2 {
+			own = append(own, fmt.Sprintf("10.0.%d.%d", w, i))
+		}
+		ExpectVals(t, r, 1, fmt.Sprintf("w%d.bar.", w), own...)
+		shared = append(shared, own...)
+	}
+	ExpectVals(t, r, 1, "shared.bar.", shared...)
+}
+
+// Workers move a value between two keys. Each batch is whole, so the value is always in exactly one
+func testConcurrentApply(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	r.PutVal(1, "a.bar.", "127.0.0.1")
+	move := func(from, to string) []record_store.StoreOp {
+		return []record_store.StoreOp{
+			{Type: record_store.StoreDelKey, DnsType: 1, Key: from},
+			{Type: record_store.StorePut, DnsType: 1, Key: to, Val: "127.0.0.1"},
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < OPS; i++ {
+				ops := move("a.bar.", "b.bar.")
+				if (w+i)%2 == 0 {
+					ops = move("b.bar.", "a.bar.")
+				}
+				if err := r.Apply(ops); err != nil {
+					t.Error("Apply()", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	a, _ := r.GetAll(1, "a.bar.")
+	b, _ := r.GetAll(1, "b.bar.")
+	if len(a)+len(b) != 1 {
+		t.Errorf("Got %v and %v -- expected the value in one key", a, b)
+	}
+}
+
+// Clear only removes the records of its own namespace
+func testClearNamespace(t *testing.T, open OpenFunc) {
+	r := openStore(t, open, "test")
+	other := openStore(t, open, "other")
+	r.PutVal(1, "foo.bar.", "127.0.0.1")
+	other.PutVal(1, "foo.bar.", "127.0.0.2")
+	ExpectVals(t, r, 1, "foo.bar.", "127.0.0.1")
+	if err := r.Clear(); err != nil {
+		t.Error("Clear()", err)
+	}
+	ExpectAll(t, r)
+	ExpectVals(t, other, 1, "foo.bar.", "127.0.0.2")
+	ExpectAll(t, other, record_store.StoreRecord{DnsType: 1, Key: "foo.bar.", Vals: []string{"127.0.0.2"}})
+}
@@ -3,19 +3,29 @@ package main
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	"gloon/cache_rs"
+	"gloon/etcd_rs"
+	"gloon/file_rs"
 	"gloon/mem_rs"
+	"gloon/peer_rs"
 	"gloon/record_set"
 	"gloon/redis_rs"
+	"gloon/sql_rs"
 	"log"
 	"regexp"
+	"sync"
 	"time"
 )
 
 type Server struct {
 	*dns.Server
 	*record_set.RecordSet
+	store    record_set.RecordStore // The record set's store, including any cache. Closed on shutdown
+	mu       sync.RWMutex           // Guards resolver and settings, which are swapped on reload
 	resolver *Resolver
 	settings *Settings
+	static   map[HostPair]bool // Records added from settings.Hostnames
+	started  bool              // Set once the listener is up
 }
 
 var split_rex = regexp.MustCompile("[:= ]")
@@ -23,6 +33,7 @@ var split_rex = regexp.MustCompile("[:= ]")
 func NewServer(addr string, settings *Settings) (s *Server, err error) {
 	s = &Server{}
 	s.settings = settings
+	s.static = make(map[HostPair]bool)
 
 	// Set up the record store
 	var store record_set.RecordStore
@@ -30,26 +41,118 @@ func NewServer(addr string, settings *Settings) (s *Server, err error) {
 	case "redis":
 		store, err = redis_rs.Create(settings.StoreOpts)
 		if err != nil {
-			log.Fatalf("Unable to create redis record set: %s", err.Error())
+			return nil, fmt.Errorf("Unable to create redis record set: %s", err.Error())
+		}
+	case "etcd":
+		store, err = etcd_rs.Create(settings.StoreOpts)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create etcd record set: %s", err.Error())
+		}
+	case "file":
+		store, err = file_rs.Create(settings.StoreOpts)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open record file: %s", err.Error())
+		}
+	case "sql":
+		store, err = sql_rs.Create(settings.StoreOpts)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open sql record store: %s", err.Error())
+		}
+	case "peer":
+		store, err = peer_rs.Create(settings.StoreOpts)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to start peer record store: %s", err.Error())
 		}
 	case "memory":
 		store = mem_rs.Create()
 	default:
-		log.Fatalf("Unknown dns record store type %s specified", settings.Store)
+		return nil, fmt.Errorf("Unknown dns record store type %s specified", settings.Store)
+	}
+	if settings.StoreCache > 0 {
+		store = cache_rs.Create(store, time.Duration(settings.StoreCache)*time.Second)
 	}
+	s.store = store
 	s.RecordSet = record_set.Create(store)
 	s.Server = &dns.Server{Addr: addr, Net: "udp"}
+	s.Server.NotifyStartedFunc = func() {
+		s.mu.Lock()
+		s.started = true
+		s.mu.Unlock()
+	}
 	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
 		s.handleDnsRequest(w, r)
 	})
 	s.resolver, err = NewResolver(settings)
-	for _, v := range settings.Hostnames {
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create resolver: %s", err.Error())
+	}
+	s.loadStatic(settings.Hostnames)
+	return
+}
+
+// Close the listener and wait for in-flight queries. A server that never started has nothing to stop
+func (s *Server) Stop() error {
+	s.mu.RLock()
+	started := s.started
+	s.mu.RUnlock()
+	if !started {
+		return nil
+	}
+	return s.Shutdown()
+}
+
+// Close the record store, for stores that hold files or connections, or run in the background
+// (ex. lease renewal, syncing with peers). The record set can't be used afterwards
+func (s *Server) closeStore() (err error) {
+	switch c := s.store.(type) {
+	case interface{ Close() error }:
+		err = c.Close()
+	case interface{ Close() }:
+		c.Close()
+	}
+	return
+}
+
+// Remove the static records added from settings
+func (s *Server) clearStatic() {
+	s.loadStatic(nil)
+}
+
+// Swap in new settings and resolver, and apply changes to the static records
+func (s *Server) Reconfigure(settings *Settings, resolver *Resolver) {
+	s.mu.Lock()
+	s.settings = settings
+	s.resolver = resolver
+	s.mu.Unlock()
+	s.loadStatic(settings.Hostnames)
+}
+
+func (s *Server) config() (*Settings, *Resolver) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings, s.resolver
+}
+
+// Add records in the form HOSTNAME=IP, removing static records we added before that are no longer listed
+func (s *Server) loadStatic(hostnames []string) {
+	recs := s.RecordSet.WithSource("static")
+	static := make(map[HostPair]bool)
+	for _, v := range hostnames {
 		parts := split_rex.Split(v, -1)
 		if len(parts) == 2 {
-			s.RecordSet.Put(dns.TypeA, parts[0], parts[1])
+			hp := HostPair{parts[0], parts[1]}
+			if !s.static[hp] {
+				recs.Put(dns.TypeA, hp.host, hp.addr)
+			}
+			static[hp] = true
 		}
 	}
-	return
+	for hp := range s.static {
+		if !static[hp] {
+			recs.DelAddr(dns.TypeA, hp.host, hp.addr)
+		}
+	}
+	s.static = static
 }
 
 func (s *Server) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
@@ -58,9 +161,10 @@ func (s *Server) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 			handlePanic(r)
 		}
 	}()
+	settings, resolver := s.config()
 	start := time.Now()
 	defer func() {
-		if s.settings.Debug {
+		if settings.Debug {
 			elapsed := time.Since(start)
 			log.Printf("%#v took %s", r.Question, elapsed)
 		}
@@ -70,18 +174,18 @@ func (s *Server) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m.Compress = false
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		if s.processQuery(m) {
+		if s.processQuery(m, settings) {
 			w.WriteMsg(m)
 			return
 		}
 	}
-	if s.settings.DisableForwarding {
+	if settings.DisableForwarding {
 		log.Printf("WARNING: name not found and forwarding disabled")
 		m.Rcode = dns.RcodeNameError
 		w.WriteMsg(m)
 		return
 	}
-	resp, err := s.resolver.Lookup(r)
+	resp, err := resolver.Lookup(r)
 	if err == nil {
 		w.WriteMsg(resp)
 	} else {
@@ -89,23 +193,33 @@ func (s *Server) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
-func (s *Server) processQuery(m *dns.Msg) bool {
+func (s *Server) processQuery(m *dns.Msg, settings *Settings) bool {
 	answers := 0
 
 	for _, q := range m.Question {
-		var rr dns.RR
+		var rrs []dns.RR
 		switch q.Qtype {
 		case dns.TypeA:
 			ip := s.Get(dns.TypeA, q.Name)
 			if ip != "" {
-				rr, _ = dns.NewRR(fmt.Sprintf("%s %d A %s", q.Name, s.settings.Ttl, ip))
-			} else if s.settings.Debug {
+				rrs = append(rrs, s.newRR(settings, q.Name, dns.TypeA, ip))
+			} else if cname := s.Get(dns.TypeCNAME, q.Name); cname != "" {
+				// Answer with the alias, and the target's address if we have it
+				rrs = append(rrs, s.newRR(settings, q.Name, dns.TypeCNAME, cname))
+				if ip = s.Get(dns.TypeA, cname); ip != "" {
+					rrs = append(rrs, s.newRR(settings, cname, dns.TypeA, ip))
+				}
+			} else if settings.Debug {
 				log.Printf("Missed A record for %s", q.Name)
 			}
 		case dns.TypePTR:
 			host := s.Get(dns.TypePTR, q.Name)
 			if host != "" {
-				rr, _ = dns.NewRR(fmt.Sprintf("%s %d PTR %s", q.Name, s.settings.Ttl, host))
+				rrs = append(rrs, s.newRR(settings, q.Name, dns.TypePTR, host))
+			}
+		case dns.TypeTXT, dns.TypeCNAME, dns.TypeMX, dns.TypeSRV, dns.TypeNS:
+			for _, val := range s.GetAll(q.Qtype, q.Name) {
+				rrs = append(rrs, s.newRR(settings, q.Name, q.Qtype, val))
 			}
 		case dns.TypeAAAA: // Bail for now if we have an ipv4
 			ip := s.Get(dns.TypeA, q.Name)
@@ -116,9 +230,12 @@ func (s *Server) processQuery(m *dns.Msg) bool {
 		default:
 			return false // If we get a question we can't answer, bail
 		}
-		if rr != nil {
+		for _, rr := range rrs {
+			if rr == nil {
+				continue
+			}
 			m.Answer = append(m.Answer, rr)
-			if s.settings.Debug {
+			if settings.Debug {
 				log.Printf("Resolved request. RR: %s", rr.String())
 			}
 			answers++
@@ -129,3 +246,22 @@ func (s *Server) processQuery(m *dns.Msg) bool {
 	}
 	return false
 }
+
+// Build an answer from a stored value, using the record's own TTL if it has one
+func (s *Server) newRR(settings *Settings, name string, dnsType uint16, rdata string) (rr dns.RR) {
+	ttl, ok := s.Ttl(dnsType, name)
+	if !ok {
+		ttl = uint32(settings.Ttl)
+	}
+	if dnsType == dns.TypeTXT { // Stored unquoted
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: []string{rdata},
+		}
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d %s %s", name, ttl, dns.TypeToString[dnsType], rdata))
+	if err != nil {
+		log.Printf("Invalid %s record %s %s: %s", dns.TypeToString[dnsType], name, rdata, err.Error())
+	}
+	return
+}
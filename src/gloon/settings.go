@@ -3,21 +3,36 @@ package main
 import ()
 
 type Settings struct {
+	ConfigFile             string   // TOML config file. Flags override values from the file
 	ResolverAddr           string   // Address resolver listens on
 	ApiAddr                string   // Address built-in api http server listens on. Required to enable server
+	ApiTokensFile          string   // Bearer tokens and their scopes. Requests without a valid token are refused when set
+	ApiTlsCert             string   // Serve the api over https with this certificate
+	ApiTlsKey              string   // Key for ApiTlsCert
+	ApiClientCa            string   // Require api clients to present a certificate signed by this CA
 	DisableForwarding      bool     // Disable forwarding of requests to other resolvers when not found. False by default
 	DisableDocker          bool     // Diable docker support
 	ResolvFile             string   // resolv.conf to use for forwarding. Defaults to /etc/resolv.conf
 	HostnameFilter         string   // Only add docker hostnames matching this regex. Defaut is to add all containers w/ a configured hostname
 	AppendDomain           string   // Append this domain name to all A records
-	Hostfile               string   //Add A records from this file. File supports wildcards
+	HostnameTemplate       string   // text/template used to build docker container hostnames. Replaces hostname + AppendDomain
+	Hostfiles              []string // Add A records from these files, or *.hosts files in these directories. Files support wildcards
+	Zonefiles              []string // Add records from these RFC 1035 zone files
 	HostfileReloadInterval int      // Reload hostfile on this interval. If 0 (the default) try using inotify or similiar where vailable
 	Hostnames              []string // Hostnames to add from the command line
-	Store                  string   // Defaults to memory. "redis" for redis
+	Store                  string   // Defaults to memory. "file" for a local file, "redis" for redis, "etcd" for etcd v3, "sql" for a SQL database, "peer" to replicate between instances
 	StoreOpts              string   // Store-specific options
+	StoreCache             int      // Cache records read from the store for this many seconds. 0 (the default) disables the cache
+	CleanupOnExit          bool     // Remove the records this instance published from the store on shutdown
 	Ttl                    int      // TTL to apply. Defaults to 10
 	NoPtr                  bool     // Don't create ptr records automatically when set
 	Debug                  bool     // More logging when set
 	ResolverTimeout        int      // Pass thru Resolver timeout
 	DockerNetwork          string   // Restrict docker ips to those found on this network
+	DockerWithdrawPaused   bool     // Remove records for paused containers, restoring them on unpause
+	DockerRequireHealthy   bool     // Only publish containers once their healthcheck reports healthy
+	DockerHosts            []string // Docker daemons to monitor. Empty means the daemon from the DOCKER_* environment
+	DockerSwarm            bool     // Publish records for swarm services and tasks
+	DockerTxt              bool     // Publish TXT records describing each container
+	DockerTxtLabels        []string // Container labels to include in TXT records
 }
@@ -0,0 +1,6 @@
+//go:build postgres
+
+package sql_rs
+
+// Left out unless built with -tags postgres
+import _ "github.com/lib/pq"
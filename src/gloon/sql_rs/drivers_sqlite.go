@@ -0,0 +1,6 @@
+//go:build cgo
+
+package sql_rs
+
+// Built in by default. github.com/mattn/go-sqlite3 needs cgo, so builds without it have no sqlite3 driver
+import _ "github.com/mattn/go-sqlite3"
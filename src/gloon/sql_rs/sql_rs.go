@@ -0,0 +1,267 @@
+package sql_rs
+
+import (
+	"database/sql"
+	"fmt"
+	"gloon/record_store"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Schema changes, in order. Version n of the schema has the first n applied. Add to the end, and
+// never change one that has been released
+var migrations = [][]string{
+	{
+		`CREATE TABLE gloon_records (type INTEGER NOT NULL, name TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (type, name, value))`,
+		`CREATE INDEX gloon_records_name ON gloon_records (name)`,
+	},
+	{
+		`CREATE TABLE gloon_meta (type INTEGER NOT NULL, name TEXT NOT NULL, meta TEXT NOT NULL, PRIMARY KEY (type, name))`,
+	},
+}
+
+const (
+	createSchemaTable = `CREATE TABLE IF NOT EXISTS gloon_schema (version INTEGER NOT NULL)`
+	selectVersion     = `SELECT COALESCE(MAX(version), 0) FROM gloon_schema`
+	insertVersion     = `INSERT INTO gloon_schema (version) VALUES (?)`
+	insertValue       = `INSERT INTO gloon_records (type, name, value) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+	selectValues      = `SELECT value FROM gloon_records WHERE type = ? AND name = ?`
+	deleteKey         = `DELETE FROM gloon_records WHERE type = ? AND name = ?`
+	deleteValue       = `DELETE FROM gloon_records WHERE type = ? AND name = ? AND value = ?`
+	selectAll         = `SELECT type, name, value FROM gloon_records ORDER BY type, name, value`
+	deleteAll         = `DELETE FROM gloon_records`
+	selectMeta        = `SELECT meta FROM gloon_meta WHERE type = ? AND name = ?`
+	upsertMeta        = `INSERT INTO gloon_meta (type, name, meta) VALUES (?, ?, ?) ON CONFLICT (type, name) DO UPDATE SET meta = excluded.meta`
+	deleteMeta        = `DELETE FROM gloon_meta WHERE type = ? AND name = ?`
+	selectAllMeta     = `SELECT type, name, meta FROM gloon_meta`
+	deleteAllMeta     = `DELETE FROM gloon_meta`
+)
+
+// A RecordStore in a SQL database, one row per value, and one per key with metadata. Works with PostgreSQL (9.5 or later) and
+// SQLite (3.24 or later). The driver has to be compiled in, see drivers_*.go
+type SqlRecordStore struct {
+	db       *sql.DB
+	postgres bool // Uses $1 placeholders rather than ?
+}
+
+// opts is "DRIVER:DSN", ex. "postgres:postgres://gloon@db/gloon" or "sqlite3:/var/lib/gloon/records.sqlite".
+// The schema is created, or brought up to date, before returning
+func Create(opts string) (r *SqlRecordStore, err error) {
+	parts := strings.SplitN(opts, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("Expected DRIVER:DSN in store options")
+	}
+	driver, dsn := parts[0], parts[1]
+	if !hasDriver(driver) {
+		return nil, fmt.Errorf("No %s driver in this build. Available: %s", driver, strings.Join(sql.Drivers(), ", "))
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return
+	}
+	r = &SqlRecordStore{db: db, postgres: driver == "postgres" || driver == "pgx"}
+	if err = r.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to update the schema: %s", err.Error())
+	}
+	return
+}
+
+func hasDriver(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Queries are written with ? placeholders
+func (r *SqlRecordStore) rebind(query string) string {
+	if !r.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Apply the migrations the database hasn't had, each in its own transaction
+func (r *SqlRecordStore) migrate() (err error) {
+	if _, err = r.db.Exec(createSchemaTable); err != nil {
+		return
+	}
+	var version int
+	if err = r.db.QueryRow(selectVersion).Scan(&version); err != nil {
+		return
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("Schema version %d is newer than this gloon knows (%d)", version, len(migrations))
+	}
+	for v := version + 1; v <= len(migrations); v++ {
+		log.Printf("Updating record schema to version %d", v)
+		tx, err := r.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[v-1] {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %s", v, err.Error())
+			}
+		}
+		if _, err = tx.Exec(r.rebind(insertVersion), v); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func (r *SqlRecordStore) PutVal(dnsType uint16, key, val string) (err error) {
+	_, err = r.db.Exec(r.rebind(insertValue), dnsType, key, val)
+	return
+}
+
+func (r *SqlRecordStore) GetAll(dnsType uint16, key string) (vals []string, err error) {
+	rows, err := r.db.Query(r.rebind(selectValues), dnsType, key)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	vals = []string{}
+	for rows.Next() {
+		var v string
+		if err = rows.Scan(&v); err != nil {
+			return
+		}
+		vals = append(vals, v)
+	}
+	return vals, rows.Err()
+}
+
+func (r *SqlRecordStore) GetMeta(dnsType uint16, key string) (meta string, err error) {
+	err = r.db.QueryRow(r.rebind(selectMeta), dnsType, key).Scan(&meta)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// The values and metadata go in one transaction
+func (r *SqlRecordStore) DelKey(dnsType uint16, key string) (err error) {
+	return r.Apply([]record_store.StoreOp{{Type: record_store.StoreDelKey, DnsType: dnsType, Key: key}})
+}
+
+func (r *SqlRecordStore) DelVal(dnsType uint16, key, val string) (err error) {
+	_, err = r.db.Exec(r.rebind(deleteValue), dnsType, key, val)
+	return
+}
+
+// Apply ops in a transaction
+func (r *SqlRecordStore) Apply(ops []record_store.StoreOp) (err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case record_store.StorePut:
+			_, err = tx.Exec(r.rebind(insertValue), op.DnsType, op.Key, op.Val)
+		case record_store.StoreDelVal:
+			_, err = tx.Exec(r.rebind(deleteValue), op.DnsType, op.Key, op.Val)
+		case record_store.StoreDelKey:
+			if _, err = tx.Exec(r.rebind(deleteKey), op.DnsType, op.Key); err == nil {
+				_, err = tx.Exec(r.rebind(deleteMeta), op.DnsType, op.Key)
+			}
+		case record_store.StoreSetMeta:
+			if op.Val == "" {
+				_, err = tx.Exec(r.rebind(deleteMeta), op.DnsType, op.Key)
+			} else {
+				_, err = tx.Exec(r.rebind(upsertMeta), op.DnsType, op.Key, op.Val)
+			}
+		default:
+			err = fmt.Errorf("Unknown store operation %d", op.Type)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *SqlRecordStore) All() (records []record_store.StoreRecord, err error) {
+	metas, err := r.allMeta()
+	if err != nil {
+		return
+	}
+	rows, err := r.db.Query(selectAll)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dnsType uint16
+		var key, val string
+		if err = rows.Scan(&dnsType, &key, &val); err != nil {
+			return
+		}
+		// Rows come sorted, so a record's values are together
+		if n := len(records); n > 0 && records[n-1].DnsType == dnsType && records[n-1].Key == key {
+			records[n-1].Vals = append(records[n-1].Vals, val)
+			continue
+		}
+		meta := metas[record_store.StoreKey{DnsType: dnsType, Key: key}]
+		records = append(records, record_store.StoreRecord{DnsType: dnsType, Key: key, Vals: []string{val}, Meta: meta})
+	}
+	return records, rows.Err()
+}
+
+func (r *SqlRecordStore) allMeta() (metas map[record_store.StoreKey]string, err error) {
+	rows, err := r.db.Query(selectAllMeta)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	metas = make(map[record_store.StoreKey]string)
+	for rows.Next() {
+		var k record_store.StoreKey
+		var meta string
+		if err = rows.Scan(&k.DnsType, &k.Key, &meta); err != nil {
+			return
+		}
+		metas[k] = meta
+	}
+	return metas, rows.Err()
+}
+
+func (r *SqlRecordStore) Clear() (err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	for _, stmt := range []string{deleteAll, deleteAllMeta} {
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *SqlRecordStore) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,278 @@
+package sql_rs
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"gloon/record_set"
+	"gloon/rstest"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// A database/sql driver that understands just the statements the store uses, so the store can be
+// tested without a database. Set GLOON_TEST_SQL to DRIVER:DSN to also test against a real one
+type fakeDb struct {
+	sync.Mutex // Held for the whole of a transaction
+	version    int
+	tables     bool // Set by the first migration
+	rows       map[string]bool
+	meta       map[string]string // Keyed by type and name
+	saved      map[string]bool   // Rows when the open transaction began
+	savedMeta  map[string]string
+}
+
+type fakeDriver struct {
+	sync.Mutex
+	dbs map[string]*fakeDb
+}
+
+var fakes = &fakeDriver{dbs: make(map[string]*fakeDb)}
+
+// Databases opened so far, so each test run (ex. with -count) gets new ones
+var fakeRuns int64
+
+// A fresh database for t, as its database name and its --store-opts
+func fakeDsn(t *testing.T) (name, opts string) {
+	name = fmt.Sprintf("%s-%d", t.Name(), atomic.AddInt64(&fakeRuns, 1))
+	return name, "fakesql:" + name
+}
+
+func init() {
+	sql.Register("fakesql", fakes)
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.dbs[name] == nil {
+		d.dbs[name] = &fakeDb{rows: make(map[string]bool), meta: make(map[string]string)}
+	}
+	return &fakeConn{db: d.dbs[name]}, nil
+}
+
+type fakeConn struct {
+	db   *fakeDb
+	inTx bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.Lock()
+	c.inTx = true
+	c.db.saved = make(map[string]bool)
+	for k := range c.db.rows {
+		c.db.saved[k] = true
+	}
+	c.db.savedMeta = make(map[string]string)
+	for k, v := range c.db.meta {
+		c.db.savedMeta[k] = v
+	}
+	return c, nil
+}
+func (c *fakeConn) Commit() error {
+	c.inTx = false
+	c.db.Unlock()
+	return nil
+}
+func (c *fakeConn) Rollback() error {
+	c.db.rows, c.db.meta = c.db.saved, c.db.savedMeta
+	return c.Commit()
+}
+
+// Outside a transaction, each statement locks the database itself
+func (c *fakeConn) lock() func() {
+	if c.inTx {
+		return func() {}
+	}
+	c.db.Lock()
+	return c.db.Unlock
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func rowKey(args ...driver.Value) string {
+	return fmt.Sprintf("%v\x00%v\x00%v", args[0], args[1], args[2])
+}
+
+func metaKey(args ...driver.Value) string {
+	return fmt.Sprintf("%v\x00%v", args[0], args[1])
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	defer s.conn.lock()()
+	if !db.tables && strings.Contains(s.query, "gloon_records") && !strings.HasPrefix(s.query, "CREATE") {
+		return nil, fmt.Errorf("no such table: gloon_records")
+	}
+	switch s.query {
+	case createSchemaTable:
+	case insertVersion:
+		db.version = int(args[0].(int64))
+	case migrations[0][0]:
+		db.tables = true
+	case migrations[0][1], migrations[1][0]:
+	case insertValue:
+		db.rows[rowKey(args...)] = true
+	case deleteValue:
+		delete(db.rows, rowKey(args...))
+	case deleteKey:
+		prefix := fmt.Sprintf("%v\x00%v\x00", args[0], args[1])
+		for k := range db.rows {
+			if strings.HasPrefix(k, prefix) {
+				delete(db.rows, k)
+			}
+		}
+	case deleteAll:
+		db.rows = make(map[string]bool)
+	case upsertMeta:
+		db.meta[metaKey(args...)] = args[2].(string)
+	case deleteMeta:
+		delete(db.meta, metaKey(args...))
+	case deleteAllMeta:
+		db.meta = make(map[string]string)
+	default:
+		return nil, fmt.Errorf("fakesql: unexpected statement %q", s.query)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	defer s.conn.lock()()
+	var rows [][]driver.Value
+	cols := 1
+	switch s.query {
+	case selectVersion:
+		rows = append(rows, []driver.Value{int64(db.version)})
+	case selectValues, selectAll:
+		var keys []string
+		for k := range db.rows {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts := strings.Split(k, "\x00")
+			if s.query == selectAll {
+				cols = 3
+				rows = append(rows, []driver.Value{parts[0], parts[1], parts[2]})
+			} else if parts[0] == fmt.Sprint(args[0]) && parts[1] == fmt.Sprint(args[1]) {
+				rows = append(rows, []driver.Value{parts[2]})
+			}
+		}
+	case selectMeta:
+		if meta, ok := db.meta[metaKey(args...)]; ok {
+			rows = append(rows, []driver.Value{meta})
+		}
+	case selectAllMeta:
+		cols = 3
+		for k, meta := range db.meta {
+			parts := strings.Split(k, "\x00")
+			rows = append(rows, []driver.Value{parts[0], parts[1], meta})
+		}
+	default:
+		return nil, fmt.Errorf("fakesql: unexpected query %q", s.query)
+	}
+	return &fakeRows{rows: rows, cols: cols}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	cols int
+}
+
+func (r *fakeRows) Columns() []string { return make([]string, r.cols) }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func openStore(t *testing.T, opts string) record_set.RecordStore {
+	r, err := Create(opts)
+	if err != nil {
+		t.Fatalf("Create(%s) failed: %s", opts, err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestConformance(t *testing.T) {
+	rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+		_, dsn := fakeDsn(t)
+		return openStore(t, dsn+"/"+namespace)
+	})
+	// A file per test and namespace, since a database holds one set of records
+	dir := t.TempDir()
+	t.Run("sqlite3", func(t *testing.T) {
+		if !hasDriver("sqlite3") {
+			t.Skip("No sqlite3 driver in this build")
+		}
+		rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+			return openStore(t, "sqlite3:"+filepath.Join(dir, strings.Replace(t.Name(), "/", "-", -1)+"-"+namespace+".sqlite"))
+		})
+	})
+	if real := os.Getenv("GLOON_TEST_SQL"); real != "" {
+		t.Run("GLOON_TEST_SQL", func(t *testing.T) {
+			rstest.Run(t, func(t *testing.T, namespace string) record_set.RecordStore {
+				if namespace != "test" {
+					t.Skip("A database holds one set of records")
+				}
+				return openStore(t, real)
+			})
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	name, dsn := fakeDsn(t)
+	r, err := Create(dsn)
+	if err != nil {
+		t.Fatal("Create()", err)
+	}
+	r.PutVal(1, "foo.bar", "127.0.0.1")
+	r.Close()
+	// Reopening leaves the schema and records alone
+	if r, err = Create(dsn); err != nil {
+		t.Fatal("Create() of an existing database", err)
+	}
+	if vals, _ := r.GetAll(1, "foo.bar"); len(vals) != 1 {
+		t.Errorf("Got %v after reopening -- expected [127.0.0.1]", vals)
+	}
+	r.Close()
+	fakes.Lock()
+	fakes.dbs[name].version = len(migrations) + 1
+	fakes.Unlock()
+	if _, err = Create(dsn); err == nil {
+		t.Error("Create() accepted a schema from a newer version")
+	}
+	for _, opts := range []string{"", "fakesql", "nosuchdriver:x"} {
+		if _, err = Create(opts); err == nil {
+			t.Errorf("Create(%q) succeeded", opts)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	r := &SqlRecordStore{postgres: true}
+	if q := r.rebind(deleteValue); q != `DELETE FROM gloon_records WHERE type = $1 AND name = $2 AND value = $3` {
+		t.Errorf("Got %s", q)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/miekg/dns"
+	. "gloon/record_set"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task addresses change without generating service or node events, so we also resync periodically
+const swarmResyncInterval = 30 * time.Second
+
+// Swarm event types. These are not defined by the vendored docker api types
+var swarmEventTypes = []string{"service", "node"}
+
+// A swarm manager we can publish service records for
+type SwarmSource interface {
+	IsSwarmManager(ctx context.Context) (bool, error)
+	SwarmEvents(ctx context.Context) (<-chan events.Message, <-chan error) // Service and node events. Stops when ctx is cancelled or on error
+	Services(ctx context.Context) ([]swarm.Service, error)
+	RunningTasks(ctx context.Context) ([]swarm.Task, error)
+	NetworkNames(ctx context.Context) (map[string]string, error) // Keyed by network ID
+	String() string                                              // Name used in logs
+}
+
+// Publishes records for swarm services (the service VIP) and their tasks (tasks.<service>, one
+// value per running task), the same way docker's embedded DNS does inside overlay networks
+type SwarmMonitor struct {
+	recs   *RecordSet
+	source SwarmSource
+	resync time.Duration
+	sync.Mutex
+	settings *Settings
+	domain   string
+	records  map[HostPair]bool // Records we have published
+}
+
+func NewSwarmMonitor(recs *RecordSet, settings *Settings, source SwarmSource, domain string) *SwarmMonitor {
+	return &SwarmMonitor{recs: recs, source: source, resync: swarmResyncInterval, settings: settings, domain: domain, records: make(map[HostPair]bool)}
+}
+
+// Apply new settings, and republish the swarm's records under them
+func (sm *SwarmMonitor) Reconfigure(settings *Settings, domain string) {
+	sm.Lock()
+	sm.settings, sm.domain = settings, domain
+	sm.Unlock()
+	sm.sync()
+}
+
+// Keep swarm records in sync until ctx is cancelled
+func (sm *SwarmMonitor) Run(ctx context.Context) (err error) {
+	manager, err := sm.source.IsSwarmManager(ctx)
+	if err != nil {
+		return
+	}
+	if !manager {
+		return fmt.Errorf("%s is not a swarm manager", sm.source)
+	}
+	log.Printf("Starting swarm monitor for %s...", sm.source)
+	defer func() {
+		if r := recover(); r != nil {
+			handlePanic(r)
+		}
+	}()
+	ticker := time.NewTicker(sm.resync)
+	defer ticker.Stop()
+	for {
+		sm.sync()
+		evCtx, cancel := context.WithCancel(ctx)
+		ev, ev_err := sm.source.SwarmEvents(evCtx)
+	events:
+		for {
+			select {
+			case event := <-ev:
+				if sm.debug() {
+					log.Printf("Got swarm event from %s: %s %s %s", sm.source, event.Type, event.Action, event.Actor.ID)
+				}
+				sm.sync()
+			case <-ticker.C:
+				sm.sync()
+			case err := <-ev_err:
+				if ctx.Err() != nil {
+					cancel()
+					return nil
+				}
+				// Keep the records we have, and resubscribe at the next resync
+				log.Printf("Swarm event stream from %s failed: %s", sm.source, err.Error())
+				break events
+			}
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (sm *SwarmMonitor) debug() bool {
+	sm.Lock()
+	defer sm.Unlock()
+	return sm.settings.Debug
+}
+
+// Remove every record the monitor published
+func (sm *SwarmMonitor) clear() {
+	sm.Lock()
+	defer sm.Unlock()
+	for hp := range sm.records {
+		sm.recs.DelAddr(dns.TypeA, hp.host, hp.addr)
+	}
+	sm.records = make(map[HostPair]bool)
+}
+
+// Rebuild the full set of swarm records and apply the difference to the record set
+func (sm *SwarmMonitor) sync() {
+	sm.Lock()
+	defer sm.Unlock()
+	records, err := sm.currentRecords()
+	if err != nil {
+		log.Printf("Unable to list swarm services on %s: %s", sm.source, err.Error())
+		return
+	}
+	for hp := range records {
+		if !sm.records[hp] {
+			sm.recs.Put(dns.TypeA, hp.host, hp.addr)
+		}
+	}
+	for hp := range sm.records {
+		if !records[hp] {
+			sm.recs.DelAddr(dns.TypeA, hp.host, hp.addr)
+		}
+	}
+	sm.records = records
+}
+
+func (sm *SwarmMonitor) currentRecords() (records map[HostPair]bool, err error) {
+	ctx := context.Background()
+	records = make(map[HostPair]bool)
+	services, err := sm.source.Services(ctx)
+	if err != nil {
+		return
+	}
+	tasks, err := sm.source.RunningTasks(ctx)
+	if err != nil {
+		return
+	}
+	networkNames, err := sm.source.NetworkNames(ctx)
+	if err != nil {
+		return
+	}
+	serviceNames := make(map[string]string)
+	for _, svc := range services {
+		name := svc.Spec.Name
+		serviceNames[svc.ID] = name
+		for _, vip := range svc.Endpoint.VirtualIPs {
+			if sm.useNetwork(networkNames[vip.NetworkID]) {
+				records[HostPair{sm.hostname(name), stripPrefixLen(vip.Addr)}] = true
+			}
+		}
+	}
+	for _, task := range tasks {
+		name, ok := serviceNames[task.ServiceID]
+		if !ok || task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		for _, att := range task.NetworksAttachments {
+			if !sm.useNetwork(att.Network.Spec.Name) {
+				continue
+			}
+			for _, addr := range att.Addresses {
+				records[HostPair{sm.hostname("tasks." + name), stripPrefixLen(addr)}] = true
+			}
+		}
+	}
+	return
+}
+
+// Addresses on the ingress network are only reachable through the routing mesh, so we skip them
+func (sm *SwarmMonitor) useNetwork(name string) bool {
+	if sm.settings.DockerNetwork != "" {
+		return name == sm.settings.DockerNetwork
+	}
+	return name != "ingress"
+}
+
+func (sm *SwarmMonitor) hostname(name string) string {
+	if sm.domain != "" {
+		return fmt.Sprintf("%s.%s", name, sm.domain)
+	}
+	return name
+}
+
+// Swarm reports addresses in CIDR notation
+func stripPrefixLen(addr string) string {
+	if i := strings.Index(addr, "/"); i != -1 {
+		return addr[:i]
+	}
+	return addr
+}
+
+func (ds *DockerSource) IsSwarmManager(ctx context.Context) (bool, error) {
+	info, err := ds.cli.Info(ctx)
+	return info.Swarm.ControlAvailable, err
+}
+
+func (ds *DockerSource) SwarmEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	f := filters.NewArgs()
+	for _, t := range swarmEventTypes {
+		f.Add("type", t)
+	}
+	return ds.cli.Events(ctx, types.EventsOptions{Filters: f})
+}
+
+func (ds *DockerSource) Services(ctx context.Context) ([]swarm.Service, error) {
+	return ds.cli.ServiceList(ctx, types.ServiceListOptions{})
+}
+
+func (ds *DockerSource) RunningTasks(ctx context.Context) ([]swarm.Task, error) {
+	f := filters.NewArgs()
+	f.Add("desired-state", string(swarm.TaskStateRunning))
+	return ds.cli.TaskList(ctx, types.TaskListOptions{Filters: f})
+}
+
+func (ds *DockerSource) NetworkNames(ctx context.Context) (names map[string]string, err error) {
+	networks, err := ds.cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return
+	}
+	names = make(map[string]string)
+	for _, nw := range networks {
+		names[nw.ID] = nw.Name
+	}
+	return
+}
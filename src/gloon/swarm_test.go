@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"testing"
+	"time"
+)
+
+func (fs *fakeSource) IsSwarmManager(ctx context.Context) (bool, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.manager, nil
+}
+
+// Like the docker client, the stream reports an error once ctx is cancelled
+func (fs *fakeSource) SwarmEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	errs := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return fs.swarmEvents, errs
+}
+
+func (fs *fakeSource) Services(ctx context.Context) ([]swarm.Service, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return append([]swarm.Service(nil), fs.services...), nil
+}
+
+func (fs *fakeSource) RunningTasks(ctx context.Context) ([]swarm.Task, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return append([]swarm.Task(nil), fs.tasks...), nil
+}
+
+func (fs *fakeSource) NetworkNames(ctx context.Context) (map[string]string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	names := make(map[string]string)
+	for ID, name := range fs.networks {
+		names[ID] = name
+	}
+	return names, nil
+}
+
+func (fs *fakeSource) setSwarm(services []swarm.Service, tasks []swarm.Task) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.services, fs.tasks = services, tasks
+}
+
+func testService(ID, name string, vips ...swarm.EndpointVirtualIP) swarm.Service {
+	svc := swarm.Service{ID: ID, Endpoint: swarm.Endpoint{VirtualIPs: vips}}
+	svc.Spec.Name = name
+	return svc
+}
+
+func testTask(serviceID string, state swarm.TaskState, network string, addrs ...string) swarm.Task {
+	att := swarm.NetworkAttachment{Addresses: addrs}
+	att.Network.Spec.Name = network
+	task := swarm.Task{ServiceID: serviceID, NetworksAttachments: []swarm.NetworkAttachment{att}}
+	task.Status.State = state
+	return task
+}
+
+func newTestSwarm(settings *Settings) (*SwarmMonitor, *fakeSource, *record_set.RecordSet) {
+	fs := newFakeSource()
+	fs.manager = true
+	fs.networks = map[string]string{"n1": "front", "n2": "ingress", "n3": "back"}
+	recs := record_set.Create(mem_rs.Create())
+	return NewSwarmMonitor(recs, settings, fs, "docker"), fs, recs
+}
+
+func expectAddrs(t *testing.T, recs *record_set.RecordSet, host string, expected ...string) {
+	t.Helper()
+	vals := recs.GetAll(1, host)
+	if len(vals) != len(expected) {
+		t.Errorf("Got %v for %s -- expected %v", vals, host, expected)
+		return
+	}
+	for _, v := range expected {
+		if !containsString(vals, v) {
+			t.Errorf("Got %v for %s -- expected %v", vals, host, expected)
+			return
+		}
+	}
+}
+
+func TestSwarmSync(t *testing.T) {
+	sm, fs, recs := newTestSwarm(&Settings{})
+	fs.setSwarm([]swarm.Service{
+		testService("s1", "web", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.0.2/24"}, swarm.EndpointVirtualIP{NetworkID: "n2", Addr: "10.255.0.2/16"}),
+		testService("s2", "db", swarm.EndpointVirtualIP{NetworkID: "n3", Addr: "10.0.1.2/24"}),
+	}, []swarm.Task{
+		testTask("s1", swarm.TaskStateRunning, "front", "10.0.0.3/24"),
+		testTask("s1", swarm.TaskStateRunning, "front", "10.0.0.4/24"),
+		testTask("s1", swarm.TaskStateRunning, "ingress", "10.255.0.3/16"),
+		testTask("s1", swarm.TaskStateStarting, "front", "10.0.0.5/24"),
+		testTask("s9", swarm.TaskStateRunning, "front", "10.0.0.9/24"), // Unknown service
+		testTask("s2", swarm.TaskStateRunning, "back", "10.0.1.3/24"),
+	})
+	sm.sync()
+	expectAddrs(t, recs, "web.docker.", "10.0.0.2")
+	expectAddrs(t, recs, "tasks.web.docker.", "10.0.0.3", "10.0.0.4")
+	expectAddrs(t, recs, "db.docker.", "10.0.1.2")
+	expectAddrs(t, recs, "tasks.db.docker.", "10.0.1.3")
+
+	// A task goes away, and so does a service
+	fs.setSwarm([]swarm.Service{
+		testService("s1", "web", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.0.2/24"}),
+	}, []swarm.Task{
+		testTask("s1", swarm.TaskStateRunning, "front", "10.0.0.4/24"),
+	})
+	sm.sync()
+	expectAddrs(t, recs, "web.docker.", "10.0.0.2")
+	expectAddrs(t, recs, "tasks.web.docker.", "10.0.0.4")
+	expectAddrs(t, recs, "db.docker.")
+	expectAddrs(t, recs, "tasks.db.docker.")
+
+	sm.clear()
+	expectAddrs(t, recs, "web.docker.")
+	expectAddrs(t, recs, "tasks.web.docker.")
+}
+
+// With a docker network set, only addresses on it are published
+func TestSwarmNetwork(t *testing.T) {
+	sm, fs, recs := newTestSwarm(&Settings{DockerNetwork: "back"})
+	fs.setSwarm([]swarm.Service{
+		testService("s1", "web", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.0.2/24"}, swarm.EndpointVirtualIP{NetworkID: "n3", Addr: "10.0.1.2/24"}),
+	}, []swarm.Task{
+		testTask("s1", swarm.TaskStateRunning, "front", "10.0.0.3/24"),
+		testTask("s1", swarm.TaskStateRunning, "back", "10.0.1.3/24"),
+	})
+	sm.sync()
+	expectAddrs(t, recs, "web.docker.", "10.0.1.2")
+	expectAddrs(t, recs, "tasks.web.docker.", "10.0.1.3")
+}
+
+// Records follow events, and a periodic resync catches changes that come without one
+func TestSwarmRun(t *testing.T) {
+	sm, fs, recs := newTestSwarm(&Settings{})
+	sm.resync = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sm.Run(ctx)
+	}()
+	fs.setSwarm([]swarm.Service{testService("s1", "web", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.0.2/24"})}, nil)
+	fs.swarmEvents <- events.Message{Type: "service", Action: "create"}
+	fs.swarmEvents <- events.Message{Type: "service", Action: "update"} // Handled after the first
+	expectAddrs(t, recs, "web.docker.", "10.0.0.2")
+
+	fs.setSwarm([]swarm.Service{testService("s1", "web", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.0.2/24"})},
+		[]swarm.Task{testTask("s1", swarm.TaskStateRunning, "front", "10.0.0.3/24")})
+	deadline := time.Now().Add(2 * time.Second)
+	for len(recs.GetAll(1, "tasks.web.docker.")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error("Run() after cancel", err)
+	}
+	expectAddrs(t, recs, "tasks.web.docker.", "10.0.0.3")
+
+	// Only managers know about services
+	sm, fs, _ = newTestSwarm(&Settings{})
+	fs.manager = false
+	if err := sm.Run(context.Background()); err == nil {
+		t.Error("Run() on a worker succeeded")
+	}
+}
+
+func TestSwarmReconfigure(t *testing.T) {
+	sm, fs, recs := newTestSwarm(&Settings{})
+	fs.setSwarm([]swarm.Service{
+		testService("s1", "web", swarm.EndpointVirtualIP{NetworkID: "n1", Addr: "10.0.0.2/24"}, swarm.EndpointVirtualIP{NetworkID: "n3", Addr: "10.0.1.2/24"}),
+	}, nil)
+	sm.sync()
+	expectAddrs(t, recs, "web.docker.", "10.0.0.2", "10.0.1.2")
+
+	sm.Reconfigure(&Settings{DockerNetwork: "back"}, "swarm")
+	expectAddrs(t, recs, "web.docker.")
+	expectAddrs(t, recs, "web.swarm.", "10.0.1.2")
+}
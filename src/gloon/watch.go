@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"github.com/rjeczalik/notify"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Quiet period after the last file event before we reload. Editors that save atomically and
+// ConfigMap style symlink swaps produce bursts of create/rename/remove events
+const WATCH_DEBOUNCE = 250 * time.Millisecond
+
+// Polling interval used when native notifications are unavailable, ex. the directory is missing
+const WATCH_FALLBACK_INTERVAL = 5 * time.Second
+
+// Calls reload whenever one of the watched paths may have changed. The directories containing
+// the paths, and their symlink targets, are watched for creates, writes, renames and removes.
+// If a reload interval is set we poll instead
+type FileWatcher struct {
+	name           string          // Used in logs
+	paths          func() []string // Files or directories to watch. Called again after each reload
+	reloadInterval int
+	reload         func()
+}
+
+// Watch until ctx is cancelled
+func (fw *FileWatcher) Run(ctx context.Context) {
+	fw.reload()
+	if fw.reloadInterval > 0 {
+		for {
+			select {
+			case <-time.After(time.Duration(fw.reloadInterval) * time.Second):
+				fw.reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	for ctx.Err() == nil {
+		dirs := fw.watchDirs()
+		if err := fw.watch(ctx, dirs); err != nil {
+			log.Printf("WARNING: notifications for %s could not be set up: %s. Polling every %s", fw.name, err.Error(), WATCH_FALLBACK_INTERVAL)
+			fw.pollUntilWatchable(ctx)
+		}
+	}
+}
+
+// Watch dirs until the set of directories we should watch changes, or one of them goes away
+func (fw *FileWatcher) watch(ctx context.Context, dirs []string) error {
+	c := make(chan notify.EventInfo, 16)
+	defer notify.Stop(c)
+	for _, dir := range dirs {
+		if err := notify.Watch(dir, c, notify.All); err != nil {
+			return err
+		}
+	}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-c:
+			debounce = time.After(WATCH_DEBOUNCE)
+		case <-debounce:
+			debounce = nil
+			log.Printf("Reloading modified %s", fw.name)
+			fw.reload()
+			if current := fw.watchDirs(); strings.Join(current, "\n") != strings.Join(dirs, "\n") || !dirsExist(dirs) {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (fw *FileWatcher) pollUntilWatchable(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(WATCH_FALLBACK_INTERVAL):
+		case <-ctx.Done():
+			return
+		}
+		fw.reload()
+		if dirsExist(fw.watchDirs()) {
+			return
+		}
+	}
+}
+
+// Directories to watch: the paths themselves if they are directories, else their parent. Symlinks
+// are followed so edits to the target are seen as well as swaps of the link itself
+func (fw *FileWatcher) watchDirs() (dirs []string) {
+	seen := make(map[string]bool)
+	add := func(p string) {
+		dir := p
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			dir = filepath.Dir(p)
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, p := range fw.paths() {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		add(abs)
+		if target, err := filepath.EvalSymlinks(abs); err == nil && target != abs {
+			add(target)
+		}
+	}
+	sort.Strings(dirs)
+	return
+}
+
+func dirsExist(dirs []string) bool {
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	. "gloon/record_set"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Record types we load from zone files. Anything else (SOA, AAAA, ...) is skipped
+var zoneTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeCNAME: true,
+	dns.TypeMX:    true,
+	dns.TypeSRV:   true,
+	dns.TypeNS:    true,
+	dns.TypeTXT:   true,
+	dns.TypePTR:   true,
+}
+
+type ZoneRecord struct {
+	dnsType   uint16
+	host, val string
+}
+
+// The records of a name and type share a TTL
+type ZoneRRset struct {
+	dnsType uint16
+	host    string
+}
+
+// How deep $INCLUDE can nest, as in miekg/dns
+const ZONE_INCLUDE_DEPTH = 7
+
+// RFC 1035 master file record source. Supports $ORIGIN, $TTL and $INCLUDE. Like Hostfile,
+// the file is watched and changes are applied as a diff against what was loaded before. Included
+// files are watched too
+type Zonefile struct {
+	records        map[ZoneRecord]bool
+	ttls           map[ZoneRRset]uint32
+	files          []string // The file and those it included, as of the last load
+	fn             string
+	recs           *RecordSet
+	reloadInterval int
+}
+
+func NewZonefile(fn string, recs *RecordSet, reloadInterval int) (zf *Zonefile) {
+	zf = &Zonefile{make(map[ZoneRecord]bool), make(map[ZoneRRset]uint32), []string{fn}, fn, recs, reloadInterval}
+	return
+}
+
+// Load and watch the file until ctx is cancelled
+func (zf *Zonefile) Run(ctx context.Context) {
+	fw := &FileWatcher{
+		name:           "zonefile " + zf.fn,
+		paths:          func() []string { return zf.files },
+		reloadInterval: zf.reloadInterval,
+		reload: func() {
+			// On errors we keep serving the records we loaded last time
+			if err := zf.loadZone(); err != nil {
+				log.Printf("Unable to load zone file: %s", err.Error())
+			}
+		},
+	}
+	fw.Run(ctx)
+}
+
+func (zf *Zonefile) loadZone() (err error) {
+	zp := newZoneParser()
+	err = zp.parse(zf.fn, ".", "", 0)
+	// Watch whatever we got to, so fixing a broken include reloads the zone
+	zf.files = zp.files
+	if err != nil {
+		return
+	}
+	for zr := range zp.records {
+		if !zf.records[zr] {
+			zf.recs.Put(zr.dnsType, zr.host, zr.val)
+		}
+	}
+	for rrset, ttl := range zp.ttls {
+		if old, ok := zf.ttls[rrset]; !ok || old != ttl {
+			zf.recs.SetTtl(rrset.dnsType, rrset.host, &ttl)
+		}
+	}
+	// Remove records not in new file. A record's TTL goes with its last value
+	for zr := range zf.records {
+		if !zp.records[zr] {
+			zf.recs.DelAddr(zr.dnsType, zr.host, zr.val)
+		}
+	}
+	zf.records, zf.ttls = zp.records, zp.ttls
+	return
+}
+
+// Remove every record loaded from the file
+func (zf *Zonefile) clear() {
+	for zr := range zf.records {
+		zf.recs.DelAddr(zr.dnsType, zr.host, zr.val)
+	}
+	zf.records = make(map[ZoneRecord]bool)
+	zf.ttls = make(map[ZoneRRset]uint32)
+}
+
+// Records read from a zone file and the files it includes. The whole zone is parsed before
+// anything is returned, so a broken file never leaves us with half a zone
+type zoneParser struct {
+	records map[ZoneRecord]bool
+	ttls    map[ZoneRRset]uint32 // The lowest TTL given for each record set
+	files   []string
+}
+
+func newZoneParser() *zoneParser {
+	return &zoneParser{records: make(map[ZoneRecord]bool), ttls: make(map[ZoneRRset]uint32)}
+}
+
+// Parse fn with origin and ttl as its starting $ORIGIN and $TTL. miekg/dns opens $INCLUDE paths
+// relative to the working directory, so we handle them here, relative to the including file: the
+// file is parsed in parts between its $INCLUDE lines, each starting with the $ORIGIN and $TTL in
+// effect. Parts are padded with blank lines, so errors give the line in the file
+func (zp *zoneParser) parse(fn, origin, ttl string, depth int) (err error) {
+	zp.files = append(zp.files, fn)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	partOrigin, partTtl, partStart := origin, ttl, 0
+	for i, line := range lines {
+		fields := strings.Fields(strings.SplitN(line, ";", 2)[0])
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "$") {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			origin = zoneOrigin(fields[1], origin)
+		case "$TTL":
+			ttl = fields[1]
+		case "$INCLUDE":
+			if err = zp.parsePart(fn, partOrigin, partTtl, partStart, lines[partStart:i]); err != nil {
+				return
+			}
+			if depth+1 > ZONE_INCLUDE_DEPTH {
+				return fmt.Errorf("%s: too deeply nested $INCLUDE on line %d", fn, i+1)
+			}
+			inc := fields[1]
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(fn), inc)
+			}
+			incOrigin := origin
+			if len(fields) > 2 {
+				incOrigin = zoneOrigin(fields[2], origin)
+			}
+			if err = zp.parse(inc, incOrigin, ttl, depth+1); err != nil {
+				return
+			}
+			partOrigin, partTtl, partStart = origin, ttl, i+1
+		}
+	}
+	return zp.parsePart(fn, partOrigin, partTtl, partStart, lines[partStart:])
+}
+
+// Parse lines, which start at line start (from 0) of fn
+func (zp *zoneParser) parsePart(fn, origin, ttl string, start int, lines []string) (err error) {
+	body := strings.Repeat("\n", start) + strings.Join(lines, "")
+	text := body
+	if ttl != "" {
+		if start > 0 {
+			// On the first line, which is blank
+			text = "$TTL " + ttl + body
+		} else {
+			text = "$TTL " + ttl + "\n" + body
+		}
+	}
+	err = parseZoneText(text, origin, fn, func(rr dns.RR) {
+		hdr := rr.Header()
+		if !zoneTypes[hdr.Rrtype] {
+			return
+		}
+		host := strings.TrimSuffix(hdr.Name, ".")
+		zp.records[ZoneRecord{hdr.Rrtype, host, zoneValue(rr)}] = true
+		rrset := ZoneRRset{hdr.Rrtype, host}
+		if old, ok := zp.ttls[rrset]; !ok || hdr.Ttl < old {
+			zp.ttls[rrset] = hdr.Ttl
+		}
+	})
+	if err != nil && text != body && start == 0 {
+		// The $TTL line moved everything down one. The TTL makes no difference to what parses, so
+		// get the error again with the right line
+		err = parseZoneText(body, origin, fn, func(dns.RR) {})
+	}
+	return
+}
+
+func parseZoneText(text, origin, fn string, found func(rr dns.RR)) (err error) {
+	tokens := dns.ParseZone(strings.NewReader(text), origin, fn)
+	for t := range tokens {
+		if t.Error != nil {
+			err = t.Error
+			// Drain the parser so it can exit
+			for range tokens {
+			}
+			return
+		}
+		found(t.RR)
+	}
+	return
+}
+
+// An $ORIGIN or $INCLUDE origin, which may be relative to the current one
+func zoneOrigin(name, current string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	if current == "." {
+		return name + "."
+	}
+	return name + "." + current
+}
+
+// The value we store for a record. Addresses and text are stored bare, other types as presentation
+// format record data
+func zoneValue(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.TXT:
+		return strings.Join(v.Txt, "")
+	case *dns.PTR:
+		return strings.TrimSuffix(v.Ptr, ".")
+	}
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
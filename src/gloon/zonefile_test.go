@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"gloon/mem_rs"
+	"gloon/record_set"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testZone = `$ORIGIN example.test.
+$TTL 300
+@       IN SOA ns.example.test. admin.example.test. 1 7200 3600 1209600 300
+www     IN A     10.0.0.1
+mail 60 IN A     10.0.0.2
+@       IN MX    10 mail
+alias   IN CNAME www
+info    IN TXT   "hello world"
+`
+
+func TestZonefile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-zone")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "example.zone")
+	writeHosts(t, fn, testZone)
+	recs := record_set.Create(mem_rs.Create())
+	zf := NewZonefile(fn, recs, 0)
+	if err := zf.loadZone(); err != nil {
+		t.Fatal("loadZone()", err)
+	}
+	expectAddr(t, recs, "www.example.test.", "10.0.0.1")
+	expectAddr(t, recs, "mail.example.test.", "10.0.0.2")
+	expectTtl(t, recs, dns.TypeA, "www.example.test.", 300)
+	expectTtl(t, recs, dns.TypeA, "mail.example.test.", 60)
+	if mx := recs.Get(dns.TypeMX, "example.test."); mx != "10 mail.example.test." {
+		t.Errorf("Got MX %q", mx)
+	}
+	if txt := recs.Get(dns.TypeTXT, "info.example.test."); txt != "hello world" {
+		t.Errorf("Got TXT %q", txt)
+	}
+
+	// Broken files report the line and keep the old records
+	writeHosts(t, fn, testZone+"broken  IN A     not-an-ip\n")
+	err = zf.loadZone()
+	if err == nil || !strings.Contains(err.Error(), "line: 9") {
+		t.Errorf("Expected parse error on line 9, got %v", err)
+	}
+	expectAddr(t, recs, "www.example.test.", "10.0.0.1")
+
+	writeHosts(t, fn, strings.Replace(testZone, "10.0.0.1", "10.0.0.3", 1))
+	if err := zf.loadZone(); err != nil {
+		t.Fatal("loadZone()", err)
+	}
+	expectAddr(t, recs, "www.example.test.", "10.0.0.3")
+	expectTtl(t, recs, dns.TypeA, "www.example.test.", 300)
+}
+
+func expectTtl(t *testing.T, recs *record_set.RecordSet, dnsType uint16, host string, expected uint32) {
+	t.Helper()
+	if ttl, ok := recs.Ttl(dnsType, host); !ok || ttl != expected {
+		t.Errorf("Got TTL %d, %v for %s -- expected %d", ttl, ok, host, expected)
+	}
+}
+
+func TestZonefileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gloon-zone")
+	if err != nil {
+		t.Fatal("TempDir()", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	fn := filepath.Join(dir, "example.zone")
+	inc := filepath.Join(dir, "sub", "hosts.zone")
+	// Paths are relative to the including file, wherever gloon runs from
+	writeHosts(t, fn, "$ORIGIN example.test.\n$TTL 300\n$INCLUDE sub/hosts.zone hosts\nwww IN A 10.0.0.1\n")
+	writeHosts(t, inc, "db IN A 10.0.1.1\ndb 60 IN A 10.0.1.2\nmail IN A 10.0.1.3\n")
+	recs := record_set.Create(mem_rs.Create())
+	zf := NewZonefile(fn, recs, 0)
+	if err := zf.loadZone(); err != nil {
+		t.Fatal("loadZone()", err)
+	}
+	expectAddr(t, recs, "www.example.test.", "10.0.0.1")
+	if vals := recs.GetAll(dns.TypeA, "db.hosts.example.test."); len(vals) != 2 {
+		t.Errorf("Got %v for the included records", vals)
+	}
+	// Values of a name share the lowest TTL
+	expectTtl(t, recs, dns.TypeA, "db.hosts.example.test.", 60)
+	// and included files start with the including file's $TTL
+	expectTtl(t, recs, dns.TypeA, "mail.hosts.example.test.", 300)
+	if len(zf.files) != 2 || zf.files[1] != inc {
+		t.Errorf("Watching %v -- expected the zone file and %s", zf.files, inc)
+	}
+
+	// Errors in an included file give its name and line
+	writeHosts(t, inc, "db IN A 10.0.1.1\nbroken IN A not-an-ip\n")
+	if err := zf.loadZone(); err == nil || !strings.Contains(err.Error(), "hosts.zone") || !strings.Contains(err.Error(), "line: 2") {
+		t.Errorf("Expected parse error on line 2 of hosts.zone, got %v", err)
+	}
+	// and in the including file, the line after the include
+	writeHosts(t, inc, "db IN A 10.0.1.1\n")
+	writeHosts(t, fn, "$ORIGIN example.test.\n$TTL 300\n$INCLUDE sub/hosts.zone hosts\nbroken IN A not-an-ip\n")
+	if err := zf.loadZone(); err == nil || !strings.Contains(err.Error(), "example.zone") || !strings.Contains(err.Error(), "line: 4") {
+		t.Errorf("Expected parse error on line 4 of example.zone, got %v", err)
+	}
+}